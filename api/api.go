@@ -4,14 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"strconv"
+	"strings"
 	"time"
 
 	"encore.dev/beta/errs"
+	"encore.dev/types/uuid"
 
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/api/db"
 	"github.com/ohmpatel1997/pave-coding-challenge-simon/ledger"
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/money"
 	"github.com/ohmpatel1997/pave-coding-challenge-simon/transfer"
 	tb "github.com/tigerbeetledb/tigerbeetle-go"
+	tb_types "github.com/tigerbeetledb/tigerbeetle-go/pkg/types"
 )
 
 // encore:service
@@ -25,31 +29,255 @@ func initAPIService() (*APIService, error) {
 		return nil, errs.Wrap(errors.New("error connecting to db"), err.Error())
 	}
 
+	chart, err := ledger.NewChartOfAccounts()
+	if err != nil {
+		return nil, err
+	}
+
 	return &APIService{
-		Ledger: ledger.NewLedgerService(tbClient),
+		Ledger: ledger.NewLedgerService(tbClient, chart),
 	}, nil
 }
 
 func (api *APIService) Shutdown(force context.Context) {
-	api.Ledger.TB.Close()
+	api.Ledger.Backend.Close()
 }
 
 //encore:api public method=POST path=/accounts
 func (api *APIService) Account(ctx context.Context, req *AccountReq) error {
-	err := api.Ledger.CreateAccount(req.ID, req.AccountType)
+	currency, err := ledger.CurrencyByCode(req.Currency)
+	if err != nil {
+		return err
+	}
+
+	var accType ledger.AccountType
+	if req.Type != "" {
+		accType, err = api.Ledger.Chart.AccountType(req.Type)
+	} else {
+		accType, err = api.Ledger.Chart.AccountTypeByCode(req.AccountType)
+	}
+	if err != nil {
+		return err
+	}
+
+	var userData tb_types.Uint128
+	if req.UserData != "" {
+		userData, err = tb_types.HexStringToUint128(req.UserData)
+		if err != nil {
+			return &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "user data must be at most 32 hex digits",
+			}
+		}
+	}
+
+	return api.createAccount(ctx, &db.AccountReq{
+		ID:          req.ID,
+		Owner:       req.Owner,
+		DisplayName: req.DisplayName,
+		Currency:    currency.Code,
+		AccountType: accType.Name,
+		CreatedBy:   req.CreatedBy,
+	}, accType, userData)
+}
+
+type AccountReq struct {
+	ID uint64 `json:"id"`
+	// Type is the name of the account type in the chart of accounts, like customer or fee_income
+	Type string `json:"type"`
+	// AccountType is the code of the account type, used when Type is empty
+	AccountType uint16 `json:"account_type"`
+	// Currency is the ISO 4217 code of the account, USD by default
+	Currency    string `json:"currency"`
+	Owner       string `json:"owner"`
+	DisplayName string `json:"display_name"`
+	CreatedBy   string `json:"created_by"`
+	// UserData is stored in the user data of the TigerBeetle account, as at most 32 hex digits
+	UserData string `json:"user_data"`
+}
+
+// createAccount records the account metadata and creates the ledger account in one go: the metadata is
+// only committed once the ledger account exists
+func (api *APIService) createAccount(ctx context.Context, req *db.AccountReq, accType ledger.AccountType, userData tb_types.Uint128) error {
+	if userData != (tb_types.Uint128{}) {
+		req.UserData = userData.String()
+	}
+
+	tx, err := db.AccountDB.Begin(ctx)
+	if err != nil {
+		return errs.Wrap(err, "error starting transaction")
+	}
+
+	inserted, err := db.InsertAccount(ctx, req, tx)
+	if err != nil {
+		tx.Rollback()
+		return errs.Wrap(err, "error recording account")
+	}
+
+	if !inserted {
+		tx.Rollback()
+
+		// the same request again is a no-op, another account with the id is a conflict
+		existing, err := db.GetAccount(ctx, req.ID)
+		if err != nil {
+			return errs.Wrap(err, "error getting account")
+		}
+		if !existing.Matches(req) {
+			return accountExists(req.ID)
+		}
+		return nil
+	}
+
+	err = api.Ledger.CreateAccount(req.ID, accType, req.Currency, userData)
+	if errs.Code(err) == errs.AlreadyExists {
+		tx.Rollback()
+		return accountExists(req.ID)
+	}
 	if err != nil {
+		tx.Rollback()
 		return &errs.Error{
 			Code:    errs.Internal,
 			Message: fmt.Sprintf("error creating account: %s", err.Error()),
 		}
 	}
 
+	err = tx.Commit()
+	if err != nil {
+		return errs.Wrap(err, "error recording account")
+	}
+
 	return nil
 }
 
-type AccountReq struct {
+func accountExists(id uint64) error {
+	return &errs.Error{
+		Code:    errs.AlreadyExists,
+		Message: fmt.Sprintf("account %d already exists", id),
+	}
+}
+
+// SystemAccounts creates the bank's system accounts listed in the chart of accounts, existing ones are kept
+//
+//encore:api public method=POST path=/system-accounts
+func (api *APIService) SystemAccounts(ctx context.Context) (*SystemAccountsResponse, error) {
+	var resp SystemAccountsResponse
+	for _, sa := range api.Ledger.Chart.SystemAccounts() {
+		err := api.createAccount(ctx, &db.AccountReq{
+			ID:          sa.ID,
+			Owner:       "bank",
+			DisplayName: fmt.Sprintf("%s %s", sa.Currency, sa.Role),
+			Currency:    sa.Currency,
+			AccountType: sa.Type.Name,
+			CreatedBy:   "system",
+		}, sa.Type, tb_types.Uint128{})
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Accounts = append(resp.Accounts, SystemAccount{
+			ID:       sa.ID,
+			Role:     string(sa.Role),
+			Type:     sa.Type.Name,
+			Currency: sa.Currency,
+		})
+	}
+
+	return &resp, nil
+}
+
+type SystemAccountsResponse struct {
+	Accounts []SystemAccount
+}
+
+type SystemAccount struct {
+	ID       uint64
+	Role     string
+	Type     string
+	Currency string
+}
+
+const (
+	defaultAccountsLimit = 50
+	maxAccountsLimit     = 100
+)
+
+// ListAccounts lists the accounts by id. Pass the next cursor of a page to get the following one.
+//
+//encore:api public method=GET path=/accounts
+func (api *APIService) ListAccounts(ctx context.Context, req *ListAccountsRequest) (*ListAccountsResponse, error) {
+	limit := req.Limit
+	switch {
+	case limit <= 0:
+		limit = defaultAccountsLimit
+	case limit > maxAccountsLimit:
+		limit = maxAccountsLimit
+	}
+
+	rows, next, err := db.ListAccounts(ctx, &db.ListAccountsReq{
+		Owner:       req.Owner,
+		Currency:    req.Currency,
+		AccountType: req.Type,
+		Status:      req.Status,
+		Cursor:      req.Cursor,
+		Limit:       limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	accounts := make([]AccountInfo, 0, len(rows))
+	for _, a := range rows {
+		accounts = append(accounts, accountInfo(&a))
+	}
+
+	return &ListAccountsResponse{
+		Accounts:   accounts,
+		NextCursor: next,
+	}, nil
+}
+
+type ListAccountsRequest struct {
+	Owner    string `query:"owner"`
+	Currency string `query:"currency"`
+	Type     string `query:"type"`
+	Status   string `query:"status"`
+	Cursor   string `query:"cursor"`
+	Limit    int    `query:"limit"`
+}
+
+type ListAccountsResponse struct {
+	Accounts   []AccountInfo `json:"accounts"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+// AccountInfo is the metadata of an account
+type AccountInfo struct {
 	ID          uint64 `json:"id"`
-	AccountType uint16 `json:"account_type"`
+	Owner       string `json:"owner"`
+	DisplayName string `json:"display_name"`
+	Currency    string `json:"currency"`
+	Type        string `json:"type"`
+	Status      string `json:"status"`
+	// StatusReason is why the status last changed
+	StatusReason string    `json:"status_reason,omitempty"`
+	UserData     string    `json:"user_data,omitempty"`
+	CreatedBy    string    `json:"created_by"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func accountInfo(a *db.Account) AccountInfo {
+	return AccountInfo{
+		ID:           a.ID,
+		Owner:        a.Owner,
+		DisplayName:  a.DisplayName,
+		Currency:     a.Currency,
+		Type:         a.AccountType,
+		Status:       a.Status,
+		StatusReason: a.StatusReason,
+		UserData:     a.UserData,
+		CreatedBy:    a.CreatedBy,
+		CreatedAt:    a.CreatedAt,
+	}
 }
 
 //encore:api public method=GET path=/accounts/:id
@@ -62,29 +290,59 @@ func (api *APIService) GetAccount(ctx context.Context, id uint64) (*AccountResp,
 		}
 	}
 
+	currency, err := ledger.CurrencyByLedger(resp.Ledger)
+	if err != nil {
+		return nil, err
+	}
+
+	accType, err := api.Ledger.Chart.AccountTypeByCode(resp.Code)
+	if err != nil {
+		return nil, err
+	}
+
+	// accounts created before the metadata was recorded have none
+	var info *AccountInfo
+	meta, err := db.GetAccount(ctx, id)
+	switch {
+	case err == nil:
+		i := accountInfo(meta)
+		info = &i
+	case errs.Code(err) != errs.NotFound:
+		return nil, err
+	}
+
 	return &AccountResp{
 		ID:             resp.ID.String(),
 		Ledger:         resp.Ledger,
+		Currency:       currency.Code,
 		Code:           resp.Code,
+		Type:           accType.Name,
+		Category:       string(accType.Category),
 		Flags:          resp.Flags,
 		DebitsPending:  resp.DebitsPending,
 		DebitsPosted:   resp.DebitsPosted,
 		CreditsPending: resp.CreditsPending,
 		CreditsPosted:  resp.CreditsPosted,
 		Timestamp:      time.Unix(0, int64(resp.Timestamp)),
+		Info:           info,
 	}, nil
 }
 
 type AccountResp struct {
 	ID             string
 	Ledger         uint32
+	Currency       string
 	Code           uint16
+	Type           string
+	Category       string
 	Flags          uint16
 	DebitsPending  uint64
 	DebitsPosted   uint64
 	CreditsPending uint64
 	CreditsPosted  uint64
 	Timestamp      time.Time
+	// Info is the metadata of the account, empty for accounts created before it was recorded
+	Info *AccountInfo
 }
 
 //encore:api public method=GET path=/accounts/:id/balance
@@ -97,19 +355,483 @@ func (api *APIService) Balance(ctx context.Context, id uint64) (*BalanceResponse
 		}
 	}
 
+	currency, err := ledger.CurrencyByLedger(acc.Ledger)
+	if err != nil {
+		return nil, err
+	}
+
+	accType, err := api.Ledger.Chart.AccountTypeByCode(acc.Code)
+	if err != nil {
+		return nil, err
+	}
+
+	balance := accType.Balance(acc)
+	available := currency.Format(balance.Available)
+	if balance.Negative {
+		available = "-" + available
+	}
+
 	return &BalanceResponse{
-		AvailableBalance: "$" + strconv.FormatFloat(float64(acc.CreditsPosted-acc.DebitsPosted-acc.DebitsPending)/100, 'f', 2, 64),
-		ReservedBalance:  "$" + strconv.FormatFloat(float64(acc.DebitsPending)/100, 'f', 2, 64),
+		Currency:         currency.Code,
+		AvailableBalance: available,
+		ReservedBalance:  currency.Format(balance.Reserved),
 	}, nil
 }
 
+// requestAmount parses the decimal amount of a request in its currency, the account currency when empty.
+// The amount is required and must not be zero.
+func requestAmount(amount string, currencyCode string, accountCurrency ledger.Currency) (money.Amount, error) {
+	if currencyCode == "" {
+		currencyCode = accountCurrency.Code
+	}
+	if strings.TrimSpace(amount) == "" {
+		return money.Amount{}, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "amount is required",
+		}
+	}
+
+	parsed, err := money.Parse(amount, currencyCode)
+	if err != nil {
+		return money.Amount{}, err
+	}
+	if parsed.IsZero() {
+		return money.Amount{}, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "amount must be greater than zero",
+		}
+	}
+
+	return parsed, nil
+}
+
+// reversalAmount parses the amount of a reversal like requestAmount, a missing or zero amount reverses the whole
+// authorization
+func reversalAmount(amount string, currencyCode string, accountCurrency ledger.Currency) (money.Amount, error) {
+	if currencyCode == "" {
+		currencyCode = accountCurrency.Code
+	}
+	if strings.TrimSpace(amount) == "" {
+		amount = "0"
+	}
+
+	return money.Parse(amount, currencyCode)
+}
+
 type BalanceResponse struct {
+	Currency         string `json:"currency"`
 	AvailableBalance string `json:"available_balance"`
 	ReservedBalance  string `json:"reserved_balance"`
 }
 
+// Transactions lists the transactions of the account, newest first. Pass the next cursor of a page to get the following one.
+//
+//encore:api public method=GET path=/accounts/:id/transactions
+func (api *APIService) Transactions(ctx context.Context, id uint64, req *TransactionsRequest) (*TransactionsResponse, error) {
+	acc, err := api.Ledger.GetAccount(id)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: fmt.Sprintf("error getting account: %s", err.Error()),
+		}
+	}
+
+	currency, err := ledger.CurrencyByLedger(acc.Ledger)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := transfer.ListTransfers(ctx, &transfer.ListTransfersRequest{
+		Account:       id,
+		Progress:      req.TransferProgress,
+		DeclineReason: req.DeclineReason,
+		Direction:     req.Direction,
+		From:          req.From,
+		To:            req.To,
+		Cursor:        req.Cursor,
+		Limit:         req.Limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	transactions := make([]Transaction, 0, len(resp.Transfers))
+	for _, t := range resp.Transfers {
+		txn := Transaction{
+			ID:                    t.ID.String(),
+			Kind:                  t.Kind,
+			Direction:             "debit",
+			CounterpartyAccountID: t.CreditAccountID,
+			Amount:                currency.Format(t.Amount),
+			SettledAmount:         currency.Format(t.SettledAmount),
+			ReversedAmount:        currency.Format(t.ReversedAmount),
+			TransferProgress:      t.TransferProgress,
+			DeclineReason:         t.DeclineReason,
+			MerchantCategoryCode:  t.MerchantCategoryCode,
+			CreatedAt:             t.CreatedAt,
+			ExpiresAt:             t.ExpiresAt,
+		}
+		if t.CreditAccountID == id {
+			txn.Direction = "credit"
+			txn.CounterpartyAccountID = t.DebitAccountID
+		}
+		if t.PresentmentID.Valid {
+			txn.PresentmentID = t.PresentmentID.UUID.String()
+		}
+		if t.CardID.Valid {
+			txn.CardID = t.CardID.UUID.String()
+		}
+		if t.OriginalTransferID.Valid {
+			txn.OriginalTransactionID = t.OriginalTransferID.UUID.String()
+		}
+		transactions = append(transactions, txn)
+	}
+
+	return &TransactionsResponse{
+		Transactions: transactions,
+		NextCursor:   resp.NextCursor,
+	}, nil
+}
+
+type TransactionsRequest struct {
+	TransferProgress string    `query:"transfer_progress"`
+	DeclineReason    string    `query:"decline_reason"`
+	Direction        string    `query:"direction"` // debit or credit
+	From             time.Time `query:"from"`
+	To               time.Time `query:"to"`
+	Cursor           string    `query:"cursor"`
+	Limit            int       `query:"limit"`
+}
+
+type TransactionsResponse struct {
+	Transactions []Transaction `json:"transactions"`
+	NextCursor   string        `json:"next_cursor,omitempty"`
+}
+
+type Transaction struct {
+	ID                    string     `json:"id"`
+	Kind                  string     `json:"kind"`
+	Direction             string     `json:"direction"`
+	CounterpartyAccountID uint64     `json:"counterparty_account_id"`
+	Amount                string     `json:"amount"`
+	SettledAmount         string     `json:"settled_amount"`
+	ReversedAmount        string     `json:"reversed_amount"`
+	TransferProgress      string     `json:"transfer_progress"`
+	DeclineReason         string     `json:"decline_reason,omitempty"`
+	MerchantCategoryCode  string     `json:"mcc,omitempty"`
+	CreatedAt             time.Time  `json:"created_at"`
+	ExpiresAt             *time.Time `json:"expires_at,omitempty"`
+	PresentmentID         string     `json:"presentment_id,omitempty"`
+	CardID                string     `json:"card_id,omitempty"`
+	OriginalTransactionID string     `json:"original_transaction_id,omitempty"`
+}
+
+// GetTransfer returns the transfer as recorded in the transfers table, the ledger transfers booked for it
+// and the status of its workflows.
+//
+//encore:api public method=GET path=/transfers/:id
+func (api *APIService) GetTransfer(ctx context.Context, id uuid.UUID) (*TransferDetailsResponse, error) {
+	details, err := transfer.GetTransfer(ctx, &transfer.GetTransferRequest{ID: id})
+	if err != nil {
+		return nil, err
+	}
+
+	// conversions book a leg in the merchant currency next to each ledger transfer, legs of other transfers aren't found
+	ids := make([]uuid.UUID, 0, 2*len(details.LedgerTransferIDs))
+	for _, ledgerTransferID := range details.LedgerTransferIDs {
+		ids = append(ids, ledgerTransferID, ledger.ConversionLegID(ledgerTransferID))
+	}
+
+	ledgerTransfers, err := api.Ledger.LookupTransfers(ids)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: fmt.Sprintf("error getting ledger transfers: %s", err.Error()),
+		}
+	}
+
+	// pending transfers are resolved by the post or void transfer pointing to them
+	resolvedBy := make(map[tb_types.Uint128]uint16)
+	for _, lt := range ledgerTransfers {
+		if lt.Flags&(postPendingFlag|voidPendingFlag) != 0 {
+			resolvedBy[lt.PendingID] = lt.Flags
+		}
+	}
+
+	t := details.Transfer
+	acc, err := api.Ledger.GetAccount(t.DebitAccountID)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: fmt.Sprintf("error getting account: %s", err.Error()),
+		}
+	}
+
+	currency, err := ledger.CurrencyByLedger(acc.Ledger)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &TransferDetailsResponse{
+		ID:                        t.ID.String(),
+		Kind:                      t.Kind,
+		DebitAccountID:            t.DebitAccountID,
+		CreditAccountID:           t.CreditAccountID,
+		Currency:                  currency.Code,
+		Amount:                    currency.Format(t.Amount),
+		SettledAmount:             currency.Format(t.SettledAmount),
+		ReversedAmount:            currency.Format(t.ReversedAmount),
+		TransferProgress:          t.TransferProgress,
+		DeclineReason:             t.DeclineReason,
+		MerchantCategoryCode:      t.MerchantCategoryCode,
+		CreatedAt:                 t.CreatedAt,
+		ExpiresAt:                 t.ExpiresAt,
+		FXRate:                    t.FXRate,
+		SettlementFXRate:          t.SettlementFXRate,
+		NetworkTransactionID:      t.References.NetworkTransactionID,
+		AuthCode:                  t.References.AuthCode,
+		MerchantID:                t.References.MerchantID,
+		AcquirerReference:         t.References.AcquirerReference,
+		MatchRule:                 t.MatchRule,
+		OverdrawnAmount:           currency.Format(t.OverdrawnAmount),
+		WorkflowStatus:            details.WorkflowStatus,
+		PresentmentWorkflowStatus: details.PresentmentWorkflowStatus,
+		LedgerTransfers:           make([]LedgerTransfer, 0, len(ledgerTransfers)),
+	}
+	if t.PresentmentID.Valid {
+		resp.PresentmentID = t.PresentmentID.UUID.String()
+	}
+	if t.CardID.Valid {
+		resp.CardID = t.CardID.UUID.String()
+	}
+	if t.OriginalTransferID.Valid {
+		resp.OriginalTransactionID = t.OriginalTransferID.UUID.String()
+	}
+	if t.MerchantCurrency != "" {
+		merchantCurrency, err := ledger.CurrencyByCode(t.MerchantCurrency)
+		if err != nil {
+			return nil, err
+		}
+		resp.MerchantCurrency = merchantCurrency.Code
+		resp.MerchantAmount = merchantCurrency.Format(t.MerchantAmount)
+	}
+
+	for _, lt := range ledgerTransfers {
+		ledgerCurrency, err := ledger.CurrencyByLedger(lt.Ledger)
+		if err != nil {
+			return nil, err
+		}
+
+		ledgerTransfer := LedgerTransfer{
+			ID:                  ledger.FromU128(lt.ID).String(),
+			DebitAccountID:      lt.DebitAccountID.String(),
+			CreditAccountID:     lt.CreditAccountID.String(),
+			Currency:            ledgerCurrency.Code,
+			Amount:              ledgerCurrency.Format(lt.Amount),
+			Pending:             lt.Flags&pendingFlag != 0,
+			PostPendingTransfer: lt.Flags&postPendingFlag != 0,
+			VoidPendingTransfer: lt.Flags&voidPendingFlag != 0,
+			Timestamp:           time.Unix(0, int64(lt.Timestamp)),
+		}
+		if ledgerTransfer.PostPendingTransfer || ledgerTransfer.VoidPendingTransfer {
+			ledgerTransfer.PendingID = ledger.FromU128(lt.PendingID).String()
+		}
+		if ledgerTransfer.Pending {
+			flags, ok := resolvedBy[lt.ID]
+			switch {
+			case !ok:
+				ledgerTransfer.PendingStatus = "pending"
+			case flags&postPendingFlag != 0:
+				ledgerTransfer.PendingStatus = "posted"
+			default:
+				ledgerTransfer.PendingStatus = "voided"
+			}
+		}
+		resp.LedgerTransfers = append(resp.LedgerTransfers, ledgerTransfer)
+	}
+
+	return resp, nil
+}
+
+var (
+	pendingFlag     = tb_types.TransferFlags{Pending: true}.ToUint16()
+	postPendingFlag = tb_types.TransferFlags{PostPendingTransfer: true}.ToUint16()
+	voidPendingFlag = tb_types.TransferFlags{VoidPendingTransfer: true}.ToUint16()
+)
+
+type TransferDetailsResponse struct {
+	ID                    string     `json:"id"`
+	Kind                  string     `json:"kind"`
+	DebitAccountID        uint64     `json:"debit_account_id"`
+	CreditAccountID       uint64     `json:"credit_account_id"`
+	Currency              string     `json:"currency"`
+	Amount                string     `json:"amount"`
+	SettledAmount         string     `json:"settled_amount"`
+	ReversedAmount        string     `json:"reversed_amount"`
+	TransferProgress      string     `json:"transfer_progress"`
+	DeclineReason         string     `json:"decline_reason,omitempty"`
+	MerchantCategoryCode  string     `json:"mcc,omitempty"`
+	CreatedAt             time.Time  `json:"created_at"`
+	ExpiresAt             *time.Time `json:"expires_at,omitempty"`
+	PresentmentID         string     `json:"presentment_id,omitempty"`
+	CardID                string     `json:"card_id,omitempty"`
+	OriginalTransactionID string     `json:"original_transaction_id,omitempty"`
+	MerchantCurrency      string     `json:"merchant_currency,omitempty"`
+	MerchantAmount        string     `json:"merchant_amount,omitempty"`
+	FXRate                *string    `json:"fx_rate,omitempty"`
+	SettlementFXRate      *string    `json:"settlement_fx_rate,omitempty"`
+	NetworkTransactionID  string     `json:"network_transaction_id,omitempty"`
+	AuthCode              string     `json:"auth_code,omitempty"`
+	MerchantID            string     `json:"merchant_id,omitempty"`
+	AcquirerReference     string     `json:"acquirer_reference,omitempty"`
+	// MatchRule is the rule that matched the presentment with the authorization
+	MatchRule string `json:"match_rule,omitempty"`
+	// OverdrawnAmount is what the collections account covered of a force-posted presentment
+	OverdrawnAmount           string           `json:"overdrawn_amount"`
+	WorkflowStatus            string           `json:"workflow_status"`
+	PresentmentWorkflowStatus string           `json:"presentment_workflow_status,omitempty"`
+	LedgerTransfers           []LedgerTransfer `json:"ledger_transfers"`
+}
+
+// LedgerTransfer is a transfer as booked in the ledger
+type LedgerTransfer struct {
+	ID                  string `json:"id"`
+	PendingID           string `json:"pending_id,omitempty"`
+	DebitAccountID      string `json:"debit_account_id"`
+	CreditAccountID     string `json:"credit_account_id"`
+	Currency            string `json:"currency"`
+	Amount              string `json:"amount"`
+	Pending             bool   `json:"pending"`
+	PostPendingTransfer bool   `json:"post_pending_transfer"`
+	VoidPendingTransfer bool   `json:"void_pending_transfer"`
+	// PendingStatus of a pending transfer: pending, posted or voided
+	PendingStatus string    `json:"pending_status,omitempty"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// Authorize places a hold on the account and answers once the ledger approved or declined it
+//
 //encore:api public method=POST path=/accounts/:id/authorize
-func (api *APIService) Authorize(ctx context.Context, id uint64, req *AuthorizeRequest) error {
+func (api *APIService) Authorize(ctx context.Context, id uint64, req *AuthorizeRequest) (*AuthorizationResponse, error) {
+	return authorizeOnce(ctx, "authorize", accountScope(id), req.IdempotencyKey, []interface{}{id, req}, func(transferID uuid.UUID) (*AuthorizationResponse, error) {
+		return api.authorize(ctx, id, req, transferID, nil)
+	})
+}
+
+// AuthorizationResponse is the answer to an authorization: approved once the hold is placed, or declined with the
+// reason
+type AuthorizationResponse struct {
+	ID            string `json:"id"`
+	Status        string `json:"status"`
+	DeclineReason string `json:"decline_reason,omitempty"`
+	// AuthCode of an approved authorization, presentments can carry it to match the authorization
+	AuthCode string `json:"auth_code,omitempty"`
+}
+
+// authorizeOnce runs the authorization once per idempotency key, a replay answers with the decision on the
+// authorization it made
+func authorizeOnce(ctx context.Context, operation string, scope string, key string, req interface{}, fn func(transferID uuid.UUID) (*AuthorizationResponse, error)) (*AuthorizationResponse, error) {
+	var resp *AuthorizationResponse
+	err := idempotent(ctx, operation, scope, key, req, func(transferID uuid.UUID) error {
+		var err error
+		resp, err = fn(transferID)
+		return err
+	})
+	if err != nil || resp != nil {
+		return resp, err
+	}
+
+	auth, err := transfer.GetAuthorization(ctx, &transfer.GetAuthorizationRequest{ID: idempotencyTransferID(operation, scope, key)})
+	if err != nil {
+		return nil, err
+	}
+	return authorizationResponse(auth), nil
+}
+
+func authorizationResponse(auth *transfer.AuthorizationResponse) *AuthorizationResponse {
+	return &AuthorizationResponse{
+		ID:            auth.ID.String(),
+		Status:        auth.Status,
+		DeclineReason: auth.DeclineReason,
+		AuthCode:      auth.AuthCode,
+	}
+}
+
+// authorize places the authorization hold on the account, made with the card if not nil, and waits for the ledger
+// to approve or decline it
+func (api *APIService) authorize(ctx context.Context, id uint64, req *AuthorizeRequest, transferID uuid.UUID, cardID *uuid.UUID) (*AuthorizationResponse, error) {
+	acc, err := api.Ledger.GetAccount(id)
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: fmt.Sprintf("error getting account: %s", err.Error()),
+		}
+	}
+
+	currency, err := ledger.CurrencyByLedger(acc.Ledger)
+	if err != nil {
+		return nil, err
+	}
+
+	amount, err := requestAmount(req.Amount, req.Currency, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	auth, err := transfer.Authorize(ctx, &transfer.Request{
+		TransferID:           transferID,
+		CustomerAccount:      id,
+		TxnType:              transfer.TransactionTypeCreditCardAuth,
+		Amount:               amount,
+		MerchantCategoryCode: req.MerchantCategoryCode,
+		CardID:               cardID,
+		References: transfer.NetworkReferences{
+			NetworkTransactionID: req.NetworkTransactionID,
+			MerchantID:           req.MerchantID,
+			AcquirerReference:    req.AcquirerReference,
+		},
+	})
+	if errs.Code(err) == errs.DeadlineExceeded {
+		return nil, err
+	}
+	if err != nil {
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: fmt.Sprintf("error authorizing: %s", err.Error()),
+		}
+	}
+	return authorizationResponse(auth), nil
+}
+
+type AuthorizeRequest struct {
+	// Amount is a decimal string like "12.34", with at most as many fraction digits as the currency has minor units
+	Amount string `json:"amount"`
+	// Currency is the ISO 4217 currency of the amount, the account currency when empty.
+	// Changes to an authorization in another currency are in the same currency.
+	Currency string `json:"currency"`
+	// MerchantCategoryCode is the ISO 18245 merchant category, it decides how long the hold lasts
+	MerchantCategoryCode string `json:"mcc"`
+	// NetworkTransactionID, MerchantID and AcquirerReference are stored with the authorization to match its presentment
+	NetworkTransactionID string `json:"network_transaction_id,omitempty"`
+	MerchantID           string `json:"merchant_id,omitempty"`
+	AcquirerReference    string `json:"acquirer_reference,omitempty"`
+	// IdempotencyKey makes retries of the request return the original result instead of moving money again
+	IdempotencyKey string `header:"Idempotency-Key"`
+}
+
+//encore:api public method=POST path=/accounts/:id/authorizations/:auth_id/increment
+func (api *APIService) IncrementAuthorization(ctx context.Context, id uint64, authID uuid.UUID, req *IncrementAuthorizationRequest) error {
+	return idempotent(ctx, "increment_authorization", accountScope(id), req.IdempotencyKey, []interface{}{id, authID, req}, func(transferID uuid.UUID) error {
+		return api.incrementAuthorization(ctx, id, authID, req, transferID)
+	})
+}
+
+func (api *APIService) incrementAuthorization(ctx context.Context, id uint64, authID uuid.UUID, req *IncrementAuthorizationRequest, transferID uuid.UUID) error {
+	err := checkDebit(ctx, id)
+	if err != nil {
+		return err
+	}
+
 	acc, err := api.Ledger.GetAccount(id)
 	if err != nil {
 		return &errs.Error{
@@ -118,37 +840,118 @@ func (api *APIService) Authorize(ctx context.Context, id uint64, req *AuthorizeR
 		}
 	}
 
-	// check if the account has enough balance
-	if acc.CreditsPosted-(acc.DebitsPosted+acc.DebitsPending) < uint64(req.Amount*100) {
+	currency, err := ledger.CurrencyByLedger(acc.Ledger)
+	if err != nil {
+		return err
+	}
+
+	amount, err := requestAmount(req.Amount, req.Currency, currency)
+	if err != nil {
+		return err
+	}
+
+	// the ledger refuses increments beyond the balance when placing the hold
+	err = transfer.Transfer(ctx, &transfer.Request{
+		TransferID:      transferID,
+		CustomerAccount: id,
+		TxnType:         transfer.TransactionTypeCreditCardIncrementalAuth,
+		Amount:          amount,
+		AuthorizationID: authID,
+	})
+
+	// a declined increment, or one still undecided, is returned as it is
+	if code := errs.Code(err); code == errs.FailedPrecondition || code == errs.DeadlineExceeded {
+		return err
+	}
+	if err != nil {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: fmt.Sprintf("error incrementing authorization: %s", err.Error()),
+		}
+	}
+	return nil
+}
+
+type IncrementAuthorizationRequest struct {
+	Amount         string `json:"amount"`
+	Currency       string `json:"currency"`
+	IdempotencyKey string `header:"Idempotency-Key"`
+}
+
+// ReverseAuthorization releases the hold of an open authorization before it expires.
+// A zero amount reverses the whole authorization.
+//
+//encore:api public method=POST path=/accounts/:id/authorizations/:auth_id/reverse
+func (api *APIService) ReverseAuthorization(ctx context.Context, id uint64, authID uuid.UUID, req *ReverseAuthorizationRequest) error {
+	return idempotent(ctx, "reverse_authorization", accountScope(id), req.IdempotencyKey, []interface{}{id, authID, req}, func(transferID uuid.UUID) error {
+		return api.reverseAuthorization(ctx, id, authID, req, transferID)
+	})
+}
+
+func (api *APIService) reverseAuthorization(ctx context.Context, id uint64, authID uuid.UUID, req *ReverseAuthorizationRequest, transferID uuid.UUID) error {
+	// check if the account exists
+	acc, err := api.Ledger.GetAccount(id)
+	if err != nil {
 		return &errs.Error{
 			Code:    errs.Internal,
-			Message: fmt.Sprintf("insufficient balance"),
+			Message: fmt.Sprintf("error getting account: %s", err.Error()),
 		}
 	}
 
+	currency, err := ledger.CurrencyByLedger(acc.Ledger)
+	if err != nil {
+		return err
+	}
+
+	amount, err := reversalAmount(req.Amount, req.Currency, currency)
+	if err != nil {
+		return err
+	}
+
 	err = transfer.Transfer(ctx, &transfer.Request{
+		TransferID:      transferID,
 		CustomerAccount: id,
-		TxnType:         transfer.TransactionTypeCreditCardAuth,
-		Amount:          uint64(req.Amount * 100),
+		TxnType:         transfer.TransactionTypeCreditCardReversal,
+		Amount:          amount,
+		AuthorizationID: authID,
 	})
 
+	// a refused reversal, or one still undecided, is returned as it is
+	if code := errs.Code(err); code == errs.FailedPrecondition || code == errs.DeadlineExceeded {
+		return err
+	}
 	if err != nil {
 		return &errs.Error{
 			Code:    errs.Internal,
-			Message: fmt.Sprintf("error authorizing: %s", err.Error()),
+			Message: fmt.Sprintf("error reversing authorization: %s", err.Error()),
 		}
 	}
 	return nil
 }
 
-type AuthorizeRequest struct {
-	Amount float64 `json:"amount"`
+type ReverseAuthorizationRequest struct {
+	Amount         string `json:"amount"`
+	Currency       string `json:"currency"`
+	IdempotencyKey string `header:"Idempotency-Key"`
 }
 
 //encore:api public method=POST path=/accounts/:id/present
 func (api *APIService) Present(ctx context.Context, id uint64, req *PresentRequest) error {
+	return idempotent(ctx, "present", accountScope(id), req.IdempotencyKey, []interface{}{id, req}, func(transferID uuid.UUID) error {
+		return api.present(ctx, id, req, transferID, nil)
+	})
+}
+
+// present settles an authorization of the account, one made with the card if not nil, or posts the amount right away
+// when no authorization matches
+func (api *APIService) present(ctx context.Context, id uint64, req *PresentRequest, transferID uuid.UUID, cardID *uuid.UUID) error {
+	err := checkPresentment(ctx, id)
+	if err != nil {
+		return err
+	}
+
 	// check if the account exists
-	_, err := api.Ledger.GetAccount(id)
+	acc, err := api.Ledger.GetAccount(id)
 	if err != nil {
 		return &errs.Error{
 			Code:    errs.Internal,
@@ -156,20 +959,25 @@ func (api *APIService) Present(ctx context.Context, id uint64, req *PresentReque
 		}
 	}
 
-	// check if there is a pending auth transfer
-	// just an extra guard, actual matching of presentment and auth is done in the transfer service
-	_, err = transfer.GetAuthTransferForPresentment(ctx, &transfer.PresentmentRequest{
-		Account: id,
-		Amount:  uint64(req.Amount * 100),
-	})
+	currency, err := ledger.CurrencyByLedger(acc.Ledger)
+	if err != nil {
+		return err
+	}
+
+	amount, err := requestAmount(req.Amount, req.Currency, currency)
 	if err != nil {
 		return err
 	}
 
+	// the presentment is matched with an authorization by the transfer service, or force-posted without one
 	err = transfer.Transfer(ctx, &transfer.Request{
+		TransferID:      transferID,
 		CustomerAccount: id,
 		TxnType:         transfer.TransactionTypeCreditCardPresent,
-		Amount:          uint64(req.Amount * 100),
+		Amount:          amount,
+		CardID:          cardID,
+		References:      req.references(),
+		MoreClearings:   req.FinalClearing != nil && !*req.FinalClearing,
 	})
 
 	if err != nil {
@@ -181,24 +989,136 @@ func (api *APIService) Present(ctx context.Context, id uint64, req *PresentReque
 	return nil
 }
 
+// Refund credits the customer back, optionally against an original settled transaction
+//
+//encore:api public method=POST path=/accounts/:id/refund
+func (api *APIService) Refund(ctx context.Context, id uint64, req *RefundRequest) error {
+	return idempotent(ctx, "refund", accountScope(id), req.IdempotencyKey, []interface{}{id, req}, func(transferID uuid.UUID) error {
+		return api.refund(ctx, id, req, transferID)
+	})
+}
+
+func (api *APIService) refund(ctx context.Context, id uint64, req *RefundRequest, transferID uuid.UUID) error {
+	err := checkCredit(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	// check if the account exists
+	acc, err := api.Ledger.GetAccount(id)
+	if err != nil {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: fmt.Sprintf("error getting account: %s", err.Error()),
+		}
+	}
+
+	currency, err := ledger.CurrencyByLedger(acc.Ledger)
+	if err != nil {
+		return err
+	}
+	amount, err := requestAmount(req.Amount, "", currency)
+	if err != nil {
+		return err
+	}
+
+	err = transfer.Transfer(ctx, &transfer.Request{
+		TransferID:         transferID,
+		CustomerAccount:    id,
+		TxnType:            transfer.TransactionTypeCreditCardRefund,
+		Amount:             amount,
+		OriginalTransferID: req.OriginalTransactionID,
+	})
+
+	if err != nil {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: fmt.Sprintf("error refunding: %s", err.Error()),
+		}
+	}
+	return nil
+}
+
+type RefundRequest struct {
+	Amount                string     `json:"amount"`
+	OriginalTransactionID *uuid.UUID `json:"original_transaction_id,omitempty"`
+	IdempotencyKey        string     `header:"Idempotency-Key"`
+}
+
 type PresentRequest struct {
-	Amount float64 `json:"amount"`
+	Amount   string `json:"amount"`
+	Currency string `json:"currency"`
+	// NetworkTransactionID, AuthCode and AcquirerReference match the authorization exactly, MerchantID with the
+	// exact amount. Without them the presentment matches an authorization of a close amount, and a presentment matching
+	// no authorization is force-posted.
+	NetworkTransactionID string `json:"network_transaction_id,omitempty"`
+	AuthCode             string `json:"auth_code,omitempty"`
+	MerchantID           string `json:"merchant_id,omitempty"`
+	AcquirerReference    string `json:"acquirer_reference,omitempty"`
+	// FinalClearing is false when more presentments of the authorization follow, like the shipments of an order: the
+	// rest of the authorization stays held for them. A presentment is the final clearing by default.
+	FinalClearing  *bool  `json:"final_clearing,omitempty"`
+	IdempotencyKey string `header:"Idempotency-Key"`
+}
+
+func (req *PresentRequest) references() transfer.NetworkReferences {
+	return transfer.NetworkReferences{
+		NetworkTransactionID: req.NetworkTransactionID,
+		AuthCode:             req.AuthCode,
+		MerchantID:           req.MerchantID,
+		AcquirerReference:    req.AcquirerReference,
+	}
 }
 
 type PresentResponse struct {
 	Ok int64 `json:"ok"`
 }
 type TransferRequest struct {
-	FromAccountID uint64  `json:"from_account_id"`
-	ToAccountID   uint64  `json:"to_account_id"`
-	Amount        float64 `json:"amount"`
+	FromAccountID  uint64 `json:"from_account_id"`
+	ToAccountID    uint64 `json:"to_account_id"`
+	Amount         string `json:"amount"`
+	IdempotencyKey string `header:"Idempotency-Key"`
 }
 
 //encore:api public method=POST path=/internal/transfers
 func (api *APIService) Transfer(ctx context.Context, req *TransferRequest) error {
+	return idempotent(ctx, "transfer", accountScope(req.FromAccountID), req.IdempotencyKey, req, func(transferID uuid.UUID) error {
+		return api.transfer(ctx, req, transferID)
+	})
+}
+
+func (api *APIService) transfer(ctx context.Context, req *TransferRequest, transferID uuid.UUID) error {
+	// the to account is the one debited
+	err := checkDebit(ctx, req.ToAccountID)
+	if err != nil {
+		return err
+	}
+
+	err = checkCredit(ctx, req.FromAccountID)
+	if err != nil {
+		return err
+	}
+
+	acc, err := api.Ledger.GetAccount(req.FromAccountID)
+	if err != nil {
+		return err
+	}
+
+	// the ledger rejects the transfer if the other account is in another currency
+	currency, err := ledger.CurrencyByLedger(acc.Ledger)
+	if err != nil {
+		return err
+	}
+
+	amount, err := requestAmount(req.Amount, "", currency)
+	if err != nil {
+		return err
+	}
+
 	return api.Ledger.Transfer(&ledger.TransferReq{
+		ID:              transferID,
 		DebitAccountID:  req.ToAccountID, // user account debit increases the bank asset, so it's a credit for bank
 		CreditAccountID: req.FromAccountID,
-		Amount:          uint64(req.Amount * 100), // convert to cents and take the floor
+		Amount:          amount,
 	})
 }
@@ -0,0 +1,253 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/types/uuid"
+
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/api/db"
+)
+
+// cardValidity is how long a card is valid when issued without an expiry
+const cardValidity = 3 * 365 * 24 * time.Hour
+
+type IssueCardRequest struct {
+	// Kind is physical or virtual
+	Kind string `json:"kind"`
+	// ExpiresAt is when the card expires, three years after issuance by default
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// ReplacesCardToken is the card of the account this one replaces, the replaced card expires right away
+	ReplacesCardToken string `json:"replaces_card_token,omitempty"`
+}
+
+type Card struct {
+	ID             string    `json:"id"`
+	Token          string    `json:"token"`
+	AccountID      uint64    `json:"account_id"`
+	Kind           string    `json:"kind"`
+	Status         string    `json:"status"`
+	StatusReason   string    `json:"status_reason,omitempty"`
+	ReplacesCardID string    `json:"replaces_card_id,omitempty"`
+	ExpiresAt      time.Time `json:"expires_at"`
+	CreatedAt      time.Time `json:"created_at"`
+}
+
+func card(c *db.Card) *Card {
+	resp := &Card{
+		ID:           c.ID.String(),
+		Token:        c.Token,
+		AccountID:    c.AccountID,
+		Kind:         c.Kind,
+		Status:       string(c.CurrentStatus(time.Now())),
+		StatusReason: c.StatusReason,
+		ExpiresAt:    c.ExpiresAt,
+		CreatedAt:    c.CreatedAt,
+	}
+	if c.ReplacesCardID.Valid {
+		resp.ReplacesCardID = c.ReplacesCardID.UUID.String()
+	}
+	return resp
+}
+
+// IssueCard issues a new card on the account
+//
+//encore:api public method=POST path=/accounts/:id/cards
+func (api *APIService) IssueCard(ctx context.Context, id uint64, req *IssueCardRequest) (*Card, error) {
+	kind := db.CardKind(req.Kind)
+	if kind != db.CardKindPhysical && kind != db.CardKindVirtual {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "kind must be physical or virtual",
+		}
+	}
+
+	_, err := api.Ledger.GetAccount(id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkDebit(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	cardReq := &db.CardReq{
+		AccountID: id,
+		Kind:      kind,
+		ExpiresAt: time.Now().Add(cardValidity),
+	}
+	if req.ExpiresAt != nil {
+		if !req.ExpiresAt.After(time.Now()) {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "expiry must be in the future",
+			}
+		}
+		cardReq.ExpiresAt = *req.ExpiresAt
+	}
+
+	if req.ReplacesCardToken != "" {
+		replaced, err := db.GetCardByToken(ctx, req.ReplacesCardToken)
+		if err != nil {
+			return nil, err
+		}
+
+		if replaced.AccountID != id {
+			return nil, &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "the replaced card belongs to another account",
+			}
+		}
+		cardReq.ReplacesCardID = uuid.NullUUID{UUID: replaced.ID, Valid: true}
+	}
+
+	cardReq.ID, err = uuid.NewV4()
+	if err != nil {
+		return nil, errs.Wrap(err, "error generating the card id")
+	}
+
+	cardReq.Token, err = newCardToken()
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.InsertCard(ctx, cardReq)
+	if err != nil {
+		return nil, errs.Wrap(err, "error issuing card")
+	}
+
+	c, err := db.GetCardByToken(ctx, cardReq.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	return card(c), nil
+}
+
+// newCardToken returns a random token standing for the card number outside the card vault
+func newCardToken() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errs.Wrap(err, "error generating the card token")
+	}
+	return "card_" + hex.EncodeToString(b), nil
+}
+
+type CardsResponse struct {
+	Cards []*Card `json:"cards"`
+}
+
+// ListCards lists the cards of the account, newest first
+//
+//encore:api public method=GET path=/accounts/:id/cards
+func (api *APIService) ListCards(ctx context.Context, id uint64) (*CardsResponse, error) {
+	rows, err := db.ListCards(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &CardsResponse{Cards: make([]*Card, 0, len(rows))}
+	for i := range rows {
+		resp.Cards = append(resp.Cards, card(&rows[i]))
+	}
+
+	return resp, nil
+}
+
+//encore:api public method=GET path=/cards/:token
+func (api *APIService) GetCard(ctx context.Context, token string) (*Card, error) {
+	c, err := db.GetCardByToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return card(c), nil
+}
+
+// LockCard declines the transactions made with the card until it's unlocked
+//
+//encore:api public method=POST path=/cards/:token/lock
+func (api *APIService) LockCard(ctx context.Context, token string, req *StatusChangeRequest) (*Card, error) {
+	return changeCardStatus(ctx, token, db.CardStatusActive, db.CardStatusLocked, req.Reason)
+}
+
+//encore:api public method=POST path=/cards/:token/unlock
+func (api *APIService) UnlockCard(ctx context.Context, token string, req *StatusChangeRequest) (*Card, error) {
+	return changeCardStatus(ctx, token, db.CardStatusLocked, db.CardStatusActive, req.Reason)
+}
+
+func changeCardStatus(ctx context.Context, token string, from db.CardStatus, to db.CardStatus, reason string) (*Card, error) {
+	c, err := db.GetCardByToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	status := c.CurrentStatus(time.Now())
+	if status != from {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: fmt.Sprintf("card is %s", status),
+		}
+	}
+
+	err = db.UpdateCardStatus(ctx, c.ID, to, reason)
+	if err != nil {
+		return nil, errs.Wrap(err, "error updating card status")
+	}
+
+	c.Status, c.StatusReason = string(to), reason
+	return card(c), nil
+}
+
+// activeCard returns the card with the token if it can be used
+func activeCard(ctx context.Context, token string) (*db.Card, error) {
+	c, err := db.GetCardByToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	status := c.CurrentStatus(time.Now())
+	if status != db.CardStatusActive {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: fmt.Sprintf("card is %s", status),
+		}
+	}
+
+	return c, nil
+}
+
+// CardAuthorize authorizes a transaction made with the card on its account
+//
+//encore:api public method=POST path=/cards/:token/authorize
+func (api *APIService) CardAuthorize(ctx context.Context, token string, req *AuthorizeRequest) (*AuthorizationResponse, error) {
+	return authorizeOnce(ctx, "card_authorize", token, req.IdempotencyKey, []interface{}{token, req}, func(transferID uuid.UUID) (*AuthorizationResponse, error) {
+		c, err := activeCard(ctx, token)
+		if err != nil {
+			return nil, err
+		}
+
+		return api.authorize(ctx, c.AccountID, req, transferID, &c.ID)
+	})
+}
+
+// CardPresent settles an authorization made with the card
+//
+//encore:api public method=POST path=/cards/:token/present
+func (api *APIService) CardPresent(ctx context.Context, token string, req *PresentRequest) error {
+	return idempotent(ctx, "card_present", token, req.IdempotencyKey, []interface{}{token, req}, func(transferID uuid.UUID) error {
+		// a card locked or expired after the authorization still gets its presentments
+		c, err := db.GetCardByToken(ctx, token)
+		if err != nil {
+			return err
+		}
+
+		return api.present(ctx, c.AccountID, req, transferID, &c.ID)
+	})
+}
@@ -0,0 +1,158 @@
+package api
+
+import (
+	"context"
+
+	"encore.dev/types/uuid"
+
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/api/db"
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/ledger"
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/money"
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/transfer"
+)
+
+// SpendControlsRequest sets the spend controls of an account or a card. Amounts are decimal strings in the account
+// currency, an empty amount or a nil count is no limit.
+type SpendControlsRequest struct {
+	MaxTransactionAmount string `json:"max_transaction_amount"`
+	DailyLimit           string `json:"daily_limit"`
+	MonthlyLimit         string `json:"monthly_limit"`
+	// HourlyCount is how many authorizations are allowed in an hour
+	HourlyCount *int `json:"hourly_count,omitempty"`
+	// BlockedMCCs are the merchant categories declined right away
+	BlockedMCCs []string `json:"blocked_mccs"`
+}
+
+type SpendControlsResponse struct {
+	Currency             string   `json:"currency"`
+	MaxTransactionAmount string   `json:"max_transaction_amount,omitempty"`
+	DailyLimit           string   `json:"daily_limit,omitempty"`
+	MonthlyLimit         string   `json:"monthly_limit,omitempty"`
+	HourlyCount          *int     `json:"hourly_count,omitempty"`
+	BlockedMCCs          []string `json:"blocked_mccs"`
+}
+
+// SetAccountSpendControls replaces the spend controls of the account, checked on every authorization
+//
+//encore:api public method=PUT path=/accounts/:id/spend-controls
+func (api *APIService) SetAccountSpendControls(ctx context.Context, id uint64, req *SpendControlsRequest) (*SpendControlsResponse, error) {
+	return api.setSpendControls(ctx, id, nil, req)
+}
+
+//encore:api public method=GET path=/accounts/:id/spend-controls
+func (api *APIService) GetAccountSpendControls(ctx context.Context, id uint64) (*SpendControlsResponse, error) {
+	return api.getSpendControls(ctx, id, nil)
+}
+
+// SetCardSpendControls replaces the spend controls of the card, checked on its authorizations on top of the
+// controls of its account
+//
+//encore:api public method=PUT path=/cards/:token/spend-controls
+func (api *APIService) SetCardSpendControls(ctx context.Context, token string, req *SpendControlsRequest) (*SpendControlsResponse, error) {
+	c, err := db.GetCardByToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return api.setSpendControls(ctx, c.AccountID, &c.ID, req)
+}
+
+//encore:api public method=GET path=/cards/:token/spend-controls
+func (api *APIService) GetCardSpendControls(ctx context.Context, token string) (*SpendControlsResponse, error) {
+	c, err := db.GetCardByToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return api.getSpendControls(ctx, c.AccountID, &c.ID)
+}
+
+func (api *APIService) setSpendControls(ctx context.Context, id uint64, cardID *uuid.UUID, req *SpendControlsRequest) (*SpendControlsResponse, error) {
+	currency, err := api.accountCurrency(id)
+	if err != nil {
+		return nil, err
+	}
+
+	controls := &transfer.SpendControls{
+		Account:     id,
+		CardID:      cardID,
+		HourlyCount: req.HourlyCount,
+		BlockedMCCs: req.BlockedMCCs,
+	}
+
+	limits := []struct {
+		value string
+		dest  **uint64
+	}{
+		{req.MaxTransactionAmount, &controls.MaxTransactionAmount},
+		{req.DailyLimit, &controls.DailyLimit},
+		{req.MonthlyLimit, &controls.MonthlyLimit},
+	}
+	for _, limit := range limits {
+		if limit.value == "" {
+			continue
+		}
+
+		amount, err := money.Parse(limit.value, currency.Code)
+		if err != nil {
+			return nil, err
+		}
+		*limit.dest = &amount.Value
+	}
+
+	err = transfer.SetSpendControls(ctx, controls)
+	if err != nil {
+		return nil, err
+	}
+
+	return spendControlsResponse(controls, currency), nil
+}
+
+func (api *APIService) getSpendControls(ctx context.Context, id uint64, cardID *uuid.UUID) (*SpendControlsResponse, error) {
+	currency, err := api.accountCurrency(id)
+	if err != nil {
+		return nil, err
+	}
+
+	controls, err := transfer.GetSpendControls(ctx, &transfer.GetSpendControlsRequest{
+		Account: id,
+		CardID:  cardID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return spendControlsResponse(controls, currency), nil
+}
+
+// accountCurrency returns the currency of the ledger account
+func (api *APIService) accountCurrency(id uint64) (ledger.Currency, error) {
+	acc, err := api.Ledger.GetAccount(id)
+	if err != nil {
+		return ledger.Currency{}, err
+	}
+
+	return ledger.CurrencyByLedger(acc.Ledger)
+}
+
+func spendControlsResponse(controls *transfer.SpendControls, currency ledger.Currency) *SpendControlsResponse {
+	resp := &SpendControlsResponse{
+		Currency:    currency.Code,
+		HourlyCount: controls.HourlyCount,
+		BlockedMCCs: controls.BlockedMCCs,
+	}
+	if resp.BlockedMCCs == nil {
+		resp.BlockedMCCs = []string{}
+	}
+
+	if controls.MaxTransactionAmount != nil {
+		resp.MaxTransactionAmount = currency.Format(*controls.MaxTransactionAmount)
+	}
+	if controls.DailyLimit != nil {
+		resp.DailyLimit = currency.Format(*controls.DailyLimit)
+	}
+	if controls.MonthlyLimit != nil {
+		resp.MonthlyLimit = currency.Format(*controls.MonthlyLimit)
+	}
+	return resp
+}
@@ -0,0 +1,148 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"encore.dev/types/uuid"
+)
+
+type CardKind string
+
+const (
+	CardKindPhysical CardKind = "physical"
+	CardKindVirtual  CardKind = "virtual"
+)
+
+type CardStatus string
+
+const (
+	CardStatusActive CardStatus = "active"
+	CardStatusLocked CardStatus = "locked"
+	// CardStatusExpired cards are past their expiry date or were replaced
+	CardStatusExpired CardStatus = "expired"
+)
+
+// Card is a payment card of an account, known to the card networks by its token
+type Card struct {
+	ID           uuid.UUID `sql:"id"`
+	Token        string    `sql:"token"`
+	AccountID    uint64    `sql:"account_id"`
+	Kind         string    `sql:"kind"`
+	Status       string    `sql:"status"`
+	StatusReason string    `sql:"status_reason"`
+	// ReplacesCardID is the card this one replaced, if any
+	ReplacesCardID uuid.NullUUID `sql:"replaces_card_id"`
+	ExpiresAt      time.Time     `sql:"expires_at"`
+	CreatedAt      time.Time     `sql:"created_at"`
+	UpdatedAt      time.Time     `sql:"updated_at"`
+}
+
+// CurrentStatus returns the status of the card, cards past their expiry date are expired whatever their status
+func (c *Card) CurrentStatus(now time.Time) CardStatus {
+	if !now.Before(c.ExpiresAt) {
+		return CardStatusExpired
+	}
+	return CardStatus(c.Status)
+}
+
+const cardColumns = `id, token, account_id, kind, status, status_reason, replaces_card_id, expires_at, created_at, updated_at`
+
+func scanCard(row scanner, card *Card) error {
+	return row.Scan(&card.ID, &card.Token, &card.AccountID, &card.Kind, &card.Status, &card.StatusReason, &card.ReplacesCardID,
+		&card.ExpiresAt, &card.CreatedAt, &card.UpdatedAt)
+}
+
+type CardReq struct {
+	ID             uuid.UUID
+	Token          string
+	AccountID      uint64
+	Kind           CardKind
+	ReplacesCardID uuid.NullUUID
+	ExpiresAt      time.Time
+}
+
+// InsertCard records a new card. A replaced card expires with it.
+func InsertCard(ctx context.Context, req *CardReq) error {
+	tx, err := AccountDB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO cards (id, token, account_id, kind, status, replaces_card_id, expires_at)
+		    VALUES ($1, $2, $3, $4, $5, $6, $7)`, req.ID, req.Token, req.AccountID, req.Kind, CardStatusActive,
+		req.ReplacesCardID, req.ExpiresAt)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if req.ReplacesCardID.Valid {
+		_, err = tx.Exec(ctx, `
+			UPDATE cards
+			    SET status = $2, status_reason = 'replaced', updated_at = now()
+			    WHERE id = $1`, req.ReplacesCardID.UUID, CardStatusExpired)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetCardByToken returns the card with the token
+func GetCardByToken(ctx context.Context, token string) (*Card, error) {
+	var card Card
+	err := scanCard(AccountDB.QueryRow(ctx, `
+		SELECT `+cardColumns+` FROM cards
+		WHERE token = $1`, token), &card)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "card not found",
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &card, nil
+}
+
+// ListCards returns the cards of the account, newest first
+func ListCards(ctx context.Context, accountID uint64) ([]Card, error) {
+	rows, err := AccountDB.Query(ctx, `
+		SELECT `+cardColumns+` FROM cards
+		WHERE account_id = $1
+		ORDER BY created_at DESC`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var cards []Card
+	for rows.Next() {
+		var card Card
+		err = scanCard(rows, &card)
+		if err != nil {
+			return nil, err
+		}
+		cards = append(cards, card)
+	}
+
+	return cards, rows.Err()
+}
+
+// UpdateCardStatus changes the status of the card
+func UpdateCardStatus(ctx context.Context, id uuid.UUID, status CardStatus, reason string) error {
+	_, err := AccountDB.Exec(ctx, `
+		UPDATE cards
+		    SET status = $2, status_reason = $3, updated_at = now()
+		    WHERE id = $1`, id, status, reason)
+	return err
+}
@@ -0,0 +1,308 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"encore.dev/types/uuid"
+
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/ledger"
+)
+
+var (
+	AccountDB = sqldb.Named("api")
+)
+
+// Account is what we know of a ledger account besides its balances, TigerBeetle only holds ids and counters
+type Account struct {
+	ID          uint64 `sql:"id"`
+	Owner       string `sql:"owner"`
+	DisplayName string `sql:"display_name"`
+	Currency    string `sql:"currency"`
+	// AccountType is the name of the account type in the chart of accounts
+	AccountType string `sql:"account_type"`
+	Status      string `sql:"status"`
+	// StatusReason is why the status last changed
+	StatusReason    string     `sql:"status_reason"`
+	StatusChangedAt *time.Time `sql:"status_changed_at"`
+	// UserData is the hex encoded user data of the TigerBeetle account
+	UserData  string    `sql:"user_data"`
+	CreatedBy string    `sql:"created_by"`
+	CreatedAt time.Time `sql:"created_at"`
+	UpdatedAt time.Time `sql:"updated_at"`
+}
+
+const accountColumns = `id, owner, display_name, currency, account_type, status, status_reason, status_changed_at, user_data, created_by,
+	created_at, updated_at`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanAccount(row scanner, account *Account) error {
+	return row.Scan(&account.ID, &account.Owner, &account.DisplayName, &account.Currency, &account.AccountType,
+		&account.Status, &account.StatusReason, &account.StatusChangedAt, &account.UserData, &account.CreatedBy, &account.CreatedAt,
+		&account.UpdatedAt)
+}
+
+type AccountReq struct {
+	ID          uint64
+	Owner       string
+	DisplayName string
+	Currency    string
+	AccountType string
+	UserData    string
+	CreatedBy   string
+}
+
+// InsertAccount records a new account. It tells whether it was inserted, false when the id is already taken.
+func InsertAccount(ctx context.Context, req *AccountReq, tx *sqldb.Tx) (bool, error) {
+	res, err := tx.Exec(ctx, `
+		INSERT INTO accounts (id, owner, display_name, currency, account_type, status, user_data, created_by)
+		    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		    ON CONFLICT (id) DO NOTHING`, req.ID, req.Owner, req.DisplayName, req.Currency, req.AccountType,
+		ledger.AccountStatusActive, req.UserData, req.CreatedBy)
+	if err != nil {
+		return false, err
+	}
+	return res.RowsAffected() > 0, nil
+}
+
+// Matches tells whether the account was created by the request
+func (a *Account) Matches(req *AccountReq) bool {
+	return a.ID == req.ID && a.Owner == req.Owner && a.DisplayName == req.DisplayName && a.Currency == req.Currency &&
+		a.AccountType == req.AccountType && a.UserData == req.UserData && a.CreatedBy == req.CreatedBy
+}
+
+// GetAccount returns the account, NotFound for accounts created before the metadata was recorded
+func GetAccount(ctx context.Context, id uint64) (*Account, error) {
+	var account Account
+	err := scanAccount(AccountDB.QueryRow(ctx, `
+		SELECT `+accountColumns+` FROM accounts
+		WHERE id = $1`, id), &account)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "account not found",
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+// GetAccountForUpdate returns the account and locks it until the transaction ends
+func GetAccountForUpdate(ctx context.Context, id uint64, tx *sqldb.Tx) (*Account, error) {
+	var account Account
+	err := scanAccount(tx.QueryRow(ctx, `
+		SELECT `+accountColumns+` FROM accounts
+		WHERE id = $1
+		FOR UPDATE`, id), &account)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "account not found",
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+// GetAccountStatus returns the status of the account, accounts without metadata are active. The row is share locked
+// for the read, so a status change in progress, like a closure, is waited for.
+func GetAccountStatus(ctx context.Context, id uint64) (ledger.AccountStatus, error) {
+	tx, err := AccountDB.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var status ledger.AccountStatus
+	err = tx.QueryRow(ctx, `
+		SELECT status FROM accounts
+		WHERE id = $1
+		FOR SHARE`, id).Scan(&status)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return ledger.AccountStatusActive, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return status, tx.Commit()
+}
+
+type StatusChangeReq struct {
+	AccountID  uint64
+	FromStatus ledger.AccountStatus
+	ToStatus   ledger.AccountStatus
+	Reason     string
+	// SweepTransferID is the ledger transfer which moved the residual balance of a closed account to SweepAccountID
+	SweepTransferID uuid.NullUUID
+	SweepAccountID  *uint64
+	SweptAmount     uint64
+}
+
+// PendingSweep is the sweep of the residual balance of a closed account not made yet
+type PendingSweep struct {
+	AccountID       uint64
+	SweepTransferID uuid.UUID
+	SweepAccountID  uint64
+}
+
+// GetPendingSweep returns the sweep of the closure of the account not made yet, NotFound when there is none
+func GetPendingSweep(ctx context.Context, accountID uint64) (*PendingSweep, error) {
+	sweep := PendingSweep{AccountID: accountID}
+	err := AccountDB.QueryRow(ctx, `
+		SELECT sweep_transfer_id, sweep_account_id FROM account_status_changes
+		WHERE account_id = $1 AND to_status = $2 AND sweep_transfer_id IS NOT NULL AND swept_at IS NULL
+		ORDER BY created_at DESC
+		LIMIT 1`, accountID, ledger.AccountStatusClosed).Scan(&sweep.SweepTransferID, &sweep.SweepAccountID)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "no pending sweep",
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &sweep, nil
+}
+
+// CompleteSweep records the amount moved by the sweep transfer
+func CompleteSweep(ctx context.Context, sweepTransferID uuid.UUID, amount uint64) error {
+	_, err := AccountDB.Exec(ctx, `
+		UPDATE account_status_changes SET swept_amount = $2, swept_at = now()
+		WHERE sweep_transfer_id = $1`, sweepTransferID, amount)
+	return err
+}
+
+// UpdateAccountStatus changes the status of the account and records the change
+func UpdateAccountStatus(ctx context.Context, req *StatusChangeReq, tx *sqldb.Tx) error {
+	_, err := tx.Exec(ctx, `
+		UPDATE accounts
+		    SET status = $2, status_reason = $3, status_changed_at = now(), updated_at = now()
+		    WHERE id = $1`, req.AccountID, req.ToStatus, req.Reason)
+	if err != nil {
+		return err
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+		INSERT INTO account_status_changes (id, account_id, from_status, to_status, reason, sweep_transfer_id, sweep_account_id, swept_amount)
+		    VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`, id, req.AccountID, req.FromStatus, req.ToStatus, req.Reason,
+		req.SweepTransferID, req.SweepAccountID, req.SweptAmount)
+	return err
+}
+
+type ListAccountsReq struct {
+	// optional filters
+	Owner       string
+	Currency    string
+	AccountType string
+	Status      string
+	// Cursor is the next cursor of the previous page
+	Cursor string
+	Limit  int
+}
+
+// ListAccounts returns the accounts ordered by id and the cursor of the next page.
+// The cursor is empty on the last page.
+func ListAccounts(ctx context.Context, req *ListAccountsReq) ([]Account, string, error) {
+	var args []interface{}
+	conditions := []string{"TRUE"}
+
+	if req.Owner != "" {
+		args = append(args, req.Owner)
+		conditions = append(conditions, fmt.Sprintf("owner = $%d", len(args)))
+	}
+	if req.Currency != "" {
+		args = append(args, strings.ToUpper(req.Currency))
+		conditions = append(conditions, fmt.Sprintf("currency = $%d", len(args)))
+	}
+	if req.AccountType != "" {
+		args = append(args, req.AccountType)
+		conditions = append(conditions, fmt.Sprintf("account_type = $%d", len(args)))
+	}
+	if req.Status != "" {
+		args = append(args, req.Status)
+		conditions = append(conditions, fmt.Sprintf("status = $%d", len(args)))
+	}
+	if req.Cursor != "" {
+		id, err := decodeCursor(req.Cursor)
+		if err != nil {
+			return nil, "", &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "invalid cursor",
+			}
+		}
+		args = append(args, id)
+		conditions = append(conditions, fmt.Sprintf("id > $%d", len(args)))
+	}
+
+	// fetch one more row to know if there is a next page
+	args = append(args, req.Limit+1)
+	query := `
+		SELECT ` + accountColumns + ` FROM accounts
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY id ASC
+		LIMIT $` + fmt.Sprint(len(args))
+
+	rows, err := AccountDB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var accounts []Account
+	for rows.Next() {
+		var account Account
+		err = scanAccount(rows, &account)
+		if err != nil {
+			return nil, "", err
+		}
+		accounts = append(accounts, account)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(accounts) > req.Limit {
+		accounts = accounts[:req.Limit]
+		next = encodeCursor(accounts[len(accounts)-1].ID)
+	}
+
+	return accounts, next, nil
+}
+
+func encodeCursor(id uint64) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatUint(id, 10)))
+}
+
+func decodeCursor(cursor string) (uint64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.ParseUint(string(raw), 10, 64)
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"encore.dev/types/uuid"
+)
+
+var (
+	IdempotencyDB = sqldb.Named("api")
+
+	// idempotencyNamespace derives the transfer id of a request from its idempotency key
+	idempotencyNamespace = uuid.FromStringOrNil("5c2b6f0e-8f8e-4d4b-9a43-2f7f8a0c1d6e")
+)
+
+// idempotencyLease is how long a request holds its idempotency key in progress. A key left in progress longer, by a
+// request that crashed, is taken over by the next request with the key, which runs again under the same transfer id.
+const idempotencyLease = 5 * time.Minute
+
+type idempotencyStatus string
+
+const (
+	idempotencyStatusInProgress idempotencyStatus = "in_progress"
+	idempotencyStatusCompleted  idempotencyStatus = "completed"
+)
+
+// idempotent runs fn once per operation, scope and idempotency key. The scope is the account or the card of the
+// request, so callers of different accounts can't collide on a key. fn gets a transfer id derived from the key, used as
+// the workflow and ledger transfer id so the downstream calls are deduplicated as well. Replaying the key with the
+// same request returns the recorded result, replaying it with a different request is rejected.
+// Internal errors aren't recorded, so the request can be retried. Without a key fn runs with a nil id.
+func idempotent(ctx context.Context, operation string, scope string, key string, req interface{}, fn func(transferID uuid.UUID) error) error {
+	if key == "" {
+		return fn(uuid.Nil)
+	}
+
+	hash, err := requestHash(req)
+	if err != nil {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "error hashing the request",
+		}
+	}
+
+	// a key left in progress beyond its lease is taken over by the same request
+	res, err := IdempotencyDB.Exec(ctx, `
+		INSERT INTO idempotency_keys (operation, scope, key, request_hash)
+		    VALUES ($1, $2, $3, $4)
+		    ON CONFLICT (operation, scope, key) DO UPDATE SET updated_at = now()
+		    WHERE idempotency_keys.status = $5 AND idempotency_keys.request_hash = EXCLUDED.request_hash
+		      AND idempotency_keys.updated_at < $6`,
+		operation, scope, key, hash, idempotencyStatusInProgress, time.Now().Add(-idempotencyLease))
+	if err != nil {
+		return errs.Wrap(err, "error storing the idempotency key")
+	}
+
+	if res.RowsAffected() == 0 {
+		return replay(ctx, operation, scope, key, hash)
+	}
+
+	result := fn(idempotencyTransferID(operation, scope, key))
+
+	code := errs.Code(result)
+	if code == errs.Internal || code == errs.Unavailable || code == errs.Unknown || code == errs.DeadlineExceeded {
+		// let the client retry, the transfer id keeps the retry from moving the money twice and a retry of an
+		// authorization waiting for its decision waits on the same workflow
+		_, err = IdempotencyDB.Exec(ctx, `
+			DELETE FROM idempotency_keys WHERE operation = $1 AND scope = $2 AND key = $3`, operation, scope, key)
+		if err != nil {
+			return errs.Wrap(err, "error releasing the idempotency key")
+		}
+		return result
+	}
+
+	var message string
+	var encoreErr *errs.Error
+	if errors.As(result, &encoreErr) {
+		message = encoreErr.Message
+	}
+
+	_, err = IdempotencyDB.Exec(ctx, `
+		update idempotency_keys set status = $1, response_code = $2, response_message = $3, updated_at = now()
+		WHERE operation = $4 AND scope = $5 AND key = $6`, idempotencyStatusCompleted, int(code), message, operation, scope, key)
+	if err != nil {
+		return errs.Wrap(err, "error storing the idempotent response")
+	}
+
+	return result
+}
+
+// idempotencyTransferID returns the transfer id of the request with the idempotency key
+func idempotencyTransferID(operation string, scope string, key string) uuid.UUID {
+	return uuid.NewV5(idempotencyNamespace, operation+"/"+scope+"/"+key)
+}
+
+// accountScope is the idempotency scope of the requests on an account
+func accountScope(id uint64) string {
+	return strconv.FormatUint(id, 10)
+}
+
+// replay returns the recorded result of the request with the idempotency key
+func replay(ctx context.Context, operation string, scope string, key string, hash string) error {
+	var storedHash, status, message string
+	var code int
+	err := IdempotencyDB.QueryRow(ctx, `
+		SELECT request_hash, status, response_code, response_message FROM idempotency_keys
+		WHERE operation = $1 AND scope = $2 AND key = $3`, operation, scope, key).Scan(&storedHash, &status, &code, &message)
+	if err != nil {
+		return errs.Wrap(err, "error getting the idempotency key")
+	}
+
+	switch {
+	case storedHash != hash:
+		return &errs.Error{
+			Code:    errs.AlreadyExists,
+			Message: "idempotency key was already used with a different request",
+		}
+	case idempotencyStatus(status) != idempotencyStatusCompleted:
+		return &errs.Error{
+			Code:    errs.Aborted,
+			Message: "request with this idempotency key is still in progress",
+		}
+	case errs.ErrCode(code) == errs.OK:
+		return nil
+	}
+
+	return &errs.Error{
+		Code:    errs.ErrCode(code),
+		Message: message,
+	}
+}
+
+func requestHash(req interface{}) (string, error) {
+	raw, err := json.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,11 @@
+CREATE TABLE idempotency_keys (
+                            operation varchar NOT NULL,
+                            key varchar NOT NULL,
+                            request_hash varchar NOT NULL,
+                            status varchar NOT NULL DEFAULT 'in_progress',
+                            response_code integer NOT NULL DEFAULT 0,
+                            response_message varchar NOT NULL DEFAULT '',
+                            created_at timestamp with time zone NOT NULL DEFAULT now(),
+                            updated_at timestamp with time zone NOT NULL DEFAULT now(),
+                            PRIMARY KEY (operation, key)
+);
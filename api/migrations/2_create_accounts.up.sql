@@ -0,0 +1,15 @@
+CREATE TABLE accounts (
+                            id bigint NOT NULL,
+                            owner varchar NOT NULL DEFAULT '',
+                            display_name varchar NOT NULL DEFAULT '',
+                            currency varchar NOT NULL,
+                            account_type varchar NOT NULL,
+                            status varchar NOT NULL DEFAULT 'active',
+                            user_data varchar NOT NULL DEFAULT '',
+                            created_by varchar NOT NULL DEFAULT '',
+                            created_at timestamp with time zone NOT NULL DEFAULT now(),
+                            updated_at timestamp with time zone NOT NULL DEFAULT now(),
+                            PRIMARY KEY (id)
+);
+
+create index if not exists index_accounts_owner on accounts (owner);
@@ -0,0 +1,17 @@
+ALTER TABLE accounts ADD COLUMN status_reason varchar NOT NULL DEFAULT '';
+ALTER TABLE accounts ADD COLUMN status_changed_at timestamp with time zone;
+
+CREATE TABLE account_status_changes (
+                            id uuid NOT NULL,
+                            account_id bigint NOT NULL,
+                            from_status varchar NOT NULL,
+                            to_status varchar NOT NULL,
+                            reason varchar NOT NULL DEFAULT '',
+                            sweep_transfer_id uuid,
+                            sweep_account_id bigint,
+                            swept_amount bigint NOT NULL DEFAULT 0,
+                            created_at timestamp with time zone NOT NULL DEFAULT now(),
+                            PRIMARY KEY (id)
+);
+
+create index if not exists index_account_status_changes_account_id on account_status_changes (account_id, created_at);
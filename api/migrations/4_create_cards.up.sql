@@ -0,0 +1,16 @@
+CREATE TABLE cards (
+                            id uuid NOT NULL,
+                            token varchar NOT NULL,
+                            account_id bigint NOT NULL,
+                            kind varchar NOT NULL,
+                            status varchar NOT NULL DEFAULT 'active',
+                            status_reason varchar NOT NULL DEFAULT '',
+                            replaces_card_id uuid,
+                            expires_at timestamp with time zone NOT NULL,
+                            created_at timestamp with time zone NOT NULL DEFAULT now(),
+                            updated_at timestamp with time zone NOT NULL DEFAULT now(),
+                            PRIMARY KEY (id)
+);
+
+create unique index if not exists index_cards_token on cards (token);
+create index if not exists index_cards_account_id on cards (account_id);
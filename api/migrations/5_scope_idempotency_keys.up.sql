@@ -0,0 +1,3 @@
+ALTER TABLE idempotency_keys ADD COLUMN scope varchar NOT NULL DEFAULT '';
+ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey;
+ALTER TABLE idempotency_keys ADD PRIMARY KEY (operation, scope, key);
@@ -0,0 +1,3 @@
+-- swept_at is set once the residual balance of a closed account is moved to the sweep account, the sweep runs after
+-- the account is closed and is resumed by closing the account again until then
+ALTER TABLE account_status_changes ADD COLUMN swept_at timestamp with time zone;
@@ -0,0 +1,336 @@
+package api
+
+import (
+	"context"
+	"fmt"
+
+	"encore.dev/beta/errs"
+	"encore.dev/types/uuid"
+
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/api/db"
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/ledger"
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/money"
+	tb_types "github.com/tigerbeetledb/tigerbeetle-go/pkg/types"
+)
+
+type StatusChangeRequest struct {
+	Reason string `json:"reason"`
+}
+
+type CloseAccountRequest struct {
+	Reason string `json:"reason"`
+	// SweepAccountID receives the residual balance of the account, it must be in the same currency.
+	// Accounts with a balance can't be closed without one.
+	SweepAccountID *uint64 `json:"sweep_account_id,omitempty"`
+}
+
+// FreezeAccount stops money from leaving the account, money can still come in
+//
+//encore:api public method=POST path=/accounts/:id/freeze
+func (api *APIService) FreezeAccount(ctx context.Context, id uint64, req *StatusChangeRequest) (*AccountInfo, error) {
+	return api.changeStatus(ctx, id, ledger.AccountStatusFrozen, req.Reason, ledger.AccountStatusActive)
+}
+
+// UnfreezeAccount makes a frozen account active again
+//
+//encore:api public method=POST path=/accounts/:id/unfreeze
+func (api *APIService) UnfreezeAccount(ctx context.Context, id uint64, req *StatusChangeRequest) (*AccountInfo, error) {
+	return api.changeStatus(ctx, id, ledger.AccountStatusActive, req.Reason, ledger.AccountStatusFrozen)
+}
+
+// ReopenAccount makes a closed account active again
+//
+//encore:api public method=POST path=/accounts/:id/reopen
+func (api *APIService) ReopenAccount(ctx context.Context, id uint64, req *StatusChangeRequest) (*AccountInfo, error) {
+	return api.changeStatus(ctx, id, ledger.AccountStatusActive, req.Reason, ledger.AccountStatusClosed)
+}
+
+// CloseAccount closes an active or frozen account. Accounts with pending holds can't be closed, the residual
+// balance is swept to the sweep account once the account is closed. A sweep that failed is resumed by closing the
+// account again.
+//
+//encore:api public method=POST path=/accounts/:id/close
+func (api *APIService) CloseAccount(ctx context.Context, id uint64, req *CloseAccountRequest) (*AccountInfo, error) {
+	if req.Reason == "" {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "a reason is required",
+		}
+	}
+
+	tx, err := db.AccountDB.Begin(ctx)
+	if err != nil {
+		return nil, errs.Wrap(err, "error starting transaction")
+	}
+
+	// the lock makes concurrent status changes and checks wait until the account is closed: a hold placed before is
+	// pending below, one placed after is released by the status check its workflow makes once it's placed
+	acc, err := db.GetAccountForUpdate(ctx, id, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	status := ledger.AccountStatus(acc.Status)
+	if status == ledger.AccountStatusClosed {
+		tx.Rollback()
+		return api.resumeSweep(ctx, id)
+	}
+
+	ledgerAcc, err := api.Ledger.GetAccount(id)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if ledgerAcc.DebitsPending > 0 || ledgerAcc.CreditsPending > 0 {
+		tx.Rollback()
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "account has pending holds",
+		}
+	}
+
+	change := &db.StatusChangeReq{
+		AccountID:  id,
+		FromStatus: status,
+		ToStatus:   ledger.AccountStatusClosed,
+		Reason:     req.Reason,
+	}
+
+	if ledgerAcc.CreditsPosted != ledgerAcc.DebitsPosted {
+		err = api.planSweep(ctx, ledgerAcc, req.SweepAccountID, change)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	err = db.UpdateAccountStatus(ctx, change, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, errs.Wrap(err, "error updating account status")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, errs.Wrap(err, "error updating account status")
+	}
+
+	// swept once closed, no debit nor credit moves the balance any more
+	if change.SweepTransferID.Valid {
+		err = api.sweep(ctx, &db.PendingSweep{AccountID: id, SweepTransferID: change.SweepTransferID.UUID, SweepAccountID: *change.SweepAccountID})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return getAccountInfo(ctx, id)
+}
+
+// resumeSweep makes the sweep of the closed account which failed, a closed account without one can't be closed again
+func (api *APIService) resumeSweep(ctx context.Context, id uint64) (*AccountInfo, error) {
+	pending, err := db.GetPendingSweep(ctx, id)
+	if errs.Code(err) == errs.NotFound {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: fmt.Sprintf("account %d is %s", id, ledger.AccountStatusClosed),
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = api.sweep(ctx, pending)
+	if err != nil {
+		return nil, err
+	}
+
+	return getAccountInfo(ctx, id)
+}
+
+// planSweep checks the sweep account of the account with a residual balance and records it in the status change
+// with the id of the sweep transfer
+func (api *APIService) planSweep(ctx context.Context, acc *tb_types.Account, sweepAccountID *uint64, change *db.StatusChangeReq) error {
+	if sweepAccountID == nil {
+		currency, err := ledger.CurrencyByLedger(acc.Ledger)
+		if err != nil {
+			return err
+		}
+
+		balance := acc.CreditsPosted - acc.DebitsPosted
+		if acc.DebitsPosted > acc.CreditsPosted {
+			balance = acc.DebitsPosted - acc.CreditsPosted
+		}
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: fmt.Sprintf("account has a balance of %s, a sweep account is required to close it", money.New(balance, currency.Code)),
+		}
+	}
+
+	if *sweepAccountID == change.AccountID {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "the sweep account must be another account",
+		}
+	}
+
+	// the sweep is made once the account is closed, an account it can't be made to would keep the balance for good
+	sweepAcc, err := api.Ledger.GetAccount(*sweepAccountID)
+	if err != nil {
+		return err
+	}
+	if sweepAcc.Ledger != acc.Ledger {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "the sweep account must be in the currency of the account",
+		}
+	}
+
+	err = checkCredit(ctx, *sweepAccountID)
+	if err != nil {
+		return err
+	}
+
+	sweepID, err := uuid.NewV4()
+	if err != nil {
+		return errs.Wrap(err, "error generating the sweep id")
+	}
+
+	change.SweepTransferID = uuid.NullUUID{UUID: sweepID, Valid: true}
+	change.SweepAccountID = sweepAccountID
+	return nil
+}
+
+// sweep moves the residual balance of the closed account to the sweep account, whichever side it's on, and records
+// the amount moved. The transfer id is the one planned on closure, so a resumed sweep moves the balance once.
+func (api *APIService) sweep(ctx context.Context, pending *db.PendingSweep) error {
+	transfers, err := api.Ledger.LookupTransfers([]uuid.UUID{pending.SweepTransferID})
+	if err != nil {
+		return err
+	}
+	if len(transfers) > 0 {
+		return db.CompleteSweep(ctx, pending.SweepTransferID, transfers[0].Amount)
+	}
+
+	acc, err := api.Ledger.GetAccount(pending.AccountID)
+	if err != nil {
+		return err
+	}
+
+	currency, err := ledger.CurrencyByLedger(acc.Ledger)
+	if err != nil {
+		return err
+	}
+
+	transfer := &ledger.TransferReq{ID: pending.SweepTransferID}
+	transfer.DebitAccountID, transfer.CreditAccountID = pending.AccountID, pending.SweepAccountID
+	transfer.Amount = money.New(acc.CreditsPosted-acc.DebitsPosted, currency.Code)
+	if acc.DebitsPosted > acc.CreditsPosted {
+		transfer.DebitAccountID, transfer.CreditAccountID = pending.SweepAccountID, pending.AccountID
+		transfer.Amount = money.New(acc.DebitsPosted-acc.CreditsPosted, currency.Code)
+	}
+
+	if transfer.Amount.Value > 0 {
+		err = api.Ledger.Transfer(transfer)
+		if err != nil {
+			return err
+		}
+	}
+
+	return db.CompleteSweep(ctx, pending.SweepTransferID, transfer.Amount.Value)
+}
+
+// changeStatus moves the account to the status if it's in one of the from statuses
+func (api *APIService) changeStatus(ctx context.Context, id uint64, to ledger.AccountStatus, reason string, from ...ledger.AccountStatus) (*AccountInfo, error) {
+	if reason == "" {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "a reason is required",
+		}
+	}
+
+	tx, err := db.AccountDB.Begin(ctx)
+	if err != nil {
+		return nil, errs.Wrap(err, "error starting transaction")
+	}
+
+	acc, err := db.GetAccountForUpdate(ctx, id, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	status := ledger.AccountStatus(acc.Status)
+	if !hasStatus(from, status) {
+		tx.Rollback()
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: fmt.Sprintf("account %d is %s", id, status),
+		}
+	}
+
+	err = db.UpdateAccountStatus(ctx, &db.StatusChangeReq{
+		AccountID:  id,
+		FromStatus: status,
+		ToStatus:   to,
+		Reason:     reason,
+	}, tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, errs.Wrap(err, "error updating account status")
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, errs.Wrap(err, "error updating account status")
+	}
+
+	return getAccountInfo(ctx, id)
+}
+
+func getAccountInfo(ctx context.Context, id uint64) (*AccountInfo, error) {
+	acc, err := db.GetAccount(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	info := accountInfo(acc)
+	return &info, nil
+}
+
+func hasStatus(statuses []ledger.AccountStatus, status ledger.AccountStatus) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDebit fails if money can't leave the account
+func checkDebit(ctx context.Context, id uint64) error {
+	status, err := db.GetAccountStatus(ctx, id)
+	if err != nil {
+		return errs.Wrap(err, "error getting account status")
+	}
+	return status.CheckDebit(id)
+}
+
+// checkPresentment fails if the account takes no presentment, a frozen account still clears its authorizations
+func checkPresentment(ctx context.Context, id uint64) error {
+	status, err := db.GetAccountStatus(ctx, id)
+	if err != nil {
+		return errs.Wrap(err, "error getting account status")
+	}
+	return status.CheckPresentment(id)
+}
+
+// checkCredit fails if money can't come in the account
+func checkCredit(ctx context.Context, id uint64) error {
+	status, err := db.GetAccountStatus(ctx, id)
+	if err != nil {
+		return errs.Wrap(err, "error getting account status")
+	}
+	return status.CheckCredit(id)
+}
@@ -0,0 +1,138 @@
+package fx
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"encore.dev/beta/errs"
+
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/money"
+)
+
+// RatePrecision is the number of decimals rates are rounded to, so the stored rate is the applied one
+const RatePrecision = 10
+
+// Rate is the price of one unit of the From currency in the To currency
+type Rate struct {
+	From string
+	To   string
+	// Value is a decimal string, rounded to RatePrecision decimals
+	Value string
+}
+
+// RateProvider quotes exchange rates between two currencies
+type RateProvider interface {
+	Rate(from string, to string) (Rate, error)
+}
+
+// Convert converts an amount of the From currency to the To currency, taking the floor
+func (r Rate) Convert(amount money.Amount) (money.Amount, error) {
+	if !strings.EqualFold(amount.Currency, r.From) {
+		return money.Amount{}, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("can't convert %s at a %s rate", amount.Currency, r.From),
+		}
+	}
+
+	from, err := money.CurrencyByCode(r.From)
+	if err != nil {
+		return money.Amount{}, err
+	}
+
+	to, err := money.CurrencyByCode(r.To)
+	if err != nil {
+		return money.Amount{}, err
+	}
+
+	value, ok := new(big.Rat).SetString(r.Value)
+	if !ok {
+		return money.Amount{}, &errs.Error{
+			Code:    errs.Internal,
+			Message: fmt.Sprintf("invalid rate: %s", r.Value),
+		}
+	}
+
+	converted := new(big.Rat).SetInt(new(big.Int).SetUint64(amount.Value))
+	converted.Mul(converted, value)
+	converted.Mul(converted, new(big.Rat).SetFrac(pow10(to.MinorUnits), pow10(from.MinorUnits)))
+
+	// big.Int division truncates, amounts are never negative so it's the floor
+	result := new(big.Int).Quo(converted.Num(), converted.Denom())
+	if !result.IsUint64() {
+		return money.Amount{}, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "converted amount is out of range",
+		}
+	}
+
+	return money.New(result.Uint64(), to.Code), nil
+}
+
+//go:embed config/rates.json
+var ratesConfig []byte
+
+// FileRateProvider quotes rates from a fixed table of rates against a base currency.
+// It stands in for a market data feed.
+type FileRateProvider struct {
+	rates map[string]*big.Rat
+}
+
+// NewFileRateProvider loads the rate table shipped in config/rates.json
+func NewFileRateProvider() (*FileRateProvider, error) {
+	var cfg struct {
+		// Rates are the prices of one unit of the base currency
+		Rates map[string]string `json:"rates"`
+	}
+	err := json.Unmarshal(ratesConfig, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parse rates config: %v", err)
+	}
+
+	provider := &FileRateProvider{
+		rates: make(map[string]*big.Rat, len(cfg.Rates)),
+	}
+	for code, value := range cfg.Rates {
+		rate, ok := new(big.Rat).SetString(value)
+		if !ok || rate.Sign() <= 0 {
+			return nil, fmt.Errorf("parse rate of %s: %s", code, value)
+		}
+		provider.rates[code] = rate
+	}
+
+	return provider, nil
+}
+
+// Rate returns the cross rate of the currencies through the base currency
+func (p *FileRateProvider) Rate(from string, to string) (Rate, error) {
+	from, to = strings.ToUpper(from), strings.ToUpper(to)
+
+	fromRate, ok := p.rates[from]
+	if !ok {
+		return Rate{}, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("no rate for currency: %s", from),
+		}
+	}
+
+	toRate, ok := p.rates[to]
+	if !ok {
+		return Rate{}, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("no rate for currency: %s", to),
+		}
+	}
+
+	value := new(big.Rat).Quo(toRate, fromRate)
+	return Rate{
+		From:  from,
+		To:    to,
+		Value: value.FloatString(RatePrecision),
+	}, nil
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
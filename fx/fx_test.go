@@ -0,0 +1,88 @@
+package fx
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/money"
+)
+
+func TestRateConvert(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    Rate
+		amount  money.Amount
+		want    money.Amount
+		wantErr bool
+	}{
+		{"exact", Rate{From: "USD", To: "EUR", Value: "0.5"}, money.New(1000, "USD"), money.New(500, "EUR"), false},
+		// 3.33 * 0.9215 = 3.068595
+		{"floor", Rate{From: "USD", To: "EUR", Value: "0.9215"}, money.New(333, "USD"), money.New(306, "EUR"), false},
+		// 0.01 * 0.99 = 0.0099
+		{"floor to zero", Rate{From: "USD", To: "EUR", Value: "0.99"}, money.New(1, "USD"), money.New(0, "EUR"), false},
+		// 1.99 * 0.9999999999 = 1.989999999801
+		{"floor just below", Rate{From: "USD", To: "EUR", Value: "0.9999999999"}, money.New(199, "USD"), money.New(198, "EUR"), false},
+		// 12.34 USD * 150.123 = 1852.51782 JPY, no minor units
+		{"to fewer minor units", Rate{From: "USD", To: "JPY", Value: "150.123"}, money.New(1234, "USD"), money.New(1852, "JPY"), false},
+		// 1852 JPY * 0.0066612 = 12.3365424 USD
+		{"to more minor units", Rate{From: "JPY", To: "USD", Value: "0.0066612"}, money.New(1852, "JPY"), money.New(1233, "USD"), false},
+		// 1.00 USD * 0.3075 = 0.3075 KWD, three minor units
+		{"to three minor units", Rate{From: "USD", To: "KWD", Value: "0.3075"}, money.New(100, "USD"), money.New(307, "KWD"), false},
+		{"lower case currency", Rate{From: "USD", To: "EUR", Value: "0.5"}, money.New(3, "usd"), money.New(1, "EUR"), false},
+		{"zero", Rate{From: "USD", To: "EUR", Value: "0.5"}, money.New(0, "USD"), money.New(0, "EUR"), false},
+		{"currency mismatch", Rate{From: "USD", To: "EUR", Value: "0.5"}, money.New(100, "GBP"), money.Amount{}, true},
+		{"invalid rate", Rate{From: "USD", To: "EUR", Value: "abc"}, money.New(100, "USD"), money.Amount{}, true},
+		{"unknown currency", Rate{From: "USD", To: "XXX", Value: "0.5"}, money.New(100, "USD"), money.Amount{}, true},
+		{"out of range", Rate{From: "USD", To: "JPY", Value: "150"}, money.New(math.MaxUint64, "USD"), money.Amount{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.rate.Convert(tt.amount)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileRateProviderRoundTrip(t *testing.T) {
+	provider, err := NewFileRateProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// converting there and back never yields more than the original amount
+	for _, pair := range [][2]string{{"USD", "EUR"}, {"USD", "JPY"}, {"EUR", "KWD"}, {"GBP", "INR"}} {
+		there, err := provider.Rate(pair[0], pair[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		back, err := provider.Rate(pair[1], pair[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		amount := money.New(123457, pair[0])
+		converted, err := there.Convert(amount)
+		if err != nil {
+			t.Fatal(err)
+		}
+		returned, err := back.Convert(converted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if returned.Value > amount.Value {
+			t.Errorf("%s: %v converted to %v and back to %v", pair, amount, converted, returned)
+		}
+	}
+}
@@ -6,5 +6,7 @@ require github.com/tigerbeetledb/tigerbeetle-go v0.0.0-20230218113030-09d36bcbc0
 
 require (
 	encore.dev v1.13.4 // indirect
+	github.com/stretchr/testify v1.8.1 // indirect
+	go.temporal.io/api v1.16.0 // indirect
 	go.temporal.io/sdk v1.21.1 // indirect
 )
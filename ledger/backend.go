@@ -0,0 +1,21 @@
+package ledger
+
+import (
+	tb "github.com/tigerbeetledb/tigerbeetle-go"
+	tb_types "github.com/tigerbeetledb/tigerbeetle-go/pkg/types"
+)
+
+// Backend is the double-entry store the ledger service books accounts and transfers into.
+// It mirrors the TigerBeetle client API, so a tb.Client can be used as is.
+type Backend interface {
+	CreateAccounts(accounts []tb_types.Account) ([]tb_types.AccountEventResult, error)
+	CreateTransfers(transfers []tb_types.Transfer) ([]tb_types.TransferEventResult, error)
+	LookupAccounts(accountIDs []tb_types.Uint128) ([]tb_types.Account, error)
+	LookupTransfers(transferIDs []tb_types.Uint128) ([]tb_types.Transfer, error)
+	Close()
+}
+
+var (
+	_ Backend = (tb.Client)(nil)
+	_ Backend = (*MemoryBackend)(nil)
+)
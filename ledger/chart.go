@@ -0,0 +1,283 @@
+package ledger
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"sort"
+
+	"encore.dev/beta/errs"
+
+	tb_types "github.com/tigerbeetledb/tigerbeetle-go/pkg/types"
+)
+
+// Category is the accounting category of an account type
+type Category string
+
+const (
+	CategoryAsset     Category = "asset"
+	CategoryLiability Category = "liability"
+	CategoryRevenue   Category = "revenue"
+	CategoryExpense   Category = "expense"
+)
+
+// Side is a side of the ledger, an account's balance grows on its normal side
+type Side string
+
+const (
+	SideDebit  Side = "debit"
+	SideCredit Side = "credit"
+)
+
+// Role is what a system account of the bank is used for, workflows resolve system accounts by role
+type Role string
+
+const (
+	RoleSettlement  Role = "settlement"
+	RoleFX          Role = "fx"
+	RoleFees        Role = "fees"
+	RoleInterchange Role = "interchange"
+	RoleSuspense    Role = "suspense"
+	RoleWriteOff    Role = "write_off"
+	// RoleCollections accounts hold what customers owe once a force-posted presentment overdrew their account
+	RoleCollections Role = "collections"
+)
+
+// AccountType is an entry of the chart of accounts, its code is the TigerBeetle account code
+type AccountType struct {
+	Code          uint16
+	Name          string
+	Category      Category
+	NormalBalance Side
+	// Flags are the TigerBeetle account flags of accounts of the type
+	Flags uint16
+}
+
+// Balance is the balance of an account on the normal side of its type
+type Balance struct {
+	// Available is the size of the available balance, Negative when it's on the other side, like an overdrawn
+	// customer or an FX account that paid out more than it received
+	Available uint64
+	Negative  bool
+	Reserved  uint64
+}
+
+// Balance returns the available and the reserved balance of an account of the type, on its normal side
+func (t AccountType) Balance(acc *tb_types.Account) Balance {
+	if t.NormalBalance == SideDebit {
+		available, negative := signedDifference(acc.DebitsPosted, acc.CreditsPosted, acc.CreditsPending)
+		return Balance{Available: available, Negative: negative, Reserved: acc.CreditsPending}
+	}
+	available, negative := signedDifference(acc.CreditsPosted, acc.DebitsPosted, acc.DebitsPending)
+	return Balance{Available: available, Negative: negative, Reserved: acc.DebitsPending}
+}
+
+// signedDifference returns the size of the value minus the others and whether it's negative. A size beyond uint64 is
+// capped, the sum of the others may overflow.
+func signedDifference(value uint64, others ...uint64) (uint64, bool) {
+	diff := new(big.Int).SetUint64(value)
+	for _, o := range others {
+		diff.Sub(diff, new(big.Int).SetUint64(o))
+	}
+
+	negative := diff.Sign() < 0
+	diff.Abs(diff)
+	if !diff.IsUint64() {
+		return math.MaxUint64, negative
+	}
+	return diff.Uint64(), negative
+}
+
+// SystemAccount is an account of the bank with a role in a currency
+type SystemAccount struct {
+	ID       uint64
+	Role     Role
+	Type     AccountType
+	Currency string
+}
+
+//go:embed config/chart_of_accounts.json
+var chartOfAccountsConfig []byte
+
+var accountFlags = map[string]uint16{
+	"debits_must_not_exceed_credits": debitsMustNotExceedCreditsFlag,
+	"credits_must_not_exceed_debits": creditsMustNotExceedDebitsFlag,
+}
+
+// ChartOfAccounts lists the account types of the ledger and the system accounts of the bank
+type ChartOfAccounts struct {
+	types          map[string]AccountType
+	codes          map[uint16]AccountType
+	systemAccounts map[Role]map[string]SystemAccount
+}
+
+// NewChartOfAccounts loads the chart of accounts shipped in config/chart_of_accounts.json
+func NewChartOfAccounts() (*ChartOfAccounts, error) {
+	return loadChartOfAccounts(chartOfAccountsConfig)
+}
+
+func loadChartOfAccounts(raw []byte) (*ChartOfAccounts, error) {
+	var cfg struct {
+		AccountTypes []struct {
+			Code          uint16   `json:"code"`
+			Name          string   `json:"name"`
+			Category      Category `json:"category"`
+			NormalBalance Side     `json:"normal_balance"`
+			Flags         []string `json:"flags"`
+		} `json:"account_types"`
+		SystemAccounts []struct {
+			Role     Role              `json:"role"`
+			Type     string            `json:"type"`
+			Accounts map[string]uint64 `json:"accounts"`
+		} `json:"system_accounts"`
+	}
+	err := json.Unmarshal(raw, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parse chart of accounts: %v", err)
+	}
+
+	chart := &ChartOfAccounts{
+		types:          make(map[string]AccountType, len(cfg.AccountTypes)),
+		codes:          make(map[uint16]AccountType, len(cfg.AccountTypes)),
+		systemAccounts: make(map[Role]map[string]SystemAccount, len(cfg.SystemAccounts)),
+	}
+
+	for _, t := range cfg.AccountTypes {
+		switch t.Category {
+		case CategoryAsset, CategoryLiability, CategoryRevenue, CategoryExpense:
+		default:
+			return nil, fmt.Errorf("account type %s: unknown category %q", t.Name, t.Category)
+		}
+
+		if t.NormalBalance != SideDebit && t.NormalBalance != SideCredit {
+			return nil, fmt.Errorf("account type %s: unknown normal balance %q", t.Name, t.NormalBalance)
+		}
+
+		if t.Code == 0 {
+			return nil, fmt.Errorf("account type %s: code must not be zero", t.Name)
+		}
+
+		if _, ok := chart.types[t.Name]; ok {
+			return nil, fmt.Errorf("duplicate account type: %s", t.Name)
+		}
+
+		if _, ok := chart.codes[t.Code]; ok {
+			return nil, fmt.Errorf("duplicate account type code: %d", t.Code)
+		}
+
+		var flags uint16
+		for _, name := range t.Flags {
+			flag, ok := accountFlags[name]
+			if !ok {
+				return nil, fmt.Errorf("account type %s: unknown flag %q", t.Name, name)
+			}
+			flags |= flag
+		}
+
+		accType := AccountType{
+			Code:          t.Code,
+			Name:          t.Name,
+			Category:      t.Category,
+			NormalBalance: t.NormalBalance,
+			Flags:         flags,
+		}
+		chart.types[accType.Name] = accType
+		chart.codes[accType.Code] = accType
+	}
+
+	ids := make(map[uint64]bool)
+	for _, sa := range cfg.SystemAccounts {
+		accType, ok := chart.types[sa.Type]
+		if !ok {
+			return nil, fmt.Errorf("system account %s: unknown account type %s", sa.Role, sa.Type)
+		}
+
+		if _, ok := chart.systemAccounts[sa.Role]; ok {
+			return nil, fmt.Errorf("duplicate system account role: %s", sa.Role)
+		}
+
+		accounts := make(map[string]SystemAccount, len(sa.Accounts))
+		for code, id := range sa.Accounts {
+			currency, err := CurrencyByCode(code)
+			if err != nil {
+				return nil, fmt.Errorf("system account %s: %v", sa.Role, err)
+			}
+
+			if ids[id] {
+				return nil, fmt.Errorf("system account %s: duplicate account id %d", sa.Role, id)
+			}
+			ids[id] = true
+
+			accounts[currency.Code] = SystemAccount{ID: id, Role: sa.Role, Type: accType, Currency: currency.Code}
+		}
+		chart.systemAccounts[sa.Role] = accounts
+	}
+
+	return chart, nil
+}
+
+// AccountType returns the account type with the name
+func (c *ChartOfAccounts) AccountType(name string) (AccountType, error) {
+	t, ok := c.types[name]
+	if !ok {
+		return AccountType{}, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("unknown account type: %s", name),
+		}
+	}
+	return t, nil
+}
+
+// AccountTypeByCode returns the account type with the TigerBeetle account code
+func (c *ChartOfAccounts) AccountTypeByCode(code uint16) (AccountType, error) {
+	t, ok := c.codes[code]
+	if !ok {
+		return AccountType{}, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("unknown account type code: %d", code),
+		}
+	}
+	return t, nil
+}
+
+// AccountTypes returns the account types ordered by code
+func (c *ChartOfAccounts) AccountTypes() []AccountType {
+	types := make([]AccountType, 0, len(c.codes))
+	for _, t := range c.codes {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i].Code < types[j].Code })
+	return types
+}
+
+// SystemAccount returns the id of the bank's account with the role in the currency, an empty currency is the
+// default currency
+func (c *ChartOfAccounts) SystemAccount(role Role, currency string) (uint64, error) {
+	cur, err := CurrencyByCode(currency)
+	if err != nil {
+		return 0, err
+	}
+
+	sa, ok := c.systemAccounts[role][cur.Code]
+	if !ok {
+		return 0, &errs.Error{
+			Code:    errs.Internal,
+			Message: fmt.Sprintf("no %s account in %s", role, cur.Code),
+		}
+	}
+	return sa.ID, nil
+}
+
+// SystemAccounts returns every system account of the chart, ordered by id
+func (c *ChartOfAccounts) SystemAccounts() []SystemAccount {
+	var accounts []SystemAccount
+	for _, byCurrency := range c.systemAccounts {
+		for _, sa := range byCurrency {
+			accounts = append(accounts, sa)
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].ID < accounts[j].ID })
+	return accounts
+}
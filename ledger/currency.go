@@ -0,0 +1,70 @@
+package ledger
+
+import (
+	"fmt"
+
+	"encore.dev/beta/errs"
+
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/money"
+)
+
+// DefaultCurrency is used for accounts created without a currency
+const DefaultCurrency = "USD"
+
+// Currency is a currency as booked in the ledger. Every currency is booked on its own TigerBeetle ledger,
+// so money never moves between accounts of different currencies.
+type Currency struct {
+	money.Currency
+	// Ledger is the TigerBeetle ledger the currency is booked on
+	Ledger uint32
+}
+
+var currencies = []struct {
+	Code   string
+	Ledger uint32
+}{
+	{Code: "USD", Ledger: 1},
+	{Code: "EUR", Ledger: 2},
+	{Code: "GBP", Ledger: 3},
+	{Code: "JPY", Ledger: 4},
+	{Code: "CAD", Ledger: 5},
+	{Code: "INR", Ledger: 6},
+	{Code: "KWD", Ledger: 7},
+}
+
+// CurrencyByCode returns the currency with the ISO 4217 code, an empty code is the default currency
+func CurrencyByCode(code string) (Currency, error) {
+	if code == "" {
+		code = DefaultCurrency
+	}
+
+	c, err := money.CurrencyByCode(code)
+	if err != nil {
+		return Currency{}, err
+	}
+
+	for _, lc := range currencies {
+		if lc.Code == c.Code {
+			return Currency{Currency: c, Ledger: lc.Ledger}, nil
+		}
+	}
+
+	return Currency{}, &errs.Error{
+		Code:    errs.InvalidArgument,
+		Message: fmt.Sprintf("currency isn't booked in the ledger: %s", code),
+	}
+}
+
+// CurrencyByLedger returns the currency booked on the ledger
+func CurrencyByLedger(ledger uint32) (Currency, error) {
+	for _, lc := range currencies {
+		if lc.Ledger == ledger {
+			return CurrencyByCode(lc.Code)
+		}
+	}
+
+	return Currency{}, &errs.Error{
+		Code:    errs.Internal,
+		Message: fmt.Sprintf("no currency for ledger %d", ledger),
+	}
+}
@@ -0,0 +1,109 @@
+package ledger
+
+import (
+	"errors"
+
+	tb_types "github.com/tigerbeetledb/tigerbeetle-go/pkg/types"
+	"go.temporal.io/sdk/temporal"
+)
+
+// DeclineReason is why an authorization was declined, returned to the caller and stored on the declined transfer
+type DeclineReason string
+
+const (
+	// pre-checks
+	DeclineReasonTransactionLimit DeclineReason = "transaction_limit_exceeded"
+	DeclineReasonDailyLimit       DeclineReason = "daily_limit_exceeded"
+	DeclineReasonMonthlyLimit     DeclineReason = "monthly_limit_exceeded"
+	DeclineReasonVelocityLimit    DeclineReason = "velocity_limit_exceeded"
+	DeclineReasonBlockedMCC       DeclineReason = "merchant_category_blocked"
+	DeclineReasonAccountFrozen    DeclineReason = "account_frozen"
+	DeclineReasonAccountClosed    DeclineReason = "account_closed"
+	// DeclineReasonDecisionTimeout is an authorization decided after the caller stopped waiting for it
+	DeclineReasonDecisionTimeout DeclineReason = "decision_timeout"
+	// DeclineReasonOverPresentment is a presentment exceeding the authorized amount beyond the tolerance
+	DeclineReasonOverPresentment DeclineReason = "over_presentment_exceeded"
+
+	// ledger results
+	DeclineReasonInsufficientFunds DeclineReason = "insufficient_funds"
+	DeclineReasonAccountNotFound   DeclineReason = "account_not_found"
+	DeclineReasonCurrencyMismatch  DeclineReason = "currency_mismatch"
+	// DeclineReasonSystemLimit is a system account refusing the money, like a settlement account over its limit
+	DeclineReasonSystemLimit    DeclineReason = "system_limit_exceeded"
+	DeclineReasonAmountOverflow DeclineReason = "amount_overflow"
+	// DeclineReasonLedgerRejected is any other ledger result
+	DeclineReasonLedgerRejected DeclineReason = "ledger_rejected"
+)
+
+// DeclineReasonForResult maps the result of a ledger transfer to the reason of the decline
+func DeclineReasonForResult(result tb_types.CreateTransferResult) DeclineReason {
+	switch result {
+	case tb_types.TransferExceedsCredits:
+		return DeclineReasonInsufficientFunds
+	case tb_types.TransferExceedsDebits:
+		return DeclineReasonSystemLimit
+	case tb_types.TransferDebitAccountNotFound,
+		tb_types.TransferCreditAccountNotFound:
+		return DeclineReasonAccountNotFound
+	case tb_types.TransferAccountsMustHaveTheSameLedger,
+		tb_types.TransferTransferMustHaveTheSameLedgerAsAccounts:
+		return DeclineReasonCurrencyMismatch
+	case tb_types.TransferOverflowsDebitsPending,
+		tb_types.TransferOverflowsCreditsPending,
+		tb_types.TransferOverflowsDebitsPosted,
+		tb_types.TransferOverflowsCreditsPosted,
+		tb_types.TransferOverflowsDebits,
+		tb_types.TransferOverflowsCredits:
+		return DeclineReasonAmountOverflow
+	default:
+		return DeclineReasonLedgerRejected
+	}
+}
+
+// DeclineReasonForStatus returns why authorizations on an account in the status are declined, empty for active accounts
+func DeclineReasonForStatus(status AccountStatus) DeclineReason {
+	switch status {
+	case AccountStatusFrozen:
+		return DeclineReasonAccountFrozen
+	case AccountStatusClosed:
+		return DeclineReasonAccountClosed
+	default:
+		return ""
+	}
+}
+
+// DeclineReasonOf returns the decline reason carried by the error of an activity, empty when it isn't a decline
+func DeclineReasonOf(err error) DeclineReason {
+	var appErr *temporal.ApplicationError
+	if !errors.As(err, &appErr) || !appErr.HasDetails() {
+		return ""
+	}
+
+	var reason DeclineReason
+	if appErr.Details(&reason) != nil {
+		return ""
+	}
+	return reason
+}
+
+// transferResultError returns the error of the first failed transfer of a batch, nil when all of them went through.
+// In a linked chain the transfer that failed is reported rather than the ones failing along with it. A chain is
+// booked at once, so a chain failing only because a transfer of it exists is a replay of a booked chain.
+func transferResultError(results []tb_types.TransferEventResult) error {
+	var failed *tb_types.TransferEventResult
+	for i := range results {
+		switch results[i].Result {
+		case tb_types.TransferOK, tb_types.TransferExists, tb_types.TransferLinkedEventFailed:
+			continue
+		}
+		if failed == nil {
+			failed = &results[i]
+		}
+	}
+	if failed == nil {
+		return nil
+	}
+
+	return temporal.NewNonRetryableApplicationError("error creating transfer", failed.Result.String(), errors.New(failed.Result.String()),
+		DeclineReasonForResult(failed.Result))
+}
@@ -3,6 +3,7 @@ package ledger
 import (
 	"errors"
 	"fmt"
+	"math/bits"
 	"math/rand"
 
 	"encore.dev/beta/errs"
@@ -10,55 +11,44 @@ import (
 
 	"encore.dev/types/uuid"
 
-	tb "github.com/tigerbeetledb/tigerbeetle-go"
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/money"
 	tb_types "github.com/tigerbeetledb/tigerbeetle-go/pkg/types"
 )
 
 type Service struct {
-	TB tb.Client
+	Backend Backend
+	Chart   *ChartOfAccounts
 }
 
-func NewLedgerService(tb tb.Client) *Service {
+func NewLedgerService(backend Backend, chart *ChartOfAccounts) *Service {
 	return &Service{
-		TB: tb,
+		Backend: backend,
+		Chart:   chart,
 	}
 }
 
-func (l *Service) CreateAccount(id uint64, accType uint16) error {
+// CreateAccount creates an account of the type on the ledger of the currency, an empty currency is the default
+// currency. Creating an account that exists is a no-op, AlreadyExists when the existing one differs.
+func (l *Service) CreateAccount(id uint64, accType AccountType, currency string, userData tb_types.Uint128) error {
 	idUint128, err := tb_types.HexStringToUint128(fmt.Sprintf("%d", id))
 	if err != nil {
 		return errs.Wrap(err, "error parsing the id")
 	}
 
-	var res []tb_types.AccountEventResult
-	switch accType {
-	case 1:
-		// create a customer account
-		res, err = l.TB.CreateAccounts([]tb_types.Account{
-			{
-				ID:     idUint128,
-				Ledger: uint32(1), // for now constant
-				Code:   accType,
-				Flags: tb_types.AccountFlags{
-					DebitsMustNotExceedCredits: true,
-				}.ToUint16(),
-			},
-		})
-	case 2:
-		// create a bank settlement account
-		// create a customer account
-		res, err = l.TB.CreateAccounts([]tb_types.Account{
-			{
-				ID:     idUint128,
-				Ledger: uint32(1), // for now constant
-				Code:   accType,
-				Flags: tb_types.AccountFlags{
-					CreditsMustNotExceedDebits: true,
-				}.ToUint16(),
-			},
-		})
+	cur, err := CurrencyByCode(currency)
+	if err != nil {
+		return err
 	}
 
+	res, err := l.Backend.CreateAccounts([]tb_types.Account{
+		{
+			ID:       idUint128,
+			UserData: userData,
+			Ledger:   cur.Ledger,
+			Code:     accType.Code,
+			Flags:    accType.Flags,
+		},
+	})
 	if err != nil {
 		return errs.Wrap(err, "error creating account")
 	}
@@ -67,6 +57,12 @@ func (l *Service) CreateAccount(id uint64, accType uint16) error {
 		switch r.Result {
 		case tb_types.AccountExists:
 			return nil
+		case tb_types.AccountExistsWithDifferentFlags, tb_types.AccountExistsWithDifferentUserData,
+			tb_types.AccountExistsWithDifferentLedger, tb_types.AccountExistsWithDifferentCode:
+			return &errs.Error{
+				Code:    errs.AlreadyExists,
+				Message: fmt.Sprintf("account %d exists: %s", id, r.Result.String()),
+			}
 		default:
 			return &errs.Error{
 				Code:    errs.Internal,
@@ -85,7 +81,7 @@ func (l *Service) GetAccount(id uint64) (*tb_types.Account, error) {
 		return nil, errs.Wrap(err, "error parsing the id")
 	}
 
-	acc, err := l.TB.LookupAccounts([]tb_types.Uint128{
+	acc, err := l.Backend.LookupAccounts([]tb_types.Uint128{
 		idUint128,
 	})
 
@@ -110,10 +106,27 @@ type TransferReq struct {
 	ID              uuid.UUID
 	DebitAccountID  uint64
 	CreditAccountID uint64
-	Amount          uint64
+	// Amount must be in the currency of the debit account
+	Amount money.Amount
+	// Conversion is set when the credit account is in another currency than the debit account
+	Conversion *Conversion
+}
+
+// Conversion moves money across currencies: the debit account pays the amount to the bank's FX account of its
+// currency, and the bank's FX account of the other currency pays the converted amount to the credit account
+type Conversion struct {
+	SourceFXAccount uint64
+	TargetFXAccount uint64
+	// Amount is the converted amount, in the currency of the credit account
+	Amount money.Amount
 }
 
 func (l *Service) Transfer(transfer *TransferReq) error {
+	// a transfer id given by the caller makes the transfer idempotent
+	if transfer.ID != uuid.Nil {
+		return l.PostTransfer(transfer)
+	}
+
 	debitIDUint128, err := tb_types.HexStringToUint128(fmt.Sprintf("%d", transfer.DebitAccountID))
 	if err != nil {
 		return errs.Wrap(err, "error parsing the id")
@@ -124,6 +137,11 @@ func (l *Service) Transfer(transfer *TransferReq) error {
 		return errs.Wrap(err, "error parsing the id")
 	}
 
+	ledgerID, err := l.transferLedger(debitIDUint128, creditIDUint128, transfer.Amount)
+	if err != nil {
+		return err
+	}
+
 	var id tb_types.Uint128
 	var found = false
 	for tries := 0; tries < 5; tries++ {
@@ -132,7 +150,7 @@ func (l *Service) Transfer(transfer *TransferReq) error {
 			return errs.Wrap(err, "error parsing the id")
 		}
 
-		existinTransfers, err := l.TB.LookupTransfers([]tb_types.Uint128{
+		existinTransfers, err := l.Backend.LookupTransfers([]tb_types.Uint128{
 			id,
 		})
 		if err != nil {
@@ -152,13 +170,13 @@ func (l *Service) Transfer(transfer *TransferReq) error {
 		}
 	}
 
-	newTransfer, err := l.TB.CreateTransfers([]tb_types.Transfer{
+	newTransfer, err := l.Backend.CreateTransfers([]tb_types.Transfer{
 		{
 			ID:              id,
 			DebitAccountID:  debitIDUint128,
 			CreditAccountID: creditIDUint128,
-			Amount:          transfer.Amount,
-			Ledger:          uint32(1),
+			Amount:          transfer.Amount.Value,
+			Ledger:          ledgerID,
 			Code:            uint16(1),
 		},
 	})
@@ -177,130 +195,555 @@ func (l *Service) Transfer(transfer *TransferReq) error {
 	return nil
 }
 
+// FreezeAmount places a pending transfer holding the amount, idempotently on the request id
 func (l *Service) FreezeAmount(req *TransferReq) error {
-	id := toU128(req.ID.Bytes())
+	transfers, err := l.transferChain(req, tb_types.TransferFlags{Pending: true})
+	if err != nil {
+		return err
+	}
+
+	resp, err := l.Backend.CreateTransfers(transfers)
+	if err != nil {
+		return errs.Wrap(err, "error creating the transfer")
+	}
+
+	return transferResultError(resp)
+}
+
+// PostTransfer posts a transfer right away, without a pending phase, idempotently on the request id
+func (l *Service) PostTransfer(req *TransferReq) error {
+	transfers, err := l.transferChain(req, tb_types.TransferFlags{})
+	if err != nil {
+		return err
+	}
+
+	resp, err := l.Backend.CreateTransfers(transfers)
+	if err != nil {
+		return errs.Wrap(err, "error creating the transfer")
+	}
+
+	return transferResultError(resp)
+}
+
+// overdraftAttempts is how many times PostOverdrawnTransfer books the transfer when a concurrent debit takes the
+// balance it was covering
+const overdraftAttempts = 3
+
+// PostOverdrawnTransfer posts a transfer right away like PostTransfer. What the debit account lacks for it is first
+// credited from the overdraft account in a transfer with the overdraft id, booked in the same linked chain so both
+// succeed or fail together. It returns the amount credited from the overdraft account. Both are idempotent on their
+// ids, a booked transfer returns the amount of its overdraft.
+func (l *Service) PostOverdrawnTransfer(req *TransferReq, overdraftAccount uint64, overdraftID uuid.UUID) (uint64, error) {
+	transfers, err := l.transferChain(req, tb_types.TransferFlags{})
+	if err != nil {
+		return 0, err
+	}
+
+	overdraftAccID, err := tb_types.HexStringToUint128(fmt.Sprintf("%d", overdraftAccount))
+	if err != nil {
+		return 0, temporal.NewNonRetryableApplicationError("error parsing the overdraft account id", "invalid_id", errs.Wrap(err, "error parsing the overdraft account id"))
+	}
+
+	for attempt := 1; ; attempt++ {
+		booked, err := l.Backend.LookupTransfers([]tb_types.Uint128{
+			transfers[0].ID,
+			toU128(overdraftID.Bytes()),
+		})
+		if err != nil {
+			return 0, errs.Wrap(err, "error getting the transfer")
+		}
+		var posted bool
+		var overdrawn uint64
+		for _, t := range booked {
+			if t.ID == transfers[0].ID {
+				posted = true
+			} else {
+				overdrawn = t.Amount
+			}
+		}
+		if posted {
+			return overdrawn, nil
+		}
+
+		acc, err := l.GetAccount(req.DebitAccountID)
+		if err != nil {
+			return 0, nonRetryableLedgerError(err)
+		}
+
+		// the debit account must not go below zero, what it lacks is the amount beyond its available balance
+		available, negative := signedDifference(acc.CreditsPosted, acc.DebitsPosted, acc.DebitsPending)
+		var shortfall uint64
+		var overflow bool
+		switch {
+		case negative:
+			shortfall, overflow = add(req.Amount.Value, available)
+		case req.Amount.Value > available:
+			shortfall = req.Amount.Value - available
+		}
+		if overflow {
+			return 0, temporal.NewNonRetryableApplicationError("overdraft is out of range", "invalid_amount", errors.New("overdraft is out of range"),
+				DeclineReasonAmountOverflow)
+		}
+
+		chain := transfers
+		if shortfall > 0 {
+			overdraft := tb_types.Transfer{
+				ID:              toU128(overdraftID.Bytes()),
+				DebitAccountID:  overdraftAccID,
+				CreditAccountID: transfers[0].DebitAccountID,
+				Amount:          shortfall,
+				Flags:           tb_types.TransferFlags{Linked: true}.ToUint16(),
+				Code:            uint16(1), // for now constant
+			}
+			overdraft.Ledger, err = l.transferLedger(overdraftAccID, overdraft.CreditAccountID, money.New(shortfall, req.Amount.Currency))
+			if err != nil {
+				return 0, nonRetryableLedgerError(err)
+			}
+			chain = append([]tb_types.Transfer{overdraft}, transfers...)
+		}
+
+		resp, err := l.Backend.CreateTransfers(chain)
+		if err != nil {
+			return 0, errs.Wrap(err, "error creating the transfer")
+		}
+
+		err = transferResultError(resp)
+		if err == nil {
+			return shortfall, nil
+		}
+		// a concurrent debit took the balance the overdraft left to the transfer
+		if DeclineReasonOf(err) != DeclineReasonInsufficientFunds || attempt == overdraftAttempts {
+			return 0, err
+		}
+	}
+}
+
+// transferChain returns the ledger transfers booking the request. A conversion is booked as two linked transfers,
+// one on the ledger of each currency, through the bank's FX liquidity accounts.
+func (l *Service) transferChain(req *TransferReq, flags tb_types.TransferFlags) ([]tb_types.Transfer, error) {
 	debitAccID, err := tb_types.HexStringToUint128(fmt.Sprintf("%d", req.DebitAccountID))
 	if err != nil {
-		return temporal.NewNonRetryableApplicationError("error parsing the debit account id", "invalid_id", errs.Wrap(err, "error parsing the debit account id"))
+		return nil, temporal.NewNonRetryableApplicationError("error parsing the debit account id", "invalid_id", errs.Wrap(err, "error parsing the debit account id"))
 	}
 
 	creditAccID, err := tb_types.HexStringToUint128(fmt.Sprintf("%d", req.CreditAccountID))
 	if err != nil {
-		return temporal.NewNonRetryableApplicationError("error parsing the credit account id", "invalid_id", errs.Wrap(err, "error parsing the credit account id"))
+		return nil, temporal.NewNonRetryableApplicationError("error parsing the credit account id", "invalid_id", errs.Wrap(err, "error parsing the credit account id"))
+	}
+
+	if req.Conversion == nil {
+		ledgerID, err := l.transferLedger(debitAccID, creditAccID, req.Amount)
+		if err != nil {
+			return nil, nonRetryableLedgerError(err)
+		}
+
+		return []tb_types.Transfer{
+			{
+				ID:              toU128(req.ID.Bytes()),
+				DebitAccountID:  debitAccID,
+				CreditAccountID: creditAccID,
+				Amount:          req.Amount.Value,
+				Flags:           flags.ToUint16(),
+				Ledger:          ledgerID,
+				Code:            uint16(1), // for now constant
+			},
+		}, nil
+	}
+
+	sourceFXAccID, err := tb_types.HexStringToUint128(fmt.Sprintf("%d", req.Conversion.SourceFXAccount))
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("error parsing the fx account id", "invalid_id", errs.Wrap(err, "error parsing the fx account id"))
+	}
+
+	targetFXAccID, err := tb_types.HexStringToUint128(fmt.Sprintf("%d", req.Conversion.TargetFXAccount))
+	if err != nil {
+		return nil, temporal.NewNonRetryableApplicationError("error parsing the fx account id", "invalid_id", errs.Wrap(err, "error parsing the fx account id"))
+	}
+
+	sourceLedgerID, err := l.transferLedger(debitAccID, sourceFXAccID, req.Amount)
+	if err != nil {
+		return nil, nonRetryableLedgerError(err)
+	}
+
+	targetLedgerID, err := l.transferLedger(targetFXAccID, creditAccID, req.Conversion.Amount)
+	if err != nil {
+		return nil, nonRetryableLedgerError(err)
 	}
 
-	resp, err := l.TB.CreateTransfers([]tb_types.Transfer{
+	linkedFlags := flags
+	linkedFlags.Linked = true
+
+	return []tb_types.Transfer{
 		{
-			ID:              id,
+			ID:              toU128(req.ID.Bytes()),
 			DebitAccountID:  debitAccID,
+			CreditAccountID: sourceFXAccID,
+			Amount:          req.Amount.Value,
+			Flags:           linkedFlags.ToUint16(),
+			Ledger:          sourceLedgerID,
+			Code:            uint16(1), // for now constant
+		},
+		{
+			ID:              toU128(ConversionLegID(req.ID).Bytes()),
+			DebitAccountID:  targetFXAccID,
 			CreditAccountID: creditAccID,
-			Amount:          req.Amount,
+			Amount:          req.Conversion.Amount.Value,
+			Flags:           flags.ToUint16(),
+			Ledger:          targetLedgerID,
+			Code:            uint16(1), // for now constant
+		},
+	}, nil
+}
+
+// SettleTransaction posts the pending transfer. An amount lower than the pending amount
+// posts only that amount and releases the rest, zero posts the full pending amount.
+// The conversion leg of the pending transfer is posted in the same proportion.
+func (l *Service) SettleTransaction(pendingID uuid.UUID, newID uuid.UUID, amount uint64) error {
+	pending, leg, err := l.lookupPending(pendingID)
+	if err != nil {
+		return err
+	}
+
+	transfers := []tb_types.Transfer{
+		{
+			ID:        toU128(newID.Bytes()),
+			PendingID: pending.ID,
+			Amount:    amount,
 			Flags: tb_types.TransferFlags{
-				Pending: true,
+				PostPendingTransfer: true,
 			}.ToUint16(),
-			Ledger: uint32(1), // for now constant
-			Code:   uint16(1), // for now constant
 		},
-	})
+	}
 
+	if leg != nil {
+		transfers[0].Flags = tb_types.TransferFlags{Linked: true, PostPendingTransfer: true}.ToUint16()
+		transfers = append(transfers, tb_types.Transfer{
+			ID:        toU128(ConversionLegID(newID).Bytes()),
+			PendingID: leg.ID,
+			Amount:    legAmount(leg, pending, amount),
+			Flags: tb_types.TransferFlags{
+				PostPendingTransfer: true,
+			}.ToUint16(),
+		})
+	}
+
+	resp, err := l.Backend.CreateTransfers(transfers)
 	if err != nil {
 		return errs.Wrap(err, "error creating the transfer")
 	}
 
-	for _, transfer := range resp {
-		switch {
-		case transfer.Result == tb_types.TransferOK,
-			transfer.Result == tb_types.TransferExists:
-			return nil
-		default:
-			return temporal.NewNonRetryableApplicationError(fmt.Sprintf("error creating transfer"), transfer.Result.String(), errors.New(transfer.Result.String()), nil)
-		}
-	}
-	return nil
+	return transferResultError(resp)
 }
 
-func (l *Service) SettleTransaction(pendingID uuid.UUID, newID uuid.UUID) error {
-	parsedPendingID := toU128(pendingID.Bytes())
+func (l *Service) CancelTransaction(transactionID uuid.UUID, newID uuid.UUID) error {
+	pending, leg, err := l.lookupPending(transactionID)
+	if err != nil {
+		return err
+	}
 
-	parsedSettlementID := toU128(newID.Bytes())
+	if pending.Flags&pendingFlag == 0 {
+		return temporal.NewNonRetryableApplicationError("transfer is no more in pending state", "not pending", errors.New("transfer is not pending"), nil)
+	}
 
-	resp, err := l.TB.CreateTransfers([]tb_types.Transfer{
+	transfers := []tb_types.Transfer{
 		{
-			ID:        parsedSettlementID,
-			PendingID: parsedPendingID,
+			ID:        toU128(newID.Bytes()),
+			PendingID: pending.ID,
 			Flags: tb_types.TransferFlags{
-				PostPendingTransfer: true,
+				VoidPendingTransfer: true,
 			}.ToUint16(),
 		},
-	})
+	}
 
+	if leg != nil {
+		transfers[0].Flags = tb_types.TransferFlags{Linked: true, VoidPendingTransfer: true}.ToUint16()
+		transfers = append(transfers, tb_types.Transfer{
+			ID:        toU128(ConversionLegID(newID).Bytes()),
+			PendingID: leg.ID,
+			Flags: tb_types.TransferFlags{
+				VoidPendingTransfer: true,
+			}.ToUint16(),
+		})
+	}
+
+	resp, err := l.Backend.CreateTransfers(transfers)
 	if err != nil {
 		return errs.Wrap(err, "error creating the transfer")
 	}
 
-	for _, transfer := range resp {
-		switch transfer.Result {
-		case tb_types.TransferOK,
-			tb_types.TransferExists:
-			return nil
-		default:
-			return temporal.NewNonRetryableApplicationError(fmt.Sprintf("error creating transfer"), "transfer already exist", errors.New(transfer.Result.String()), nil)
-		}
+	return transferResultError(resp)
+}
+
+// ReduceTransaction lowers the pending transfer to the given amount. The pending transfer is voided and
+// a new pending transfer for the amount is placed in the same linked chain, so both succeed or fail together.
+// The conversion leg of the pending transfer is reduced in the same proportion.
+func (l *Service) ReduceTransaction(pendingID uuid.UUID, voidID uuid.UUID, newPendingID uuid.UUID, amount uint64) error {
+	pending, leg, err := l.lookupPending(pendingID)
+	if err != nil {
+		return err
 	}
 
-	return nil
-}
+	if amount == 0 || amount >= pending.Amount {
+		return temporal.NewNonRetryableApplicationError("reduced amount must be lower than the pending amount", "invalid_amount", errors.New("invalid amount"), nil)
+	}
 
-func (l *Service) CancelTransaction(transactionID uuid.UUID, newID uuid.UUID) error {
-	parseTransferID := toU128(transactionID.Bytes())
+	transfers := []tb_types.Transfer{
+		{
+			ID:        toU128(voidID.Bytes()),
+			PendingID: pending.ID,
+			Flags: tb_types.TransferFlags{
+				Linked:              true,
+				VoidPendingTransfer: true,
+			}.ToUint16(),
+		},
+	}
 
-	transfer, err := l.TB.LookupTransfers([]tb_types.Uint128{
-		parseTransferID,
+	if leg != nil {
+		transfers = append(transfers, tb_types.Transfer{
+			ID:        toU128(ConversionLegID(voidID).Bytes()),
+			PendingID: leg.ID,
+			Flags: tb_types.TransferFlags{
+				Linked:              true,
+				VoidPendingTransfer: true,
+			}.ToUint16(),
+		})
+	}
+
+	transfers = append(transfers, tb_types.Transfer{
+		ID:              toU128(newPendingID.Bytes()),
+		DebitAccountID:  pending.DebitAccountID,
+		CreditAccountID: pending.CreditAccountID,
+		Amount:          amount,
+		Flags: tb_types.TransferFlags{
+			Linked:  leg != nil,
+			Pending: true,
+		}.ToUint16(),
+		Ledger: pending.Ledger,
+		Code:   pending.Code,
 	})
 
-	if err != nil {
-		return errs.Wrap(err, "error getting the transfer")
+	if leg != nil {
+		transfers = append(transfers, tb_types.Transfer{
+			ID:              toU128(ConversionLegID(newPendingID).Bytes()),
+			DebitAccountID:  leg.DebitAccountID,
+			CreditAccountID: leg.CreditAccountID,
+			Amount:          legAmount(leg, pending, amount),
+			Flags: tb_types.TransferFlags{
+				Pending: true,
+			}.ToUint16(),
+			Ledger: leg.Ledger,
+			Code:   leg.Code,
+		})
 	}
 
-	if len(transfer) == 0 {
-		return temporal.NewNonRetryableApplicationError("transfer not found", "not found", errors.New("transfer not found"), nil)
+	resp, err := l.Backend.CreateTransfers(transfers)
+	if err != nil {
+		return errs.Wrap(err, "error creating the transfer")
 	}
 
-	pendingFlag := tb_types.TransferFlags{Pending: true}.ToUint16()
-	if transfer[0].Flags != pendingFlag {
-		return temporal.NewNonRetryableApplicationError("transfer is no more in pending state", "not pending", errors.New("transfer is not pending"), nil)
-	}
+	return transferResultError(resp)
+}
 
-	parsedNewID := toU128(newID.Bytes())
+// CaptureTransaction posts part of the pending transfer and keeps the rest pending. The pending transfer is posted for
+// the amount, which releases the rest, and a new pending transfer for the rest is placed in the same linked chain, so
+// both succeed or fail together. The conversion leg of the pending transfer is split in the same proportion.
+func (l *Service) CaptureTransaction(pendingID uuid.UUID, postID uuid.UUID, newPendingID uuid.UUID, amount uint64) error {
+	pending, leg, err := l.lookupPending(pendingID)
 	if err != nil {
-		return temporal.NewNonRetryableApplicationError("error parsing transfer id", "invalid_id", errs.Wrap(err, "error parsing the transfer id"))
+		return err
 	}
 
-	resp, err := l.TB.CreateTransfers([]tb_types.Transfer{
+	if amount == 0 || amount >= pending.Amount {
+		return temporal.NewNonRetryableApplicationError("captured amount must be lower than the pending amount", "invalid_amount", errors.New("invalid amount"), nil)
+	}
+
+	transfers := []tb_types.Transfer{
 		{
-			ID:        parsedNewID,
-			PendingID: parseTransferID,
+			ID:        toU128(postID.Bytes()),
+			PendingID: pending.ID,
+			Amount:    amount,
 			Flags: tb_types.TransferFlags{
-				VoidPendingTransfer: true,
+				Linked:              true,
+				PostPendingTransfer: true,
 			}.ToUint16(),
 		},
+	}
+
+	var legPosted uint64
+	if leg != nil {
+		legPosted = legAmount(leg, pending, amount)
+		transfers = append(transfers, tb_types.Transfer{
+			ID:        toU128(ConversionLegID(postID).Bytes()),
+			PendingID: leg.ID,
+			Amount:    legPosted,
+			Flags: tb_types.TransferFlags{
+				Linked:              true,
+				PostPendingTransfer: true,
+			}.ToUint16(),
+		})
+	}
+
+	transfers = append(transfers, tb_types.Transfer{
+		ID:              toU128(newPendingID.Bytes()),
+		DebitAccountID:  pending.DebitAccountID,
+		CreditAccountID: pending.CreditAccountID,
+		Amount:          pending.Amount - amount,
+		Flags: tb_types.TransferFlags{
+			Linked:  leg != nil,
+			Pending: true,
+		}.ToUint16(),
+		Ledger: pending.Ledger,
+		Code:   pending.Code,
 	})
 
+	if leg != nil {
+		transfers = append(transfers, tb_types.Transfer{
+			ID:              toU128(ConversionLegID(newPendingID).Bytes()),
+			DebitAccountID:  leg.DebitAccountID,
+			CreditAccountID: leg.CreditAccountID,
+			Amount:          leg.Amount - legPosted,
+			Flags: tb_types.TransferFlags{
+				Pending: true,
+			}.ToUint16(),
+			Ledger: leg.Ledger,
+			Code:   leg.Code,
+		})
+	}
+
+	resp, err := l.Backend.CreateTransfers(transfers)
 	if err != nil {
 		return errs.Wrap(err, "error creating the transfer")
 	}
 
-	for _, transfer := range resp {
-		switch transfer.Result {
-		case tb_types.TransferOK,
-			tb_types.TransferExists:
-			return nil
-		default:
-			return temporal.NewNonRetryableApplicationError(fmt.Sprintf("error creating transfer"), "transfer already exist", errors.New(transfer.Result.String()), nil)
+	return transferResultError(resp)
+}
+
+// ConversionLegID returns the id of the transfer booking the converted amount of a conversion, derived from
+// the id of the transfer in the source currency so both legs can be found from either
+func ConversionLegID(id uuid.UUID) uuid.UUID {
+	return uuid.NewV5(id, "conversion-leg")
+}
+
+// lookupPending returns the pending transfer and its conversion leg, the leg is nil if the transfer isn't a conversion
+func (l *Service) lookupPending(pendingID uuid.UUID) (*tb_types.Transfer, *tb_types.Transfer, error) {
+	pendingU128 := toU128(pendingID.Bytes())
+	legU128 := toU128(ConversionLegID(pendingID).Bytes())
+
+	transfers, err := l.Backend.LookupTransfers([]tb_types.Uint128{
+		pendingU128,
+		legU128,
+	})
+	if err != nil {
+		return nil, nil, errs.Wrap(err, "error getting the transfer")
+	}
+
+	var pending, leg *tb_types.Transfer
+	for i := range transfers {
+		switch transfers[i].ID {
+		case pendingU128:
+			pending = &transfers[i]
+		case legU128:
+			leg = &transfers[i]
 		}
 	}
 
-	return nil
+	if pending == nil {
+		return nil, nil, temporal.NewNonRetryableApplicationError("transfer not found", "not found", errors.New("transfer not found"), nil)
+	}
+
+	return pending, leg, nil
+}
+
+// legAmount returns the part of the conversion leg matching the amount of the pending transfer, zero stays zero
+func legAmount(leg *tb_types.Transfer, pending *tb_types.Transfer, amount uint64) uint64 {
+	if amount == 0 || pending.Amount == 0 {
+		return 0
+	}
+
+	// amount never exceeds the pending amount, so the quotient fits
+	hi, lo := bits.Mul64(leg.Amount, amount)
+	if hi >= pending.Amount {
+		return leg.Amount
+	}
+	quo, _ := bits.Div64(hi, lo, pending.Amount)
+	return quo
+}
+
+// transferLedger returns the ledger of the debit and credit accounts. Money only moves between accounts of the same
+// ledger, so a transfer between accounts of different currencies, or in another currency than theirs, is rejected.
+func (l *Service) transferLedger(debitAccID, creditAccID tb_types.Uint128, amount money.Amount) (uint32, error) {
+	accounts, err := l.Backend.LookupAccounts([]tb_types.Uint128{
+		debitAccID,
+		creditAccID,
+	})
+	if err != nil {
+		return 0, errs.Wrap(err, "error getting the accounts")
+	}
+
+	ledgers := make(map[tb_types.Uint128]uint32, len(accounts))
+	for _, acc := range accounts {
+		ledgers[acc.ID] = acc.Ledger
+	}
+
+	debitLedger, debitFound := ledgers[debitAccID]
+	creditLedger, creditFound := ledgers[creditAccID]
+	if !debitFound || !creditFound {
+		return 0, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "account not found",
+		}
+	}
+
+	if debitLedger != creditLedger {
+		return 0, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "accounts are in different currencies",
+		}
+	}
+
+	currency, err := CurrencyByLedger(debitLedger)
+	if err != nil {
+		return 0, err
+	}
+
+	if currency.Code != amount.Currency {
+		return 0, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("amount in %s can't be booked on %s accounts", amount.Currency, currency.Code),
+		}
+	}
+
+	return debitLedger, nil
+}
+
+// nonRetryableLedgerError stops the activity from being retried when the accounts can't take the transfer
+func nonRetryableLedgerError(err error) error {
+	switch errs.Code(err) {
+	case errs.NotFound, errs.InvalidArgument:
+		return temporal.NewNonRetryableApplicationError(err.Error(), "invalid_accounts", err)
+	}
+	return err
+}
+
+// LookupTransfers returns the ledger transfers with given ids, ids not found in the ledger are skipped
+func (l *Service) LookupTransfers(ids []uuid.UUID) ([]tb_types.Transfer, error) {
+	parsedIDs := make([]tb_types.Uint128, 0, len(ids))
+	for _, id := range ids {
+		parsedIDs = append(parsedIDs, toU128(id.Bytes()))
+	}
+
+	transfers, err := l.Backend.LookupTransfers(parsedIDs)
+	if err != nil {
+		return nil, errs.Wrap(err, "error getting the transfers")
+	}
+
+	return transfers, nil
+}
+
+// FromU128 converts a ledger id back to the uuid it was created from
+func FromU128(value tb_types.Uint128) uuid.UUID {
+	b := value.Bytes()
+	return uuid.FromBytesOrNil(b[:])
 }
 
 func toU128(value []byte) tb_types.Uint128 {
@@ -0,0 +1,483 @@
+package ledger
+
+import (
+	"math"
+	"testing"
+
+	"encore.dev/types/uuid"
+	tb_types "github.com/tigerbeetledb/tigerbeetle-go/pkg/types"
+
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/money"
+)
+
+const (
+	serviceCustomer    = 10
+	serviceMerchant    = 11
+	serviceEURMerchant = 12
+)
+
+// newTestService returns a ledger service on a memory backend with a USD customer holding 1000, a USD merchant,
+// an EUR merchant and the USD and EUR FX accounts
+func newTestService(t *testing.T) *Service {
+	t.Helper()
+
+	chart, err := NewChartOfAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewLedgerService(NewMemoryBackend(), chart)
+
+	customer, err := chart.AccountType("customer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	suspense, err := chart.AccountType("suspense")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fxLiquidity, err := chart.AccountType("fx_liquidity")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts := []struct {
+		id       uint64
+		accType  AccountType
+		currency string
+	}{
+		{serviceCustomer, customer, "USD"},
+		{serviceMerchant, customer, "USD"},
+		{serviceEURMerchant, customer, "EUR"},
+		{401, suspense, "USD"},
+		{101, fxLiquidity, "USD"},
+		{102, fxLiquidity, "EUR"},
+	}
+	for _, acc := range accounts {
+		if err := l.CreateAccount(acc.id, acc.accType, acc.currency, tb_types.Uint128{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := l.PostTransfer(&TransferReq{ID: uuid.Must(uuid.NewV4()), DebitAccountID: 401, CreditAccountID: serviceCustomer, Amount: money.New(1000, "USD")}); err != nil {
+		t.Fatal(err)
+	}
+
+	return l
+}
+
+// freeze holds 300 USD on the customer for the merchant, converted to 277 EUR when eur is set
+func freeze(t *testing.T, l *Service, eur bool) uuid.UUID {
+	t.Helper()
+
+	req := &TransferReq{ID: uuid.Must(uuid.NewV4()), DebitAccountID: serviceCustomer, CreditAccountID: serviceMerchant, Amount: money.New(300, "USD")}
+	if eur {
+		req.CreditAccountID = serviceEURMerchant
+		req.Conversion = &Conversion{SourceFXAccount: 101, TargetFXAccount: 102, Amount: money.New(277, "EUR")}
+	}
+	if err := l.FreezeAmount(req); err != nil {
+		t.Fatal(err)
+	}
+	return req.ID
+}
+
+// assertAccount checks the debits or the credits of an account, pending and posted
+func assertAccount(t *testing.T, l *Service, id uint64, debits bool, pending, posted uint64) {
+	t.Helper()
+
+	acc, err := l.GetAccount(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotPending, gotPosted := acc.CreditsPending, acc.CreditsPosted
+	if debits {
+		gotPending, gotPosted = acc.DebitsPending, acc.DebitsPosted
+	}
+	if gotPending != pending || gotPosted != posted {
+		t.Errorf("account %d: pending %d posted %d, want %d and %d", id, gotPending, gotPosted, pending, posted)
+	}
+}
+
+func TestFreezeAmount(t *testing.T) {
+	l := newTestService(t)
+	id := freeze(t, l, false)
+
+	assertAccount(t, l, serviceCustomer, true, 300, 0)
+	assertAccount(t, l, serviceMerchant, false, 300, 0)
+
+	// the same id is a no-op
+	if err := l.FreezeAmount(&TransferReq{ID: id, DebitAccountID: serviceCustomer, CreditAccountID: serviceMerchant, Amount: money.New(300, "USD")}); err != nil {
+		t.Fatalf("repeating the hold: %v", err)
+	}
+	assertAccount(t, l, serviceCustomer, true, 300, 0)
+
+	err := l.FreezeAmount(&TransferReq{ID: uuid.Must(uuid.NewV4()), DebitAccountID: serviceCustomer, CreditAccountID: serviceMerchant, Amount: money.New(701, "USD")})
+	if reason := DeclineReasonOf(err); reason != DeclineReasonInsufficientFunds {
+		t.Errorf("holding beyond the balance: got %q (%v), want %q", reason, err, DeclineReasonInsufficientFunds)
+	}
+	assertAccount(t, l, serviceCustomer, true, 300, 0)
+}
+
+func TestFreezeAmountConversion(t *testing.T) {
+	l := newTestService(t)
+	freeze(t, l, true)
+
+	assertAccount(t, l, serviceCustomer, true, 300, 0)
+	assertAccount(t, l, 101, false, 300, 0)
+	assertAccount(t, l, 102, true, 277, 0)
+	assertAccount(t, l, serviceEURMerchant, false, 277, 0)
+}
+
+func TestSettleTransaction(t *testing.T) {
+	tests := []struct {
+		name       string
+		eur        bool
+		amount     uint64
+		wantPosted uint64
+		wantLeg    uint64
+	}{
+		{name: "full", amount: 0, wantPosted: 300},
+		{name: "partial", amount: 200, wantPosted: 200},
+		{name: "full conversion", eur: true, amount: 0, wantPosted: 300, wantLeg: 277},
+		// 277 * 200 / 300 = 184.67, floored
+		{name: "partial conversion", eur: true, amount: 200, wantPosted: 200, wantLeg: 184},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestService(t)
+			id := freeze(t, l, tt.eur)
+			settleID := uuid.Must(uuid.NewV4())
+
+			if err := l.SettleTransaction(id, settleID, tt.amount); err != nil {
+				t.Fatal(err)
+			}
+			// the same id is a no-op
+			if err := l.SettleTransaction(id, settleID, tt.amount); err != nil {
+				t.Fatalf("repeating the settlement: %v", err)
+			}
+
+			assertAccount(t, l, serviceCustomer, true, 0, tt.wantPosted)
+			if tt.eur {
+				assertAccount(t, l, serviceEURMerchant, false, 0, tt.wantLeg)
+			} else {
+				assertAccount(t, l, serviceMerchant, false, 0, tt.wantPosted)
+			}
+		})
+	}
+}
+
+func TestCancelTransaction(t *testing.T) {
+	for _, eur := range []bool{false, true} {
+		l := newTestService(t)
+		id := freeze(t, l, eur)
+		cancelID := uuid.Must(uuid.NewV4())
+
+		if err := l.CancelTransaction(id, cancelID); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.CancelTransaction(id, cancelID); err != nil {
+			t.Fatalf("repeating the cancellation: %v", err)
+		}
+
+		assertAccount(t, l, serviceCustomer, true, 0, 0)
+		assertAccount(t, l, serviceEURMerchant, false, 0, 0)
+		assertAccount(t, l, 102, true, 0, 0)
+
+		if err := l.SettleTransaction(id, uuid.Must(uuid.NewV4()), 0); err == nil {
+			t.Error("settling a cancelled transaction succeeded")
+		}
+	}
+}
+
+func TestReduceTransaction(t *testing.T) {
+	tests := []struct {
+		name    string
+		eur     bool
+		amount  uint64
+		wantErr bool
+		wantLeg uint64
+	}{
+		{name: "reduce", amount: 120},
+		// 277 * 120 / 300 = 110.8, floored
+		{name: "reduce conversion", eur: true, amount: 120, wantLeg: 110},
+		{name: "zero", amount: 0, wantErr: true},
+		{name: "not lower", amount: 300, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestService(t)
+			id := freeze(t, l, tt.eur)
+			newID := uuid.Must(uuid.NewV4())
+
+			err := l.ReduceTransaction(id, uuid.Must(uuid.NewV4()), newID, tt.amount)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				assertAccount(t, l, serviceCustomer, true, 300, 0)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assertAccount(t, l, serviceCustomer, true, tt.amount, 0)
+			if tt.eur {
+				assertAccount(t, l, serviceEURMerchant, false, tt.wantLeg, 0)
+			}
+
+			// the reduced hold is pending on its own and settles as usual
+			if err := l.SettleTransaction(newID, uuid.Must(uuid.NewV4()), 0); err != nil {
+				t.Fatal(err)
+			}
+			assertAccount(t, l, serviceCustomer, true, 0, tt.amount)
+		})
+	}
+}
+
+func TestCaptureTransaction(t *testing.T) {
+	tests := []struct {
+		name    string
+		eur     bool
+		amount  uint64
+		wantErr bool
+		// EUR posted to the merchant by the capture
+		wantLeg uint64
+	}{
+		{name: "capture", amount: 100},
+		// 277 * 100 / 300 = 92.33, floored, the remaining 185 stay pending
+		{name: "capture conversion", eur: true, amount: 100, wantLeg: 92},
+		{name: "zero", amount: 0, wantErr: true},
+		{name: "not lower", amount: 300, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestService(t)
+			id := freeze(t, l, tt.eur)
+			postID, restID := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+
+			err := l.CaptureTransaction(id, postID, restID, tt.amount)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				assertAccount(t, l, serviceCustomer, true, 300, 0)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := l.CaptureTransaction(id, postID, restID, tt.amount); err != nil {
+				t.Fatalf("repeating the capture: %v", err)
+			}
+
+			assertAccount(t, l, serviceCustomer, true, 300-tt.amount, tt.amount)
+			if tt.eur {
+				assertAccount(t, l, serviceEURMerchant, false, 277-tt.wantLeg, tt.wantLeg)
+			} else {
+				assertAccount(t, l, serviceMerchant, false, 300-tt.amount, tt.amount)
+			}
+
+			// the rest is pending on its own and settles as usual
+			if err := l.SettleTransaction(restID, uuid.Must(uuid.NewV4()), 0); err != nil {
+				t.Fatal(err)
+			}
+			assertAccount(t, l, serviceCustomer, true, 0, 300)
+			if tt.eur {
+				assertAccount(t, l, serviceEURMerchant, false, 0, 277)
+			}
+		})
+	}
+}
+
+func TestCaptureTransactionWithoutFreeBalance(t *testing.T) {
+	l := newTestService(t)
+	id := freeze(t, l, false)
+
+	// spend the balance left beside the hold, the capture only moves money already held
+	if err := l.PostTransfer(&TransferReq{ID: uuid.Must(uuid.NewV4()), DebitAccountID: serviceCustomer, CreditAccountID: serviceMerchant, Amount: money.New(700, "USD")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CaptureTransaction(id, uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4()), 100); err != nil {
+		t.Fatal(err)
+	}
+	assertAccount(t, l, serviceCustomer, true, 200, 800)
+}
+
+func TestLegAmount(t *testing.T) {
+	tests := []struct {
+		name    string
+		leg     uint64
+		pending uint64
+		amount  uint64
+		want    uint64
+	}{
+		{"zero", 277, 300, 0, 0},
+		{"full", 277, 300, 300, 277},
+		{"even split", 200, 300, 150, 100},
+		// 277 * 100 / 300 = 92.33
+		{"uneven split", 277, 300, 100, 92},
+		// 277 * 299 / 300 = 276.08, the last minor unit stays with the rest
+		{"almost full", 277, 300, 299, 276},
+		// 1 * 1 / 3 = 0.33
+		{"below a minor unit", 1, 3, 1, 0},
+		// 1852 JPY converted to 1233 USD cents, 1000 JPY of it is 665.77 cents
+		{"fewer minor units", 1233, 1852, 1000, 665},
+		// the product overflows 64 bits
+		{"large amounts", math.MaxUint64 - 1, math.MaxUint64, math.MaxUint64 / 2, math.MaxUint64/2 - 1},
+		{"leg larger than pending", math.MaxUint64, 2, 1, math.MaxUint64 / 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := legAmount(&tb_types.Transfer{Amount: tt.leg}, &tb_types.Transfer{Amount: tt.pending}, tt.amount)
+			if got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLegAmountSplitsAdd(t *testing.T) {
+	// the captured parts of a leg and the part left pending never exceed the leg
+	leg, pending := &tb_types.Transfer{Amount: 277}, &tb_types.Transfer{Amount: 300}
+	for amount := uint64(1); amount < pending.Amount; amount++ {
+		captured := legAmount(leg, pending, amount)
+		rest := legAmount(leg, pending, pending.Amount-amount)
+		if captured+rest > leg.Amount {
+			t.Fatalf("splitting at %d: %d and %d exceed %d", amount, captured, rest, leg.Amount)
+		}
+	}
+}
+
+func TestPostOverdrawnTransfer(t *testing.T) {
+	tests := []struct {
+		name          string
+		amount        uint64
+		held          bool
+		wantOverdrawn uint64
+	}{
+		{name: "covered", amount: 600, wantOverdrawn: 0},
+		{name: "exact", amount: 1000, wantOverdrawn: 0},
+		{name: "short", amount: 1200, wantOverdrawn: 200},
+		// the hold of 300 isn't available
+		{name: "short beside a hold", amount: 900, held: true, wantOverdrawn: 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newTestService(t)
+			collections, err := l.Chart.AccountType("collections_receivable")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := l.CreateAccount(601, collections, "USD", tb_types.Uint128{}); err != nil {
+				t.Fatal(err)
+			}
+			var held uint64
+			if tt.held {
+				freeze(t, l, false)
+				held = 300
+			}
+
+			req := &TransferReq{ID: uuid.Must(uuid.NewV4()), DebitAccountID: serviceCustomer, CreditAccountID: serviceMerchant, Amount: money.New(tt.amount, "USD")}
+			overdraftID := uuid.NewV5(req.ID, "collections")
+
+			overdrawn, err := l.PostOverdrawnTransfer(req, 601, overdraftID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if overdrawn != tt.wantOverdrawn {
+				t.Errorf("overdrawn %d, want %d", overdrawn, tt.wantOverdrawn)
+			}
+			assertAccount(t, l, serviceCustomer, true, held, tt.amount)
+			assertAccount(t, l, 601, true, 0, tt.wantOverdrawn)
+
+			// a replay returns the booked overdraft, though the balance changed since
+			overdrawn, err = l.PostOverdrawnTransfer(req, 601, overdraftID)
+			if err != nil {
+				t.Fatalf("replaying: %v", err)
+			}
+			if overdrawn != tt.wantOverdrawn {
+				t.Errorf("replay overdrawn %d, want %d", overdrawn, tt.wantOverdrawn)
+			}
+			assertAccount(t, l, 601, true, 0, tt.wantOverdrawn)
+		})
+	}
+}
+
+func TestPostOverdrawnTransferFailsTogether(t *testing.T) {
+	l := newTestService(t)
+	collections, err := l.Chart.AccountType("collections_receivable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CreateAccount(601, collections, "USD", tb_types.Uint128{}); err != nil {
+		t.Fatal(err)
+	}
+
+	settlement, err := l.Chart.AccountType("settlement")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CreateAccount(2, settlement, "USD", tb_types.Uint128{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the settlement account can't take the money, the overdraft must not be booked alone
+	req := &TransferReq{ID: uuid.Must(uuid.NewV4()), DebitAccountID: serviceCustomer, CreditAccountID: 2, Amount: money.New(1200, "USD")}
+	_, err = l.PostOverdrawnTransfer(req, 601, uuid.NewV5(req.ID, "collections"))
+	if reason := DeclineReasonOf(err); reason != DeclineReasonSystemLimit {
+		t.Fatalf("got %q (%v), want %q", reason, err, DeclineReasonSystemLimit)
+	}
+	assertAccount(t, l, 601, true, 0, 0)
+	assertAccount(t, l, serviceCustomer, false, 0, 1000)
+}
+
+// racingBackend runs a booking of its own right before the first batch it's given, like a concurrent request
+type racingBackend struct {
+	*MemoryBackend
+	race func()
+}
+
+func (b *racingBackend) CreateTransfers(transfers []tb_types.Transfer) ([]tb_types.TransferEventResult, error) {
+	if race := b.race; race != nil {
+		b.race = nil
+		race()
+	}
+	return b.MemoryBackend.CreateTransfers(transfers)
+}
+
+func TestPostOverdrawnTransferConcurrentDebit(t *testing.T) {
+	l := newTestService(t)
+	collections, err := l.Chart.AccountType("collections_receivable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.CreateAccount(601, collections, "USD", tb_types.Uint128{}); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := &racingBackend{MemoryBackend: l.Backend.(*MemoryBackend)}
+	l.Backend = backend
+	backend.race = func() {
+		if err := l.PostTransfer(&TransferReq{ID: uuid.Must(uuid.NewV4()), DebitAccountID: serviceCustomer, CreditAccountID: serviceMerchant, Amount: money.New(500, "USD")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the shortfall is 200 when read, 700 once the concurrent debit is booked
+	req := &TransferReq{ID: uuid.Must(uuid.NewV4()), DebitAccountID: serviceCustomer, CreditAccountID: serviceMerchant, Amount: money.New(1200, "USD")}
+	overdrawn, err := l.PostOverdrawnTransfer(req, 601, uuid.NewV5(req.ID, "collections"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if overdrawn != 700 {
+		t.Errorf("overdrawn %d, want 700", overdrawn)
+	}
+	assertAccount(t, l, serviceCustomer, true, 0, 1700)
+	assertAccount(t, l, 601, true, 0, 700)
+}
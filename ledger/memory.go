@@ -0,0 +1,490 @@
+package ledger
+
+import (
+	"math/bits"
+	"sync"
+	"time"
+
+	tb_types "github.com/tigerbeetledb/tigerbeetle-go/pkg/types"
+)
+
+var (
+	linkedFlag  = tb_types.AccountFlags{Linked: true}.ToUint16()
+	pendingFlag = tb_types.TransferFlags{Pending: true}.ToUint16()
+	postFlag    = tb_types.TransferFlags{PostPendingTransfer: true}.ToUint16()
+	voidFlag    = tb_types.TransferFlags{VoidPendingTransfer: true}.ToUint16()
+
+	debitsMustNotExceedCreditsFlag = tb_types.AccountFlags{DebitsMustNotExceedCredits: true}.ToUint16()
+	creditsMustNotExceedDebitsFlag = tb_types.AccountFlags{CreditsMustNotExceedDebits: true}.ToUint16()
+
+	accountFlagsMask = tb_types.AccountFlags{
+		Linked:                     true,
+		DebitsMustNotExceedCredits: true,
+		CreditsMustNotExceedDebits: true,
+	}.ToUint16()
+	transferFlagsMask = tb_types.TransferFlags{
+		Linked:              true,
+		Pending:             true,
+		PostPendingTransfer: true,
+		VoidPendingTransfer: true,
+	}.ToUint16()
+
+	zeroUint128 = tb_types.Uint128{}
+	maxUint128  = tb_types.BytesToUint128([16]byte{
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+	})
+)
+
+// result codes shared by accounts and transfers for linked event chains
+const (
+	resultOK                   = 0
+	resultLinkedEventFailed    = 1
+	resultLinkedEventChainOpen = 2
+)
+
+// MemoryBackend is an in-memory Backend following TigerBeetle's rules: balance limit flags,
+// pending/post/void transfers, linked event chains and the same result codes.
+// It is meant for tests and local runs without a TigerBeetle cluster.
+type MemoryBackend struct {
+	mu        sync.Mutex
+	accounts  map[tb_types.Uint128]*tb_types.Account
+	transfers map[tb_types.Uint128]*tb_types.Transfer
+	// flags of the transfer that posted or voided a pending transfer, keyed by the pending id
+	resolved  map[tb_types.Uint128]uint16
+	timestamp uint64
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		accounts:  make(map[tb_types.Uint128]*tb_types.Account),
+		transfers: make(map[tb_types.Uint128]*tb_types.Transfer),
+		resolved:  make(map[tb_types.Uint128]uint16),
+	}
+}
+
+func (m *MemoryBackend) CreateAccounts(accounts []tb_types.Account) ([]tb_types.AccountEventResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	codes := applyChained(len(accounts),
+		func(i int) bool { return accounts[i].Flags&linkedFlag != 0 },
+		func(i int) (uint32, func()) {
+			res, undo := m.createAccount(accounts[i])
+			return uint32(res), undo
+		})
+
+	var results []tb_types.AccountEventResult
+	for i, code := range codes {
+		if code != resultOK {
+			results = append(results, tb_types.AccountEventResult{Index: uint32(i), Result: tb_types.CreateAccountResult(code)})
+		}
+	}
+	return results, nil
+}
+
+func (m *MemoryBackend) CreateTransfers(transfers []tb_types.Transfer) ([]tb_types.TransferEventResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	codes := applyChained(len(transfers),
+		func(i int) bool { return transfers[i].Flags&linkedFlag != 0 },
+		func(i int) (uint32, func()) {
+			res, undo := m.createTransfer(transfers[i])
+			return uint32(res), undo
+		})
+
+	var results []tb_types.TransferEventResult
+	for i, code := range codes {
+		if code != resultOK {
+			results = append(results, tb_types.TransferEventResult{Index: uint32(i), Result: tb_types.CreateTransferResult(code)})
+		}
+	}
+	return results, nil
+}
+
+func (m *MemoryBackend) LookupAccounts(accountIDs []tb_types.Uint128) ([]tb_types.Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var accounts []tb_types.Account
+	for _, id := range accountIDs {
+		if acc, ok := m.accounts[id]; ok {
+			accounts = append(accounts, *acc)
+		}
+	}
+	return accounts, nil
+}
+
+func (m *MemoryBackend) LookupTransfers(transferIDs []tb_types.Uint128) ([]tb_types.Transfer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var transfers []tb_types.Transfer
+	for _, id := range transferIDs {
+		if t, ok := m.transfers[id]; ok {
+			transfers = append(transfers, *t)
+		}
+	}
+	return transfers, nil
+}
+
+func (m *MemoryBackend) Close() {}
+
+// applyChained applies n events in order. A linked event forms a chain with the next one:
+// if any event of a chain fails, the applied events of the chain are rolled back and
+// every other event of the chain fails with linked_event_failed.
+func applyChained(n int, linked func(i int) bool, apply func(i int) (uint32, func())) []uint32 {
+	codes := make([]uint32, n)
+	var rollback []func()
+	chainStart, chainFailed := -1, false
+
+	for i := 0; i < n; i++ {
+		if chainStart < 0 && linked(i) {
+			chainStart = i
+		}
+		inChain := chainStart >= 0
+
+		switch {
+		case inChain && chainFailed:
+			codes[i] = resultLinkedEventFailed
+		case inChain && linked(i) && i == n-1:
+			codes[i] = resultLinkedEventChainOpen
+		default:
+			code, undo := apply(i)
+			codes[i] = code
+			if code == resultOK && inChain {
+				rollback = append(rollback, undo)
+			}
+		}
+
+		if inChain && codes[i] != resultOK && !chainFailed {
+			chainFailed = true
+			for j := len(rollback) - 1; j >= 0; j-- {
+				rollback[j]()
+			}
+			for j := chainStart; j < i; j++ {
+				codes[j] = resultLinkedEventFailed
+			}
+		}
+
+		if inChain && (!linked(i) || i == n-1) {
+			chainStart, chainFailed, rollback = -1, false, nil
+		}
+	}
+
+	return codes
+}
+
+func (m *MemoryBackend) createAccount(a tb_types.Account) (tb_types.CreateAccountResult, func()) {
+	switch {
+	case a.Timestamp != 0:
+		return tb_types.AccountTimestampMustBeZero, nil
+	case a.Flags&^accountFlagsMask != 0:
+		return tb_types.AccountReservedFlag, nil
+	case a.Reserved != [48]uint8{}:
+		return tb_types.AccountReservedField, nil
+	case a.ID == zeroUint128:
+		return tb_types.AccountIDMustNotBeZero, nil
+	case a.ID == maxUint128:
+		return tb_types.AccountIDMustNotBeIntMax, nil
+	case a.Ledger == 0:
+		return tb_types.AccountLedgerMustNotBeZero, nil
+	case a.Code == 0:
+		return tb_types.AccountCodeMustNotBeZero, nil
+	case a.DebitsPending != 0:
+		return tb_types.AccountDebitsPendingMustBeZero, nil
+	case a.DebitsPosted != 0:
+		return tb_types.AccountDebitsPostedMustBeZero, nil
+	case a.CreditsPending != 0:
+		return tb_types.AccountCreditsPendingMustBeZero, nil
+	case a.CreditsPosted != 0:
+		return tb_types.AccountCreditsPostedMustBeZero, nil
+	case a.Flags&debitsMustNotExceedCreditsFlag != 0 && a.Flags&creditsMustNotExceedDebitsFlag != 0:
+		return tb_types.AccountMutuallyExclusiveFlags, nil
+	}
+
+	if e, ok := m.accounts[a.ID]; ok {
+		switch {
+		case a.Flags != e.Flags:
+			return tb_types.AccountExistsWithDifferentFlags, nil
+		case a.UserData != e.UserData:
+			return tb_types.AccountExistsWithDifferentUserData, nil
+		case a.Ledger != e.Ledger:
+			return tb_types.AccountExistsWithDifferentLedger, nil
+		case a.Code != e.Code:
+			return tb_types.AccountExistsWithDifferentCode, nil
+		default:
+			return tb_types.AccountExists, nil
+		}
+	}
+
+	a.Timestamp = m.tick()
+	m.accounts[a.ID] = &a
+	return tb_types.AccountOK, func() { delete(m.accounts, a.ID) }
+}
+
+func (m *MemoryBackend) createTransfer(t tb_types.Transfer) (tb_types.CreateTransferResult, func()) {
+	switch {
+	case t.Timestamp != 0:
+		return tb_types.TransferTimestampMustBeZero, nil
+	case t.Flags&^transferFlagsMask != 0:
+		return tb_types.TransferReservedFlag, nil
+	case t.Reserved != zeroUint128:
+		return tb_types.TransferReservedField, nil
+	case t.ID == zeroUint128:
+		return tb_types.TransferIDMustNotBeZero, nil
+	case t.ID == maxUint128:
+		return tb_types.TransferIDMustNotBeIntMax, nil
+	}
+
+	if t.Flags&(postFlag|voidFlag) != 0 {
+		return m.postOrVoidPendingTransfer(t)
+	}
+
+	pending := t.Flags&pendingFlag != 0
+	switch {
+	case t.DebitAccountID == zeroUint128:
+		return tb_types.TransferDebitAccountIDMustNotBeZero, nil
+	case t.DebitAccountID == maxUint128:
+		return tb_types.TransferDebitAccountIDMustNotBeIntMax, nil
+	case t.CreditAccountID == zeroUint128:
+		return tb_types.TransferCreditAccountIDMustNotBeZero, nil
+	case t.CreditAccountID == maxUint128:
+		return tb_types.TransferCreditAccountIDMustNotBeIntMax, nil
+	case t.DebitAccountID == t.CreditAccountID:
+		return tb_types.TransferAccountsMustBeDifferent, nil
+	case t.PendingID != zeroUint128:
+		return tb_types.TransferPendingIDMustBeZero, nil
+	case !pending && t.Timeout != 0:
+		return tb_types.TransferTimeoutReservedForPendingTransfer, nil
+	case t.Ledger == 0:
+		return tb_types.TransferLedgerMustNotBeZero, nil
+	case t.Code == 0:
+		return tb_types.TransferCodeMustNotBeZero, nil
+	case t.Amount == 0:
+		return tb_types.TransferAmountMustNotBeZero, nil
+	}
+
+	dr, ok := m.accounts[t.DebitAccountID]
+	if !ok {
+		return tb_types.TransferDebitAccountNotFound, nil
+	}
+	cr, ok := m.accounts[t.CreditAccountID]
+	if !ok {
+		return tb_types.TransferCreditAccountNotFound, nil
+	}
+
+	switch {
+	case dr.Ledger != cr.Ledger:
+		return tb_types.TransferAccountsMustHaveTheSameLedger, nil
+	case t.Ledger != dr.Ledger:
+		return tb_types.TransferTransferMustHaveTheSameLedgerAsAccounts, nil
+	}
+
+	if e, ok := m.transfers[t.ID]; ok {
+		switch {
+		case t.Flags != e.Flags:
+			return tb_types.TransferExistsWithDifferentFlags, nil
+		case t.DebitAccountID != e.DebitAccountID:
+			return tb_types.TransferExistsWithDifferentDebitAccountID, nil
+		case t.CreditAccountID != e.CreditAccountID:
+			return tb_types.TransferExistsWithDifferentCreditAccountID, nil
+		case t.UserData != e.UserData:
+			return tb_types.TransferExistsWithDifferentUserData, nil
+		case t.Timeout != e.Timeout:
+			return tb_types.TransferExistsWithDifferentTimeout, nil
+		case t.Code != e.Code:
+			return tb_types.TransferExistsWithDifferentCode, nil
+		case t.Amount != e.Amount:
+			return tb_types.TransferExistsWithDifferentAmount, nil
+		default:
+			return tb_types.TransferExists, nil
+		}
+	}
+
+	now := m.tick()
+	if pending {
+		if _, overflow := add(dr.DebitsPending, t.Amount); overflow {
+			return tb_types.TransferOverflowsDebitsPending, nil
+		}
+		if _, overflow := add(cr.CreditsPending, t.Amount); overflow {
+			return tb_types.TransferOverflowsCreditsPending, nil
+		}
+	} else {
+		if _, overflow := add(dr.DebitsPosted, t.Amount); overflow {
+			return tb_types.TransferOverflowsDebitsPosted, nil
+		}
+		if _, overflow := add(cr.CreditsPosted, t.Amount); overflow {
+			return tb_types.TransferOverflowsCreditsPosted, nil
+		}
+	}
+
+	drDebits, overflow := add(dr.DebitsPending, dr.DebitsPosted, t.Amount)
+	if overflow {
+		return tb_types.TransferOverflowsDebits, nil
+	}
+	crCredits, overflow := add(cr.CreditsPending, cr.CreditsPosted, t.Amount)
+	if overflow {
+		return tb_types.TransferOverflowsCredits, nil
+	}
+	if _, overflow := add(now, t.Timeout); overflow {
+		return tb_types.TransferOverflowsTimeout, nil
+	}
+
+	switch {
+	case dr.Flags&debitsMustNotExceedCreditsFlag != 0 && drDebits > dr.CreditsPosted:
+		return tb_types.TransferExceedsCredits, nil
+	case cr.Flags&creditsMustNotExceedDebitsFlag != 0 && crCredits > cr.DebitsPosted:
+		return tb_types.TransferExceedsDebits, nil
+	}
+
+	drBefore, crBefore := *dr, *cr
+	if pending {
+		dr.DebitsPending += t.Amount
+		cr.CreditsPending += t.Amount
+	} else {
+		dr.DebitsPosted += t.Amount
+		cr.CreditsPosted += t.Amount
+	}
+
+	t.Timestamp = now
+	m.transfers[t.ID] = &t
+
+	return tb_types.TransferOK, func() {
+		*dr, *cr = drBefore, crBefore
+		delete(m.transfers, t.ID)
+	}
+}
+
+func (m *MemoryBackend) postOrVoidPendingTransfer(t tb_types.Transfer) (tb_types.CreateTransferResult, func()) {
+	post := t.Flags&postFlag != 0
+	void := t.Flags&voidFlag != 0
+
+	switch {
+	case post && void:
+		return tb_types.TransferCannotPostAndVoidPendingTransfer, nil
+	case t.Flags&pendingFlag != 0:
+		return tb_types.TransferPendingTransferCannotPostOrVoidAnother, nil
+	case t.Timeout != 0:
+		return tb_types.TransferTimeoutReservedForPendingTransfer, nil
+	case t.PendingID == zeroUint128:
+		return tb_types.TransferPendingIDMustNotBeZero, nil
+	case t.PendingID == maxUint128:
+		return tb_types.TransferPendingIDMustNotBeIntMax, nil
+	case t.PendingID == t.ID:
+		return tb_types.TransferPendingIDMustBeDifferent, nil
+	}
+
+	p, ok := m.transfers[t.PendingID]
+	if !ok {
+		return tb_types.TransferPendingTransferNotFound, nil
+	}
+
+	switch {
+	case p.Flags&pendingFlag == 0:
+		return tb_types.TransferPendingTransferNotPending, nil
+	case t.DebitAccountID != zeroUint128 && t.DebitAccountID != p.DebitAccountID:
+		return tb_types.TransferPendingTransferHasDifferentDebitAccountID, nil
+	case t.CreditAccountID != zeroUint128 && t.CreditAccountID != p.CreditAccountID:
+		return tb_types.TransferPendingTransferHasDifferentCreditAccountID, nil
+	case t.Ledger != 0 && t.Ledger != p.Ledger:
+		return tb_types.TransferPendingTransferHasDifferentLedger, nil
+	case t.Code != 0 && t.Code != p.Code:
+		return tb_types.TransferPendingTransferHasDifferentCode, nil
+	}
+
+	amount := t.Amount
+	if amount == 0 {
+		amount = p.Amount
+	}
+
+	switch {
+	case amount > p.Amount:
+		return tb_types.TransferExceedsPendingTransferAmount, nil
+	case void && amount < p.Amount:
+		return tb_types.TransferPendingTransferHasDifferentAmount, nil
+	}
+
+	if e, ok := m.transfers[t.ID]; ok {
+		switch {
+		case t.Flags != e.Flags:
+			return tb_types.TransferExistsWithDifferentFlags, nil
+		case t.PendingID != e.PendingID:
+			return tb_types.TransferExistsWithDifferentPendingID, nil
+		case t.UserData != e.UserData:
+			return tb_types.TransferExistsWithDifferentUserData, nil
+		case amount != e.Amount:
+			return tb_types.TransferExistsWithDifferentAmount, nil
+		default:
+			return tb_types.TransferExists, nil
+		}
+	}
+
+	if flags, ok := m.resolved[p.ID]; ok {
+		if flags&postFlag != 0 {
+			return tb_types.TransferPendingTransferAlreadyPosted, nil
+		}
+		return tb_types.TransferPendingTransferAlreadyVoided, nil
+	}
+
+	now := m.tick()
+	if p.Timeout > 0 && p.Timestamp+p.Timeout <= now {
+		return tb_types.TransferPendingTransferExpired, nil
+	}
+
+	dr := m.accounts[p.DebitAccountID]
+	cr := m.accounts[p.CreditAccountID]
+	if post {
+		if _, overflow := add(dr.DebitsPosted, amount); overflow {
+			return tb_types.TransferOverflowsDebitsPosted, nil
+		}
+		if _, overflow := add(cr.CreditsPosted, amount); overflow {
+			return tb_types.TransferOverflowsCreditsPosted, nil
+		}
+	}
+
+	drBefore, crBefore := *dr, *cr
+	dr.DebitsPending -= p.Amount
+	cr.CreditsPending -= p.Amount
+	if post {
+		dr.DebitsPosted += amount
+		cr.CreditsPosted += amount
+	}
+
+	t.DebitAccountID = p.DebitAccountID
+	t.CreditAccountID = p.CreditAccountID
+	t.Ledger = p.Ledger
+	t.Code = p.Code
+	t.Amount = amount
+	t.Timestamp = now
+	m.transfers[t.ID] = &t
+	m.resolved[p.ID] = t.Flags
+
+	return tb_types.TransferOK, func() {
+		*dr, *cr = drBefore, crBefore
+		delete(m.transfers, t.ID)
+		delete(m.resolved, p.ID)
+	}
+}
+
+// tick returns a strictly increasing timestamp in nanoseconds, like TigerBeetle assigns to every event
+func (m *MemoryBackend) tick() uint64 {
+	now := uint64(time.Now().UnixNano())
+	if now <= m.timestamp {
+		now = m.timestamp + 1
+	}
+	m.timestamp = now
+	return now
+}
+
+// add sums the values and reports whether the sum overflowed
+func add(values ...uint64) (uint64, bool) {
+	var sum, carry uint64
+	for _, v := range values {
+		var c uint64
+		sum, c = bits.Add64(sum, v, 0)
+		carry |= c
+	}
+	return sum, carry != 0
+}
@@ -0,0 +1,409 @@
+package ledger
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	tb_types "github.com/tigerbeetledb/tigerbeetle-go/pkg/types"
+)
+
+const (
+	testCustomer    = 1
+	testSettlement  = 2
+	testFunding     = 3
+	testOtherLedger = 4
+
+	testFundingTransfer  = 901
+	testPendingTransfer  = 902
+	testPostedPending    = 903
+	testPostOfPending    = 904
+	testExpiringTransfer = 905
+)
+
+func testID(n uint64) tb_types.Uint128 {
+	id, err := tb_types.HexStringToUint128(fmt.Sprintf("%d", n))
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+// newTestBackend returns a backend with a customer holding 1000, 100 of it pending and 50 posted from a pending
+// transfer, a settlement account able to take 1000, a funding account without limits and an account on another ledger
+func newTestBackend(t *testing.T) *MemoryBackend {
+	t.Helper()
+	b := NewMemoryBackend()
+
+	mustCreateAccounts(t, b, []tb_types.Account{
+		{ID: testID(testCustomer), Ledger: 1, Code: 1, Flags: debitsMustNotExceedCreditsFlag},
+		{ID: testID(testSettlement), Ledger: 1, Code: 2, Flags: creditsMustNotExceedDebitsFlag},
+		{ID: testID(testFunding), Ledger: 1, Code: 3},
+		{ID: testID(testOtherLedger), Ledger: 2, Code: 3},
+	})
+	mustCreateTransfers(t, b, []tb_types.Transfer{
+		{ID: testID(testFundingTransfer), DebitAccountID: testID(testFunding), CreditAccountID: testID(testCustomer), Amount: 1000, Ledger: 1, Code: 1},
+		{ID: testID(906), DebitAccountID: testID(testSettlement), CreditAccountID: testID(testFunding), Amount: 1000, Ledger: 1, Code: 1},
+		{ID: testID(testPendingTransfer), DebitAccountID: testID(testCustomer), CreditAccountID: testID(testFunding), Amount: 100, Flags: pendingFlag, Ledger: 1, Code: 1},
+		{ID: testID(testPostedPending), DebitAccountID: testID(testCustomer), CreditAccountID: testID(testFunding), Amount: 50, Flags: pendingFlag, Ledger: 1, Code: 1},
+		{ID: testID(testPostOfPending), PendingID: testID(testPostedPending), Flags: postFlag},
+		{ID: testID(testExpiringTransfer), DebitAccountID: testID(testFunding), CreditAccountID: testID(testCustomer), Amount: 10, Flags: pendingFlag, Timeout: 1, Ledger: 1, Code: 1},
+	})
+
+	return b
+}
+
+func mustCreateAccounts(t *testing.T, b *MemoryBackend, accounts []tb_types.Account) {
+	t.Helper()
+	for i, code := range createAccounts(t, b, accounts) {
+		if code != tb_types.AccountOK {
+			t.Fatalf("account %d: %s", i, code)
+		}
+	}
+}
+
+func mustCreateTransfers(t *testing.T, b *MemoryBackend, transfers []tb_types.Transfer) {
+	t.Helper()
+	for i, code := range createTransfers(t, b, transfers) {
+		if code != tb_types.TransferOK {
+			t.Fatalf("transfer %d: %s", i, code)
+		}
+	}
+}
+
+// createAccounts returns the result of every account, ok ones included
+func createAccounts(t *testing.T, b *MemoryBackend, accounts []tb_types.Account) []tb_types.CreateAccountResult {
+	t.Helper()
+	res, err := b.CreateAccounts(accounts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes := make([]tb_types.CreateAccountResult, len(accounts))
+	for _, r := range res {
+		codes[r.Index] = r.Result
+	}
+	return codes
+}
+
+// createTransfers returns the result of every transfer, ok ones included
+func createTransfers(t *testing.T, b *MemoryBackend, transfers []tb_types.Transfer) []tb_types.CreateTransferResult {
+	t.Helper()
+	res, err := b.CreateTransfers(transfers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	codes := make([]tb_types.CreateTransferResult, len(transfers))
+	for _, r := range res {
+		codes[r.Index] = r.Result
+	}
+	return codes
+}
+
+func lookupAccount(t *testing.T, b *MemoryBackend, id uint64) tb_types.Account {
+	t.Helper()
+	accounts, err := b.LookupAccounts([]tb_types.Uint128{testID(id)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 1 {
+		t.Fatalf("account %d not found", id)
+	}
+	return accounts[0]
+}
+
+func TestMemoryBackendCreateAccount(t *testing.T) {
+	tests := []struct {
+		name    string
+		account tb_types.Account
+		want    tb_types.CreateAccountResult
+	}{
+		{"ok", tb_types.Account{ID: testID(10), Ledger: 1, Code: 1}, tb_types.AccountOK},
+		{"timestamp", tb_types.Account{ID: testID(10), Ledger: 1, Code: 1, Timestamp: 1}, tb_types.AccountTimestampMustBeZero},
+		{"reserved flag", tb_types.Account{ID: testID(10), Ledger: 1, Code: 1, Flags: 1 << 15}, tb_types.AccountReservedFlag},
+		{"reserved field", tb_types.Account{ID: testID(10), Ledger: 1, Code: 1, Reserved: [48]uint8{1}}, tb_types.AccountReservedField},
+		{"zero id", tb_types.Account{Ledger: 1, Code: 1}, tb_types.AccountIDMustNotBeZero},
+		{"max id", tb_types.Account{ID: maxUint128, Ledger: 1, Code: 1}, tb_types.AccountIDMustNotBeIntMax},
+		{"zero ledger", tb_types.Account{ID: testID(10), Code: 1}, tb_types.AccountLedgerMustNotBeZero},
+		{"zero code", tb_types.Account{ID: testID(10), Ledger: 1}, tb_types.AccountCodeMustNotBeZero},
+		{"debits pending", tb_types.Account{ID: testID(10), Ledger: 1, Code: 1, DebitsPending: 1}, tb_types.AccountDebitsPendingMustBeZero},
+		{"debits posted", tb_types.Account{ID: testID(10), Ledger: 1, Code: 1, DebitsPosted: 1}, tb_types.AccountDebitsPostedMustBeZero},
+		{"credits pending", tb_types.Account{ID: testID(10), Ledger: 1, Code: 1, CreditsPending: 1}, tb_types.AccountCreditsPendingMustBeZero},
+		{"credits posted", tb_types.Account{ID: testID(10), Ledger: 1, Code: 1, CreditsPosted: 1}, tb_types.AccountCreditsPostedMustBeZero},
+		{"exclusive flags", tb_types.Account{ID: testID(10), Ledger: 1, Code: 1, Flags: debitsMustNotExceedCreditsFlag | creditsMustNotExceedDebitsFlag}, tb_types.AccountMutuallyExclusiveFlags},
+		{"exists", tb_types.Account{ID: testID(testFunding), Ledger: 1, Code: 3}, tb_types.AccountExists},
+		{"exists with different flags", tb_types.Account{ID: testID(testFunding), Ledger: 1, Code: 3, Flags: debitsMustNotExceedCreditsFlag}, tb_types.AccountExistsWithDifferentFlags},
+		{"exists with different user data", tb_types.Account{ID: testID(testFunding), Ledger: 1, Code: 3, UserData: testID(1)}, tb_types.AccountExistsWithDifferentUserData},
+		{"exists with different ledger", tb_types.Account{ID: testID(testFunding), Ledger: 2, Code: 3}, tb_types.AccountExistsWithDifferentLedger},
+		{"exists with different code", tb_types.Account{ID: testID(testFunding), Ledger: 1, Code: 4}, tb_types.AccountExistsWithDifferentCode},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBackend(t)
+			got := createAccounts(t, b, []tb_types.Account{tt.account})
+			if got[0] != tt.want {
+				t.Errorf("got %s, want %s", got[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryBackendCreateTransfer(t *testing.T) {
+	transfer := func(debit, credit uint64, amount uint64) tb_types.Transfer {
+		return tb_types.Transfer{ID: testID(10), DebitAccountID: testID(debit), CreditAccountID: testID(credit), Amount: amount, Ledger: 1, Code: 1}
+	}
+	with := func(tr tb_types.Transfer, change func(*tb_types.Transfer)) tb_types.Transfer {
+		change(&tr)
+		return tr
+	}
+	resolve := func(pendingID uint64, flags uint16, amount uint64) tb_types.Transfer {
+		return tb_types.Transfer{ID: testID(10), PendingID: testID(pendingID), Amount: amount, Flags: flags}
+	}
+	funding := transfer(testFunding, testCustomer, 1000)
+	funding.ID = testID(testFundingTransfer)
+
+	tests := []struct {
+		name     string
+		transfer tb_types.Transfer
+		want     tb_types.CreateTransferResult
+	}{
+		{"ok", transfer(testCustomer, testFunding, 850), tb_types.TransferOK},
+		{"pending ok", with(transfer(testCustomer, testFunding, 850), func(tr *tb_types.Transfer) { tr.Flags = pendingFlag }), tb_types.TransferOK},
+		{"timestamp", with(transfer(testCustomer, testFunding, 1), func(tr *tb_types.Transfer) { tr.Timestamp = 1 }), tb_types.TransferTimestampMustBeZero},
+		{"reserved flag", with(transfer(testCustomer, testFunding, 1), func(tr *tb_types.Transfer) { tr.Flags = 1 << 15 }), tb_types.TransferReservedFlag},
+		{"reserved field", with(transfer(testCustomer, testFunding, 1), func(tr *tb_types.Transfer) { tr.Reserved = testID(1) }), tb_types.TransferReservedField},
+		{"zero id", with(transfer(testCustomer, testFunding, 1), func(tr *tb_types.Transfer) { tr.ID = zeroUint128 }), tb_types.TransferIDMustNotBeZero},
+		{"max id", with(transfer(testCustomer, testFunding, 1), func(tr *tb_types.Transfer) { tr.ID = maxUint128 }), tb_types.TransferIDMustNotBeIntMax},
+		{"zero debit account", with(transfer(testCustomer, testFunding, 1), func(tr *tb_types.Transfer) { tr.DebitAccountID = zeroUint128 }), tb_types.TransferDebitAccountIDMustNotBeZero},
+		{"max debit account", with(transfer(testCustomer, testFunding, 1), func(tr *tb_types.Transfer) { tr.DebitAccountID = maxUint128 }), tb_types.TransferDebitAccountIDMustNotBeIntMax},
+		{"zero credit account", with(transfer(testCustomer, testFunding, 1), func(tr *tb_types.Transfer) { tr.CreditAccountID = zeroUint128 }), tb_types.TransferCreditAccountIDMustNotBeZero},
+		{"max credit account", with(transfer(testCustomer, testFunding, 1), func(tr *tb_types.Transfer) { tr.CreditAccountID = maxUint128 }), tb_types.TransferCreditAccountIDMustNotBeIntMax},
+		{"same accounts", transfer(testCustomer, testCustomer, 1), tb_types.TransferAccountsMustBeDifferent},
+		{"pending id", with(transfer(testCustomer, testFunding, 1), func(tr *tb_types.Transfer) { tr.PendingID = testID(testPendingTransfer) }), tb_types.TransferPendingIDMustBeZero},
+		{"timeout without pending", with(transfer(testCustomer, testFunding, 1), func(tr *tb_types.Transfer) { tr.Timeout = 1 }), tb_types.TransferTimeoutReservedForPendingTransfer},
+		{"zero ledger", with(transfer(testCustomer, testFunding, 1), func(tr *tb_types.Transfer) { tr.Ledger = 0 }), tb_types.TransferLedgerMustNotBeZero},
+		{"zero code", with(transfer(testCustomer, testFunding, 1), func(tr *tb_types.Transfer) { tr.Code = 0 }), tb_types.TransferCodeMustNotBeZero},
+		{"zero amount", transfer(testCustomer, testFunding, 0), tb_types.TransferAmountMustNotBeZero},
+		{"debit account not found", transfer(99, testFunding, 1), tb_types.TransferDebitAccountNotFound},
+		{"credit account not found", transfer(testCustomer, 99, 1), tb_types.TransferCreditAccountNotFound},
+		{"accounts on different ledgers", transfer(testCustomer, testOtherLedger, 1), tb_types.TransferAccountsMustHaveTheSameLedger},
+		{"transfer on another ledger", with(transfer(testCustomer, testFunding, 1), func(tr *tb_types.Transfer) { tr.Ledger = 2 }), tb_types.TransferTransferMustHaveTheSameLedgerAsAccounts},
+		{"exists", funding, tb_types.TransferExists},
+		{"exists with different flags", with(funding, func(tr *tb_types.Transfer) { tr.Flags = pendingFlag }), tb_types.TransferExistsWithDifferentFlags},
+		{"exists with different debit account", with(funding, func(tr *tb_types.Transfer) { tr.DebitAccountID = testID(testSettlement) }), tb_types.TransferExistsWithDifferentDebitAccountID},
+		{"exists with different credit account", with(funding, func(tr *tb_types.Transfer) { tr.CreditAccountID = testID(testSettlement) }), tb_types.TransferExistsWithDifferentCreditAccountID},
+		{"exists with different user data", with(funding, func(tr *tb_types.Transfer) { tr.UserData = testID(1) }), tb_types.TransferExistsWithDifferentUserData},
+		{"exists with different code", with(funding, func(tr *tb_types.Transfer) { tr.Code = 2 }), tb_types.TransferExistsWithDifferentCode},
+		{"exists with different amount", with(funding, func(tr *tb_types.Transfer) { tr.Amount = 1 }), tb_types.TransferExistsWithDifferentAmount},
+		{"overflows debits posted", transfer(testFunding, testCustomer, math.MaxUint64), tb_types.TransferOverflowsDebitsPosted},
+		{"overflows credits posted", transfer(testSettlement, testFunding, math.MaxUint64-1000), tb_types.TransferOverflowsCreditsPosted},
+		{"overflows debits pending", with(transfer(testCustomer, testFunding, math.MaxUint64), func(tr *tb_types.Transfer) { tr.Flags = pendingFlag }), tb_types.TransferOverflowsDebitsPending},
+		{"overflows debits", transfer(testCustomer, testSettlement, math.MaxUint64-50), tb_types.TransferOverflowsDebits},
+		{"exceeds credits", transfer(testCustomer, testFunding, 851), tb_types.TransferExceedsCredits},
+		{"pending exceeds credits", with(transfer(testCustomer, testFunding, 851), func(tr *tb_types.Transfer) { tr.Flags = pendingFlag }), tb_types.TransferExceedsCredits},
+		{"exceeds debits", transfer(testFunding, testSettlement, 1001), tb_types.TransferExceedsDebits},
+
+		{"post", resolve(testPendingTransfer, postFlag, 0), tb_types.TransferOK},
+		{"partial post", resolve(testPendingTransfer, postFlag, 40), tb_types.TransferOK},
+		{"void", resolve(testPendingTransfer, voidFlag, 0), tb_types.TransferOK},
+		{"post and void", resolve(testPendingTransfer, postFlag|voidFlag, 0), tb_types.TransferCannotPostAndVoidPendingTransfer},
+		{"post a pending transfer", resolve(testPendingTransfer, postFlag|pendingFlag, 0), tb_types.TransferPendingTransferCannotPostOrVoidAnother},
+		{"post with a timeout", with(resolve(testPendingTransfer, postFlag, 0), func(tr *tb_types.Transfer) { tr.Timeout = 1 }), tb_types.TransferTimeoutReservedForPendingTransfer},
+		{"zero pending id", resolve(0, postFlag, 0), tb_types.TransferPendingIDMustNotBeZero},
+		{"pending id of itself", with(resolve(testPendingTransfer, postFlag, 0), func(tr *tb_types.Transfer) { tr.ID = testID(testPendingTransfer) }), tb_types.TransferPendingIDMustBeDifferent},
+		{"pending transfer not found", resolve(99, postFlag, 0), tb_types.TransferPendingTransferNotFound},
+		{"not pending", resolve(testFundingTransfer, postFlag, 0), tb_types.TransferPendingTransferNotPending},
+		{"different debit account", with(resolve(testPendingTransfer, postFlag, 0), func(tr *tb_types.Transfer) { tr.DebitAccountID = testID(testFunding) }), tb_types.TransferPendingTransferHasDifferentDebitAccountID},
+		{"different credit account", with(resolve(testPendingTransfer, postFlag, 0), func(tr *tb_types.Transfer) { tr.CreditAccountID = testID(testCustomer) }), tb_types.TransferPendingTransferHasDifferentCreditAccountID},
+		{"different ledger", with(resolve(testPendingTransfer, postFlag, 0), func(tr *tb_types.Transfer) { tr.Ledger = 2 }), tb_types.TransferPendingTransferHasDifferentLedger},
+		{"different code", with(resolve(testPendingTransfer, postFlag, 0), func(tr *tb_types.Transfer) { tr.Code = 2 }), tb_types.TransferPendingTransferHasDifferentCode},
+		{"exceeds pending amount", resolve(testPendingTransfer, postFlag, 101), tb_types.TransferExceedsPendingTransferAmount},
+		{"partial void", resolve(testPendingTransfer, voidFlag, 40), tb_types.TransferPendingTransferHasDifferentAmount},
+		{"already posted", resolve(testPostedPending, postFlag, 0), tb_types.TransferPendingTransferAlreadyPosted},
+		{"post exists", with(resolve(testPostedPending, postFlag, 0), func(tr *tb_types.Transfer) { tr.ID = testID(testPostOfPending) }), tb_types.TransferExists},
+		{"post exists with different amount", with(resolve(testPostedPending, postFlag, 10), func(tr *tb_types.Transfer) { tr.ID = testID(testPostOfPending) }), tb_types.TransferExistsWithDifferentAmount},
+		{"post exists with different pending id", with(resolve(testPendingTransfer, postFlag, 0), func(tr *tb_types.Transfer) { tr.ID = testID(testPostOfPending) }), tb_types.TransferExistsWithDifferentPendingID},
+		{"expired", resolve(testExpiringTransfer, postFlag, 0), tb_types.TransferPendingTransferExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBackend(t)
+			got := createTransfers(t, b, []tb_types.Transfer{tt.transfer})
+			if got[0] != tt.want {
+				t.Errorf("got %s, want %s", got[0], tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryBackendAlreadyVoided(t *testing.T) {
+	b := newTestBackend(t)
+	mustCreateTransfers(t, b, []tb_types.Transfer{{ID: testID(10), PendingID: testID(testPendingTransfer), Flags: voidFlag}})
+
+	got := createTransfers(t, b, []tb_types.Transfer{{ID: testID(11), PendingID: testID(testPendingTransfer), Flags: postFlag}})
+	if got[0] != tb_types.TransferPendingTransferAlreadyVoided {
+		t.Errorf("got %s, want %s", got[0], tb_types.TransferPendingTransferAlreadyVoided)
+	}
+
+	customer := lookupAccount(t, b, testCustomer)
+	if customer.DebitsPending != 0 || customer.DebitsPosted != 50 {
+		t.Errorf("customer debits pending %d posted %d, want 0 and 50", customer.DebitsPending, customer.DebitsPosted)
+	}
+}
+
+func TestMemoryBackendPartialPost(t *testing.T) {
+	b := newTestBackend(t)
+	mustCreateTransfers(t, b, []tb_types.Transfer{{ID: testID(10), PendingID: testID(testPendingTransfer), Amount: 40, Flags: postFlag}})
+
+	customer := lookupAccount(t, b, testCustomer)
+	if customer.DebitsPending != 0 || customer.DebitsPosted != 90 {
+		t.Errorf("customer debits pending %d posted %d, want 0 and 90", customer.DebitsPending, customer.DebitsPosted)
+	}
+
+	funding := lookupAccount(t, b, testFunding)
+	if funding.CreditsPending != 0 || funding.CreditsPosted != 1090 {
+		t.Errorf("funding credits pending %d posted %d, want 0 and 1090", funding.CreditsPending, funding.CreditsPosted)
+	}
+
+	transfers, err := b.LookupTransfers([]tb_types.Uint128{testID(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := transfers[0]
+	if post.Amount != 40 || post.DebitAccountID != testID(testCustomer) || post.CreditAccountID != testID(testFunding) || post.Ledger != 1 || post.Code != 1 {
+		t.Errorf("post booked as %+v", post)
+	}
+
+	got := createTransfers(t, b, []tb_types.Transfer{{ID: testID(11), PendingID: testID(testPendingTransfer), Amount: 60, Flags: postFlag}})
+	if got[0] != tb_types.TransferPendingTransferAlreadyPosted {
+		t.Errorf("posting the rest got %s, want %s", got[0], tb_types.TransferPendingTransferAlreadyPosted)
+	}
+}
+
+func TestMemoryBackendLinkedChain(t *testing.T) {
+	move := func(id uint64, debit, credit uint64, amount uint64, flags uint16) tb_types.Transfer {
+		return tb_types.Transfer{ID: testID(id), DebitAccountID: testID(debit), CreditAccountID: testID(credit), Amount: amount, Flags: flags, Ledger: 1, Code: 1}
+	}
+
+	tests := []struct {
+		name      string
+		transfers []tb_types.Transfer
+		want      []tb_types.CreateTransferResult
+		// customer debits posted after the batch
+		wantDebits uint64
+	}{
+		{
+			name: "chain succeeds",
+			transfers: []tb_types.Transfer{
+				move(10, testCustomer, testFunding, 100, linkedFlag),
+				move(11, testCustomer, testFunding, 200, 0),
+			},
+			want:       []tb_types.CreateTransferResult{tb_types.TransferOK, tb_types.TransferOK},
+			wantDebits: 350,
+		},
+		{
+			name: "failure rolls the chain back",
+			transfers: []tb_types.Transfer{
+				move(10, testCustomer, testFunding, 100, linkedFlag),
+				move(11, testCustomer, testFunding, 200, linkedFlag),
+				move(12, testCustomer, testFunding, 600, 0),
+			},
+			want:       []tb_types.CreateTransferResult{tb_types.TransferLinkedEventFailed, tb_types.TransferLinkedEventFailed, tb_types.TransferExceedsCredits},
+			wantDebits: 50,
+		},
+		{
+			name: "events after a failure fail along",
+			transfers: []tb_types.Transfer{
+				move(10, testCustomer, testFunding, 900, linkedFlag),
+				move(11, testCustomer, testFunding, 10, linkedFlag),
+				move(12, testCustomer, testFunding, 10, 0),
+			},
+			want:       []tb_types.CreateTransferResult{tb_types.TransferExceedsCredits, tb_types.TransferLinkedEventFailed, tb_types.TransferLinkedEventFailed},
+			wantDebits: 50,
+		},
+		{
+			name: "unterminated chain",
+			transfers: []tb_types.Transfer{
+				move(10, testCustomer, testFunding, 100, linkedFlag),
+				move(11, testCustomer, testFunding, 200, linkedFlag),
+			},
+			want:       []tb_types.CreateTransferResult{tb_types.TransferLinkedEventFailed, tb_types.TransferLinkedEventChainOpen},
+			wantDebits: 50,
+		},
+		{
+			name: "failed chain leaves other events alone",
+			transfers: []tb_types.Transfer{
+				move(10, testCustomer, testFunding, 100, 0),
+				move(11, testCustomer, testFunding, 200, linkedFlag),
+				move(12, testCustomer, testFunding, 0, 0),
+				move(13, testCustomer, testFunding, 300, 0),
+			},
+			want:       []tb_types.CreateTransferResult{tb_types.TransferOK, tb_types.TransferLinkedEventFailed, tb_types.TransferAmountMustNotBeZero, tb_types.TransferOK},
+			wantDebits: 450,
+		},
+		{
+			name: "rolled back post releases nothing",
+			transfers: []tb_types.Transfer{
+				{ID: testID(10), PendingID: testID(testPendingTransfer), Amount: 40, Flags: postFlag | linkedFlag},
+				move(11, testCustomer, testFunding, 2000, 0),
+			},
+			want:       []tb_types.CreateTransferResult{tb_types.TransferLinkedEventFailed, tb_types.TransferExceedsCredits},
+			wantDebits: 50,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBackend(t)
+			got := createTransfers(t, b, tt.transfers)
+			for i := range tt.want {
+				if got[i] != tt.want[i] {
+					t.Errorf("transfer %d: got %s, want %s", i, got[i], tt.want[i])
+				}
+			}
+
+			customer := lookupAccount(t, b, testCustomer)
+			if customer.DebitsPosted != tt.wantDebits {
+				t.Errorf("customer debits posted %d, want %d", customer.DebitsPosted, tt.wantDebits)
+			}
+			if customer.DebitsPending != 100 {
+				t.Errorf("customer debits pending %d, want 100", customer.DebitsPending)
+			}
+
+			for i, code := range got {
+				if code == tb_types.TransferOK {
+					continue
+				}
+				found, err := b.LookupTransfers([]tb_types.Uint128{tt.transfers[i].ID})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(found) != 0 {
+					t.Errorf("failed transfer %d was stored", i)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryBackendLinkedAccounts(t *testing.T) {
+	b := NewMemoryBackend()
+	got := createAccounts(t, b, []tb_types.Account{
+		{ID: testID(10), Ledger: 1, Code: 1, Flags: linkedFlag},
+		{ID: testID(11), Ledger: 1},
+	})
+	if got[0] != tb_types.AccountLinkedEventFailed || got[1] != tb_types.AccountCodeMustNotBeZero {
+		t.Errorf("got %s and %s", got[0], got[1])
+	}
+
+	accounts, err := b.LookupAccounts([]tb_types.Uint128{testID(10)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 0 {
+		t.Error("account of the failed chain was stored")
+	}
+}
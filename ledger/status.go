@@ -0,0 +1,46 @@
+package ledger
+
+import (
+	"fmt"
+
+	"encore.dev/beta/errs"
+)
+
+// AccountStatus is the lifecycle state of an account, kept with the account metadata since TigerBeetle has none
+type AccountStatus string
+
+const (
+	AccountStatusActive AccountStatus = "active"
+	// AccountStatusFrozen accounts can't be debited, money can still come in and holds be released
+	AccountStatusFrozen AccountStatus = "frozen"
+	// AccountStatusClosed accounts can't be debited nor credited
+	AccountStatusClosed AccountStatus = "closed"
+)
+
+// CheckDebit returns a FailedPrecondition error if money can't leave the account or be held on it
+func (s AccountStatus) CheckDebit(account uint64) error {
+	if s == AccountStatusFrozen || s == AccountStatusClosed {
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: fmt.Sprintf("account %d is %s", account, s),
+		}
+	}
+	return nil
+}
+
+// CheckPresentment returns a FailedPrecondition error if a presentment can't be taken on the account: a frozen account
+// still clears the authorizations held on it, a presentment matching none is refused by CheckDebit
+func (s AccountStatus) CheckPresentment(account uint64) error {
+	return s.CheckCredit(account)
+}
+
+// CheckCredit returns a FailedPrecondition error if money can't come in the account
+func (s AccountStatus) CheckCredit(account uint64) error {
+	if s == AccountStatusClosed {
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: fmt.Sprintf("account %d is %s", account, s),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package money
+
+import (
+	"fmt"
+	"math"
+	"math/bits"
+	"strings"
+
+	"encore.dev/beta/errs"
+)
+
+// Currency is an ISO 4217 currency, amounts are counted in its minor units
+type Currency struct {
+	Code string
+	// MinorUnits is the number of digits after the decimal point
+	MinorUnits int
+	Symbol     string
+}
+
+var currencies = map[string]Currency{
+	"USD": {Code: "USD", MinorUnits: 2, Symbol: "$"},
+	"EUR": {Code: "EUR", MinorUnits: 2, Symbol: "€"},
+	"GBP": {Code: "GBP", MinorUnits: 2, Symbol: "£"},
+	"JPY": {Code: "JPY", MinorUnits: 0, Symbol: "¥"},
+	"CAD": {Code: "CAD", MinorUnits: 2, Symbol: "CA$"},
+	"INR": {Code: "INR", MinorUnits: 2, Symbol: "₹"},
+	"KWD": {Code: "KWD", MinorUnits: 3, Symbol: "KD"},
+}
+
+// CurrencyByCode returns the currency with the ISO 4217 code
+func CurrencyByCode(code string) (Currency, error) {
+	c, ok := currencies[strings.ToUpper(code)]
+	if !ok {
+		return Currency{}, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: fmt.Sprintf("unsupported currency: %s", code),
+		}
+	}
+	return c, nil
+}
+
+// Format formats an amount in minor units with the currency symbol
+func (c Currency) Format(value uint64) string {
+	return c.Symbol + decimal(value, c.MinorUnits)
+}
+
+// Amount is an exact amount of money, in minor units of its currency
+type Amount struct {
+	Value    uint64 `json:"value"`
+	Currency string `json:"currency"`
+}
+
+// New returns the amount of minor units in the currency
+func New(value uint64, currency string) Amount {
+	return Amount{Value: value, Currency: strings.ToUpper(currency)}
+}
+
+// Parse parses a decimal string like "12.34" into an amount of the currency. Negative amounts, amounts with more
+// fraction digits than the currency has minor units and amounts that don't fit in minor units are rejected.
+func Parse(value string, currency string) (Amount, error) {
+	c, err := CurrencyByCode(currency)
+	if err != nil {
+		return Amount{}, err
+	}
+
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "-") {
+		return Amount{}, invalidAmount("amount must not be negative")
+	}
+
+	whole, fraction, _ := strings.Cut(value, ".")
+	if whole == "" && fraction == "" {
+		return Amount{}, invalidAmount(fmt.Sprintf("invalid amount: %q", value))
+	}
+	if len(fraction) > c.MinorUnits {
+		return Amount{}, invalidAmount(fmt.Sprintf("%s amounts have at most %d fraction digits", c.Code, c.MinorUnits))
+	}
+
+	// the fraction is padded to the minor units, so the digits read as minor units
+	digits := whole + fraction + strings.Repeat("0", c.MinorUnits-len(fraction))
+
+	var minor uint64
+	for _, d := range digits {
+		if d < '0' || d > '9' {
+			return Amount{}, invalidAmount(fmt.Sprintf("invalid amount: %q", value))
+		}
+
+		hi, lo := bits.Mul64(minor, 10)
+		sum, carry := bits.Add64(lo, uint64(d-'0'), 0)
+		if hi != 0 || carry != 0 {
+			return Amount{}, invalidAmount("amount is too large")
+		}
+		minor = sum
+	}
+
+	return Amount{Value: minor, Currency: c.Code}, nil
+}
+
+// IsZero tells if the amount is zero
+func (a Amount) IsZero() bool {
+	return a.Value == 0
+}
+
+// String formats the amount with its currency symbol, or its currency code for an unknown currency
+func (a Amount) String() string {
+	c, err := CurrencyByCode(a.Currency)
+	if err != nil {
+		return fmt.Sprintf("%d %s", a.Value, a.Currency)
+	}
+	return c.Format(a.Value)
+}
+
+func invalidAmount(message string) error {
+	return &errs.Error{
+		Code:    errs.InvalidArgument,
+		Message: message,
+	}
+}
+
+// decimal formats minor units as a decimal string with the given number of fraction digits
+func decimal(value uint64, minorUnits int) string {
+	if minorUnits == 0 {
+		return fmt.Sprintf("%d", value)
+	}
+
+	scale := uint64(math.Pow10(minorUnits))
+	return fmt.Sprintf("%d.%0*d", value/scale, minorUnits, value%scale)
+}
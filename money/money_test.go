@@ -0,0 +1,111 @@
+package money
+
+import (
+	"errors"
+	"testing"
+
+	"encore.dev/beta/errs"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		currency string
+		want     Amount
+		wantErr  bool
+	}{
+		{"whole", "12", "USD", New(1200, "USD"), false},
+		{"fraction", "12.34", "USD", New(1234, "USD"), false},
+		{"short fraction", "12.3", "USD", New(1230, "USD"), false},
+		{"no whole", ".5", "USD", New(50, "USD"), false},
+		{"trailing dot", "12.", "USD", New(1200, "USD"), false},
+		{"leading zeros", "007.50", "USD", New(750, "USD"), false},
+		{"zero", "0", "USD", New(0, "USD"), false},
+		{"whitespace", "  12.34\t", "USD", New(1234, "USD"), false},
+		{"lower case currency", "1.5", "eur", New(150, "EUR"), false},
+		{"no minor units", "1500", "JPY", New(1500, "JPY"), false},
+		{"three minor units", "1.234", "KWD", New(1234, "KWD"), false},
+		{"largest", "184467440737095516.15", "USD", New(18446744073709551615, "USD"), false},
+
+		{"empty", "", "USD", Amount{}, true},
+		{"only whitespace", "   ", "USD", Amount{}, true},
+		{"only a dot", ".", "USD", Amount{}, true},
+		{"negative", "-1.00", "USD", Amount{}, true},
+		{"negative zero", "-0", "USD", Amount{}, true},
+		{"negative after whitespace", " -5", "USD", Amount{}, true},
+		{"plus sign", "+5", "USD", Amount{}, true},
+		{"too many fraction digits", "1.234", "USD", Amount{}, true},
+		{"fraction of a currency without minor units", "1.5", "JPY", Amount{}, true},
+		{"too many fraction digits for three minor units", "1.2345", "KWD", Amount{}, true},
+		{"overflow", "184467440737095516.16", "USD", Amount{}, true},
+		{"overflow by digits", "99999999999999999999", "JPY", Amount{}, true},
+		{"inner whitespace", "1 000", "USD", Amount{}, true},
+		{"thousands separator", "1,000.00", "USD", Amount{}, true},
+		{"two dots", "1.2.3", "USD", Amount{}, true},
+		{"exponent", "1e3", "USD", Amount{}, true},
+		{"letters", "abc", "USD", Amount{}, true},
+		{"unknown currency", "1.00", "XXX", Amount{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(tt.value, tt.currency)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				var e *errs.Error
+				if !errors.As(err, &e) || e.Code != errs.InvalidArgument {
+					t.Errorf("got %v, want an invalid argument", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tests := []struct {
+		amount Amount
+		want   string
+	}{
+		{New(1234, "USD"), "$12.34"},
+		{New(5, "USD"), "$0.05"},
+		{New(0, "EUR"), "€0.00"},
+		{New(1500, "JPY"), "¥1500"},
+		{New(1234, "KWD"), "KD1.234"},
+		{New(18446744073709551615, "USD"), "$184467440737095516.15"},
+		{New(12, "XXX"), "12 XXX"},
+	}
+
+	for _, tt := range tests {
+		if got := tt.amount.String(); got != tt.want {
+			t.Errorf("%+v: got %q, want %q", tt.amount, got, tt.want)
+		}
+	}
+}
+
+func TestParseFormatRoundTrip(t *testing.T) {
+	for _, code := range []string{"USD", "JPY", "KWD"} {
+		c, err := CurrencyByCode(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, value := range []uint64{0, 1, 99, 100, 123456789, 18446744073709551615} {
+			parsed, err := Parse(decimal(value, c.MinorUnits), code)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parsed.Value != value {
+				t.Errorf("%s: %d formatted and parsed back to %d", code, value, parsed.Value)
+			}
+		}
+	}
+}
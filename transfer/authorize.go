@@ -0,0 +1,247 @@
+package transfer
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/types/uuid"
+	"go.temporal.io/api/serviceerror"
+
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/ledger"
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/transfer/db"
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/transfer/workflow"
+)
+
+// AuthorizationResponse is the decision on an authorization
+type AuthorizationResponse struct {
+	ID uuid.UUID `json:"id"`
+	// Status is approved once the hold is placed, or declined
+	Status        string `json:"status"`
+	DeclineReason string `json:"decline_reason,omitempty"`
+	// AuthCode identifies the approval on the card network, presentments carry it back
+	AuthCode string `json:"auth_code,omitempty"`
+}
+
+// Authorize places the hold of a card authorization and answers once it's approved or declined. Declines aren't
+// errors, an authorization still undecided after the decision timeout fails with a deadline exceeded error.
+//
+//encore:api private method=POST
+func (s *Service) Authorize(ctx context.Context, req *Request) (*AuthorizationResponse, error) {
+	if req.TxnType != TransactionTypeCreditCardAuth {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "not an authorization",
+		}
+	}
+
+	return s.authorize(ctx, req)
+}
+
+type GetAuthorizationRequest struct {
+	ID uuid.UUID `json:"id"`
+}
+
+// GetAuthorization returns the decision on an authorization, waiting for it like Authorize when it's not made yet
+//
+//encore:api private method=POST
+func (s *Service) GetAuthorization(ctx context.Context, req *GetAuthorizationRequest) (*AuthorizationResponse, error) {
+	return s.authorizationResult(ctx, req.ID, time.Now().Add(s.decision.timeout))
+}
+
+func (s *Service) authorize(ctx context.Context, req *Request) (*AuthorizationResponse, error) {
+	currency, err := s.accountCurrency(req.CustomerAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	workflowID, err := newWorkflowID(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// a retry gets the result of the authorization already made, its hold would count against its own controls
+	_, err = db.GetTransferByID(ctx, workflowID)
+	if err == nil {
+		return s.authorizationResult(ctx, workflowID, time.Now().Add(s.decision.timeout))
+	}
+	if errs.Code(err) != errs.NotFound {
+		return nil, err
+	}
+
+	settlementAccount, err := s.systemAccount(ledger.RoleSettlement, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	paymentDetails := &workflow.PaymentDetails{
+		WorkflowID:           workflowID,
+		SourceAccount:        req.CustomerAccount,
+		TargetAccount:        settlementAccount,
+		Amount:               req.Amount,
+		MerchantCategoryCode: req.MerchantCategoryCode,
+		Expiry:               s.expiry.forCategory(req.MerchantCategoryCode),
+		OverPresentment:      s.overPresent.forCategory(req.MerchantCategoryCode),
+		CardID:               nullUUID(req.CardID),
+		References:           db.NetworkReferences(req.References),
+	}
+	paymentDetails.References.AuthCode = authCode(workflowID)
+	// the workflow doesn't approve the authorization once the caller stopped waiting for it
+	deadline := time.Now().Add(s.decision.timeout)
+	paymentDetails.DecisionDeadline = deadline
+
+	if isForeign(req.Amount, currency) {
+		err = s.convert(paymentDetails, currency)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reason, err := checkAccount(ctx, paymentDetails)
+	if err != nil {
+		return nil, err
+	}
+	if reason == "" {
+		reason, err = checkSpendControls(ctx, paymentDetails, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+	if reason != "" {
+		err = recordDecline(paymentDetails, reason)
+		if err != nil {
+			return nil, err
+		}
+		return declined(workflowID, reason), nil
+	}
+
+	err = s.executeWorkflow(ctx, workflowID, s.workflowSvc.Authorization, paymentDetails)
+	if err != nil {
+		// the reservation is left to the workflow if it started after all, it's ignored once the authorization is recorded
+		_ = db.ReleaseSpend(ctx, workflowID)
+		return nil, err
+	}
+
+	return s.authorizationResult(ctx, workflowID, deadline)
+}
+
+// authorizationResult returns the decision on the authorization, from the transfers table once it's recorded or
+// from its workflow until the deadline
+func (s *Service) authorizationResult(ctx context.Context, id uuid.UUID, deadline time.Time) (*AuthorizationResponse, error) {
+	decision := &workflow.AuthorizationDecision{Status: workflow.DecisionApproved}
+
+	auth, err := db.GetTransferByID(ctx, id)
+	switch {
+	case errs.Code(err) == errs.NotFound:
+		decision, err = s.awaitDecision(ctx, id, deadline)
+		if err != nil {
+			return nil, err
+		}
+	case err != nil:
+		return nil, err
+	case auth.TransferProgress == string(db.TransferProgressDeclined):
+		decision.Status, decision.DeclineReason = workflow.DecisionDeclined, ledger.DeclineReason(auth.DeclineReason)
+	case auth.TransferProgress == string(db.TransferProgressFailedOnLedgerCancellation):
+		// the hold was placed but the authorization couldn't be recorded
+		decision.Status = workflow.DecisionFailed
+	}
+
+	switch decision.Status {
+	case workflow.DecisionDeclined:
+		return declined(id, decision.DeclineReason), nil
+	case workflow.DecisionFailed:
+		return nil, &errs.Error{
+			Code:    errs.Internal,
+			Message: "authorization failed",
+		}
+	}
+	return &AuthorizationResponse{ID: id, Status: string(decision.Status), AuthCode: authCode(id)}, nil
+}
+
+// authCode returns the auth code of the authorization, six characters derived from its id
+func authCode(id uuid.UUID) string {
+	return strings.ToUpper(hex.EncodeToString(id[:3]))
+}
+
+func declined(id uuid.UUID, reason ledger.DeclineReason) *AuthorizationResponse {
+	return &AuthorizationResponse{ID: id, Status: string(workflow.DecisionDeclined), DeclineReason: string(reason)}
+}
+
+// requestResult waits for the Authorization workflow to apply the request changing the authorization, a request
+// declined returns the decline error
+func (s *Service) requestResult(ctx context.Context, authID uuid.UUID, requestID uuid.UUID, what string) error {
+	decision, err := s.awaitQuery(ctx, authID, time.Now().Add(s.decision.timeout), what, workflow.RequestQuery, requestID)
+	if err != nil {
+		return err
+	}
+
+	switch decision.Status {
+	case workflow.DecisionDeclined:
+		return declinedError(decision.DeclineReason)
+	case workflow.DecisionFailed:
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: what + " failed",
+		}
+	}
+	return nil
+}
+
+// awaitDecision queries the Authorization workflow until it approves or declines the authorization, at most until the
+// deadline
+func (s *Service) awaitDecision(ctx context.Context, workflowID uuid.UUID, deadline time.Time) (*workflow.AuthorizationDecision, error) {
+	return s.awaitQuery(ctx, workflowID, deadline, "authorization decision", workflow.DecisionQuery)
+}
+
+// awaitQuery queries the Authorization workflow until the decision isn't pending, at most until the deadline. Querying
+// is retried until then, the workflow may not be picked up by a worker yet.
+func (s *Service) awaitQuery(ctx context.Context, workflowID uuid.UUID, deadline time.Time, what string, queryType string, args ...interface{}) (*workflow.AuthorizationDecision, error) {
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	for {
+		var decision workflow.AuthorizationDecision
+		resp, err := s.client.QueryWorkflow(ctx, workflowID.String(), "", queryType, args...)
+		if err == nil {
+			err = resp.Get(&decision)
+		}
+		if ctx.Err() != nil {
+			return nil, &errs.Error{
+				Code:    errs.DeadlineExceeded,
+				Message: "timed out waiting for the " + what,
+			}
+		}
+
+		var notFound *serviceerror.NotFound
+		switch {
+		case errors.As(err, &notFound):
+			return nil, &errs.Error{
+				Code:    errs.NotFound,
+				Message: "authorization not found",
+			}
+		case err != nil && !transientQueryError(err):
+			return nil, &errs.Error{
+				Code:    errs.Internal,
+				Message: errs.Wrap(err, "error querying the "+what).Error(),
+			}
+		case err == nil && decision.Status != workflow.DecisionPending:
+			return &decision, nil
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(s.decision.pollInterval):
+		}
+	}
+}
+
+// transientQueryError tells whether querying the workflow may succeed later: the query itself failing in the
+// workflow, or a query the server refuses, won't
+func transientQueryError(err error) bool {
+	var queryFailed *serviceerror.QueryFailed
+	var invalid *serviceerror.InvalidArgument
+	return !errors.As(err, &queryFailed) && !errors.As(err, &invalid)
+}
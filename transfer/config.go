@@ -0,0 +1,215 @@
+package transfer
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/transfer/db"
+)
+
+//go:embed config/authorization_expiry.json
+var authorizationExpiryConfig []byte
+
+// authorizationExpiry is how long an authorization hold lasts before it's released, per merchant category code
+type authorizationExpiry struct {
+	defaultExpiry      time.Duration
+	merchantCategories map[string]time.Duration
+}
+
+func loadAuthorizationExpiry(raw []byte) (*authorizationExpiry, error) {
+	var cfg struct {
+		Default            string            `json:"default"`
+		MerchantCategories map[string]string `json:"merchant_categories"`
+	}
+	err := json.Unmarshal(raw, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parse authorization expiry config: %v", err)
+	}
+
+	defaultExpiry, err := time.ParseDuration(cfg.Default)
+	if err != nil {
+		return nil, fmt.Errorf("parse default authorization expiry: %v", err)
+	}
+
+	expiry := &authorizationExpiry{
+		defaultExpiry:      defaultExpiry,
+		merchantCategories: make(map[string]time.Duration, len(cfg.MerchantCategories)),
+	}
+	for mcc, value := range cfg.MerchantCategories {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("parse authorization expiry of merchant category %s: %v", mcc, err)
+		}
+		expiry.merchantCategories[mcc] = d
+	}
+
+	return expiry, nil
+}
+
+// forCategory returns the expiry of the merchant category, falling back to the default one
+func (e *authorizationExpiry) forCategory(mcc string) time.Duration {
+	if d, ok := e.merchantCategories[mcc]; ok {
+		return d
+	}
+	return e.defaultExpiry
+}
+
+//go:embed config/authorization_decision.json
+var authorizationDecisionConfig []byte
+
+// authorizationDecision is how long an authorization waits for the Authorization workflow to approve or decline it,
+// and how often the workflow is queried meanwhile
+type authorizationDecision struct {
+	timeout      time.Duration
+	pollInterval time.Duration
+}
+
+func loadAuthorizationDecision(raw []byte) (*authorizationDecision, error) {
+	var cfg struct {
+		Timeout      string `json:"timeout"`
+		PollInterval string `json:"poll_interval"`
+	}
+	err := json.Unmarshal(raw, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parse authorization decision config: %v", err)
+	}
+
+	timeout, err := time.ParseDuration(cfg.Timeout)
+	if err != nil {
+		return nil, fmt.Errorf("parse authorization decision timeout: %v", err)
+	}
+
+	pollInterval, err := time.ParseDuration(cfg.PollInterval)
+	if err != nil {
+		return nil, fmt.Errorf("parse authorization decision poll interval: %v", err)
+	}
+
+	if timeout <= 0 || pollInterval <= 0 {
+		return nil, fmt.Errorf("authorization decision timeout and poll interval must be positive")
+	}
+
+	return &authorizationDecision{timeout: timeout, pollInterval: pollInterval}, nil
+}
+
+//go:embed config/presentment_matching.json
+var presentmentMatchingConfig []byte
+
+// presentmentMatching bounds the authorizations a presentment without references matches: their amount is at most
+// the tolerance above the presented amount and they were made within the time window. Expired authorizations are
+// matched for the grace window after their expiry.
+type presentmentMatching struct {
+	fuzzyAmountTolerancePercent uint64
+	fuzzyTimeWindow             time.Duration
+	lateGraceWindow             time.Duration
+}
+
+func loadPresentmentMatching(raw []byte) (*presentmentMatching, error) {
+	var cfg struct {
+		FuzzyAmountTolerancePercent uint64 `json:"fuzzy_amount_tolerance_percent"`
+		FuzzyTimeWindow             string `json:"fuzzy_time_window"`
+		LateGraceWindow             string `json:"late_presentment_grace_window"`
+	}
+	err := json.Unmarshal(raw, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parse presentment matching config: %v", err)
+	}
+
+	window, err := time.ParseDuration(cfg.FuzzyTimeWindow)
+	if err != nil {
+		return nil, fmt.Errorf("parse presentment matching time window: %v", err)
+	}
+
+	grace, err := time.ParseDuration(cfg.LateGraceWindow)
+	if err != nil {
+		return nil, fmt.Errorf("parse late presentment grace window: %v", err)
+	}
+
+	return &presentmentMatching{
+		fuzzyAmountTolerancePercent: cfg.FuzzyAmountTolerancePercent,
+		fuzzyTimeWindow:             window,
+		lateGraceWindow:             grace,
+	}, nil
+}
+
+// fuzzyBounds returns the largest authorized amount and the oldest authorization the presented amount matches fuzzily
+func (m *presentmentMatching) fuzzyBounds(amount uint64, now time.Time) (uint64, time.Time) {
+	return amount + amount*m.fuzzyAmountTolerancePercent/100, now.Add(-m.fuzzyTimeWindow)
+}
+
+// expiredSince returns the earliest expiry of the expired authorizations a presentment still matches
+func (m *presentmentMatching) expiredSince(now time.Time) time.Time {
+	return now.Add(-m.lateGraceWindow)
+}
+
+//go:embed config/force_post.json
+var forcePostConfig []byte
+
+// forcePost tells how presentments matching no authorization are posted: whether the collections account covers what
+// the customer account lacks, or the presentment fails without enough funds
+type forcePost struct {
+	overdrawIntoCollections bool
+}
+
+func loadForcePost(raw []byte) (*forcePost, error) {
+	var cfg struct {
+		OverdrawIntoCollections bool `json:"overdraw_into_collections"`
+	}
+	err := json.Unmarshal(raw, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parse force post config: %v", err)
+	}
+
+	return &forcePost{overdrawIntoCollections: cfg.OverdrawIntoCollections}, nil
+}
+
+//go:embed config/over_presentment.json
+var overPresentmentConfig []byte
+
+// overPresentment is how much a presentment may exceed the authorized amount per merchant category code, like a tip,
+// and whether presentments beyond it are declined or posted and flagged
+type overPresentment struct {
+	defaultTolerance    db.OverPresentmentTolerance
+	merchantCategories  map[string]db.OverPresentmentTolerance
+	flagBeyondTolerance bool
+}
+
+func loadOverPresentment(raw []byte) (*overPresentment, error) {
+	type tolerance struct {
+		Percent uint64 `json:"percent"`
+		Amount  uint64 `json:"amount"`
+	}
+	var cfg struct {
+		Default            tolerance            `json:"default"`
+		MerchantCategories map[string]tolerance `json:"merchant_categories"`
+		BeyondTolerance    string               `json:"beyond_tolerance"`
+	}
+	err := json.Unmarshal(raw, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("parse over-presentment config: %v", err)
+	}
+
+	if cfg.BeyondTolerance != "decline" && cfg.BeyondTolerance != "flag" {
+		return nil, fmt.Errorf("over-presentment beyond tolerance must be decline or flag, got %q", cfg.BeyondTolerance)
+	}
+
+	over := &overPresentment{
+		defaultTolerance:    db.OverPresentmentTolerance(cfg.Default),
+		merchantCategories:  make(map[string]db.OverPresentmentTolerance, len(cfg.MerchantCategories)),
+		flagBeyondTolerance: cfg.BeyondTolerance == "flag",
+	}
+	for mcc, t := range cfg.MerchantCategories {
+		over.merchantCategories[mcc] = db.OverPresentmentTolerance(t)
+	}
+
+	return over, nil
+}
+
+// forCategory returns the tolerance of the merchant category, falling back to the default one
+func (o *overPresentment) forCategory(mcc string) db.OverPresentmentTolerance {
+	if t, ok := o.merchantCategories[mcc]; ok {
+		return t
+	}
+	return o.defaultTolerance
+}
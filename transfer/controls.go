@@ -0,0 +1,227 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"encore.dev/types/uuid"
+
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/ledger"
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/transfer/db"
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/transfer/workflow"
+)
+
+// DeclineDetails are the details of the error of a declined authorization
+type DeclineDetails struct {
+	Reason ledger.DeclineReason `json:"reason"`
+}
+
+func (DeclineDetails) ErrDetails() {}
+
+func declinedError(reason ledger.DeclineReason) error {
+	return &errs.Error{
+		Code:    errs.FailedPrecondition,
+		Message: fmt.Sprintf("authorization declined: %s", reason),
+		Details: DeclineDetails{Reason: reason},
+	}
+}
+
+// checkSpendControls returns why the controls of the account, and of the card if any, decline the authorization of
+// the amount in the account currency. The reason is empty when the authorization is allowed, its amount is then
+// reserved until the workflow records it. The checks of an account are serialised, so concurrent authorizations can't
+// both fit in what is left of a limit.
+func checkSpendControls(ctx context.Context, paymentDetails *workflow.PaymentDetails, now time.Time) (ledger.DeclineReason, error) {
+	scopes := []uuid.UUID{uuid.Nil}
+	if paymentDetails.CardID.Valid {
+		scopes = append(scopes, paymentDetails.CardID.UUID)
+	}
+
+	tx, err := db.TransferDB.Begin(ctx)
+	if err != nil {
+		return "", errs.Wrap(err, "error starting the transaction")
+	}
+	defer tx.Rollback()
+
+	err = db.LockSpend(ctx, paymentDetails.SourceAccount, tx)
+	if err != nil {
+		return "", err
+	}
+
+	for _, cardID := range scopes {
+		controls, err := db.GetSpendControls(ctx, paymentDetails.SourceAccount, cardID)
+		if errs.Code(err) == errs.NotFound {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+
+		reason, err := evaluateSpendControls(ctx, controls, paymentDetails, now, tx)
+		if err != nil || reason != "" {
+			return reason, err
+		}
+	}
+
+	err = db.ReserveSpend(ctx, paymentDetails.WorkflowID, paymentDetails.SourceAccount, paymentDetails.CardID, paymentDetails.Amount.Value, tx)
+	if err != nil {
+		return "", err
+	}
+
+	return "", tx.Commit()
+}
+
+func evaluateSpendControls(ctx context.Context, controls *db.SpendControls, paymentDetails *workflow.PaymentDetails, now time.Time, tx *sqldb.Tx) (ledger.DeclineReason, error) {
+	for _, mcc := range controls.BlockedMCCs {
+		if mcc == paymentDetails.MerchantCategoryCode {
+			return ledger.DeclineReasonBlockedMCC, nil
+		}
+	}
+
+	amount := paymentDetails.Amount.Value
+	if controls.MaxTransactionAmount != nil && amount > *controls.MaxTransactionAmount {
+		return ledger.DeclineReasonTransactionLimit, nil
+	}
+
+	// the card controls only count what was spent with the card
+	cardID := uuid.NullUUID{UUID: controls.CardID, Valid: controls.CardID != uuid.Nil}
+
+	now = now.UTC()
+	if controls.DailyLimit != nil {
+		spent, _, err := db.GetSpend(ctx, controls.AccountID, cardID, time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC), paymentDetails.WorkflowID, tx)
+		if err != nil {
+			return "", err
+		}
+		if spent+amount > *controls.DailyLimit {
+			return ledger.DeclineReasonDailyLimit, nil
+		}
+	}
+
+	if controls.MonthlyLimit != nil {
+		spent, _, err := db.GetSpend(ctx, controls.AccountID, cardID, time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC), paymentDetails.WorkflowID, tx)
+		if err != nil {
+			return "", err
+		}
+		if spent+amount > *controls.MonthlyLimit {
+			return ledger.DeclineReasonMonthlyLimit, nil
+		}
+	}
+
+	if controls.HourlyCount != nil {
+		_, count, err := db.GetSpend(ctx, controls.AccountID, cardID, now.Add(-time.Hour), paymentDetails.WorkflowID, tx)
+		if err != nil {
+			return "", err
+		}
+		if count >= *controls.HourlyCount {
+			return ledger.DeclineReasonVelocityLimit, nil
+		}
+	}
+
+	return "", nil
+}
+
+// checkAccount returns why the customer account declines the authorization: money can't leave it. The reason is
+// empty when the authorization is allowed, whether the balance is enough is left to the ledger placing the hold.
+func checkAccount(ctx context.Context, paymentDetails *workflow.PaymentDetails) (ledger.DeclineReason, error) {
+	status, err := db.GetAccountStatus(ctx, paymentDetails.SourceAccount)
+	if err != nil {
+		return "", errs.Wrap(err, "error getting account status")
+	}
+
+	return ledger.DeclineReasonForStatus(status), nil
+}
+
+// recordDecline records the authorization as declined, no hold is placed
+func recordDecline(paymentDetails *workflow.PaymentDetails, reason ledger.DeclineReason) error {
+	err := db.InsertNewTransferWithProgress(paymentDetails.DeclinedTransfer(reason))
+	if err != nil {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: errs.Wrap(err, "error recording declined authorization").Error(),
+		}
+	}
+	return nil
+}
+
+type SpendControls struct {
+	Account uint64 `json:"account"`
+	// CardID is set for the controls of a card of the account
+	CardID *uuid.UUID `json:"card_id,omitempty"`
+	// MaxTransactionAmount, DailyLimit and MonthlyLimit are in minor units of the account currency, nil for no limit
+	MaxTransactionAmount *uint64 `json:"max_transaction_amount,omitempty"`
+	DailyLimit           *uint64 `json:"daily_limit,omitempty"`
+	MonthlyLimit         *uint64 `json:"monthly_limit,omitempty"`
+	// HourlyCount is how many authorizations are allowed in an hour, nil for no limit
+	HourlyCount *int     `json:"hourly_count,omitempty"`
+	BlockedMCCs []string `json:"blocked_mccs"`
+}
+
+// SetSpendControls replaces the spend controls of an account or a card
+//
+//encore:api private method=POST
+func (s *Service) SetSpendControls(ctx context.Context, req *SpendControls) error {
+	if req.HourlyCount != nil && *req.HourlyCount < 0 {
+		return &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "hourly count must not be negative",
+		}
+	}
+
+	controls := &db.SpendControls{
+		AccountID:            req.Account,
+		MaxTransactionAmount: req.MaxTransactionAmount,
+		DailyLimit:           req.DailyLimit,
+		MonthlyLimit:         req.MonthlyLimit,
+		HourlyCount:          req.HourlyCount,
+		BlockedMCCs:          req.BlockedMCCs,
+	}
+	if req.CardID != nil {
+		controls.CardID = *req.CardID
+	}
+
+	err := db.UpsertSpendControls(ctx, controls)
+	if err != nil {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: errs.Wrap(err, "error saving spend controls").Error(),
+		}
+	}
+
+	return nil
+}
+
+type GetSpendControlsRequest struct {
+	Account uint64     `json:"account"`
+	CardID  *uuid.UUID `json:"card_id,omitempty"`
+}
+
+// GetSpendControls returns the spend controls of an account or a card, without limits when none were set
+//
+//encore:api private method=POST
+func (s *Service) GetSpendControls(ctx context.Context, req *GetSpendControlsRequest) (*SpendControls, error) {
+	cardID := uuid.Nil
+	if req.CardID != nil {
+		cardID = *req.CardID
+	}
+
+	resp := &SpendControls{Account: req.Account, CardID: req.CardID, BlockedMCCs: []string{}}
+
+	controls, err := db.GetSpendControls(ctx, req.Account, cardID)
+	if errs.Code(err) == errs.NotFound {
+		return resp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	resp.MaxTransactionAmount = controls.MaxTransactionAmount
+	resp.DailyLimit = controls.DailyLimit
+	resp.MonthlyLimit = controls.MonthlyLimit
+	resp.HourlyCount = controls.HourlyCount
+	if controls.BlockedMCCs != nil {
+		resp.BlockedMCCs = controls.BlockedMCCs
+	}
+	return resp, nil
+}
@@ -2,7 +2,10 @@ package db
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"encore.dev/beta/errs"
@@ -10,10 +13,14 @@ import (
 	"encore.dev/storage/sqldb"
 
 	"encore.dev/types/uuid"
+
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/ledger"
 )
 
 var (
 	TransferDB = sqldb.Named("transfer")
+	// AccountDB holds the account metadata, it's owned by the api service
+	AccountDB = sqldb.Named("api")
 )
 
 type TransferProgress string
@@ -22,10 +29,35 @@ const (
 	TransferProgressInitiated                  TransferProgress = "initiated"
 	TransferProgressInProcess                  TransferProgress = "in_process"
 	TransferProgressSettled                    TransferProgress = "settled"
+	TransferProgressReversed                   TransferProgress = "reversed"
 	TransferProgressFailedOnLedgerSettlement   TransferProgress = "failed_ledger_settlement"
 	TransferProgressFailedOnLedgerTimeout      TransferProgress = "failed_ledger_timeout"
 	TransferProgressFailedOnExternalDB         TransferProgress = "failed_external_db"
 	TransferProgressFailedOnLedgerCancellation TransferProgress = "failed_ledger_cancellation"
+	// TransferProgressDeclined authorizations were refused before any hold was placed
+	TransferProgressDeclined TransferProgress = "declined"
+	// TransferProgressExpired authorizations had their hold released by the timer, a late presentment can still match
+	// them for a grace window
+	TransferProgressExpired TransferProgress = "expired"
+	// TransferProgressUnmatchedForcePost presentments matched no authorization and were posted right away
+	TransferProgressUnmatchedForcePost TransferProgress = "unmatched_force_post"
+	// TransferProgressFailedForcePost presentments matched no authorization and the ledger refused to post them
+	TransferProgressFailedForcePost TransferProgress = "failed_force_post"
+	// TransferProgressFlaggedOverPresentment over-presentments exceeded the tolerance, they were posted and flagged for review
+	TransferProgressFlaggedOverPresentment TransferProgress = "flagged_over_presentment"
+)
+
+// TransferKind tells what kind of transaction a transfer row records
+type TransferKind string
+
+const (
+	TransferKindAuthorization TransferKind = "authorization"
+	TransferKindRefund        TransferKind = "refund"
+	// TransferKindPresentment rows are presentments booked without an authorization
+	TransferKindPresentment TransferKind = "presentment"
+	// TransferKindOverPresentment rows are what a presentment settled above its authorization, linked to it by
+	// original_transfer_id
+	TransferKindOverPresentment TransferKind = "over_presentment"
 )
 
 type TransferResponse struct {
@@ -33,42 +65,93 @@ type TransferResponse struct {
 	DebitAccountID   uint64    `sql:"debit_account_id"`
 	CreditAccountID  uint64    `sql:"credit_account_id"`
 	Amount           uint64    `sql:"amount"`
+	SettledAmount    uint64    `sql:"settled_amount"`
+	ReversedAmount   uint64    `sql:"reversed_amount"`
 	CreatedAt        time.Time `sql:"created_at"`
 	TransferProgress string    `sql:"transfer_progress"`
+	Kind             string    `sql:"kind"`
+	// OriginalTransferID links a refund to the transaction it refunds
+	OriginalTransferID   uuid.NullUUID `sql:"original_transfer_id"`
+	MerchantCategoryCode string        `sql:"merchant_category_code"`
+	// ExpiresAt is when the authorization hold is released if not presented
+	ExpiresAt *time.Time `sql:"expires_at"`
+	// PresentmentID is the presentment matched with the authorization
+	PresentmentID uuid.NullUUID `sql:"presentment_id"`
+	// MerchantCurrency is set when the transaction is in another currency than the customer account,
+	// MerchantAmount is then the amount in minor units of the merchant currency
+	MerchantCurrency string `sql:"merchant_currency"`
+	MerchantAmount   uint64 `sql:"merchant_amount"`
+	// FXRate converts the merchant currency to the account currency at authorization,
+	// SettlementFXRate at presentment
+	FXRate           *string `sql:"fx_rate"`
+	SettlementFXRate *string `sql:"settlement_fx_rate"`
+	// CardID is the card the transaction was made with
+	CardID uuid.NullUUID `sql:"card_id"`
+	// DeclineReason is why a declined authorization was refused
+	DeclineReason string `sql:"decline_reason"`
+	References    NetworkReferences
+	// MatchRule is the rule that matched the presentment with the authorization
+	MatchRule string `sql:"match_rule"`
+	// OverdrawnAmount is what the collections account covered of a force-posted presentment
+	OverdrawnAmount uint64 `sql:"overdrawn_amount"`
+	// OverPresentment is how much a presentment may exceed the authorized amount
+	OverPresentment OverPresentmentTolerance
+	// ClearedAmount and ClearedMerchantAmount are what the presentments cleared so far of an authorization in the
+	// account or the merchant currency, the rest is still held
+	ClearedAmount         uint64 `sql:"cleared_amount"`
+	ClearedMerchantAmount uint64 `sql:"cleared_merchant_amount"`
 }
 
-func GetTransaction(ctx context.Context, customerAccount uint64, amount uint64, progress TransferProgress, forUpdate bool, tx *sqldb.Tx) (*TransferResponse, error) {
-	var transfer TransferResponse
-	query := `
-		SELECT id, debit_account_id, credit_account_id, amount, created_at, transfer_progress FROM transfers
-		WHERE debit_account_id = $1 AND amount = $2 AND transfer_progress = $3
-		ORDER BY created_at ASC
-		LIMIT 1`
-
-	if forUpdate {
-		query += " FOR UPDATE"
+// HeldAmount returns what is still held of the authorization, in the currency of its presentments
+func (t *TransferResponse) HeldAmount() uint64 {
+	if t.MerchantCurrency != "" {
+		return t.MerchantAmount - t.ClearedMerchantAmount
 	}
+	return t.Amount - t.ClearedAmount
+}
 
-	var err error
-	if tx != nil {
-		err = tx.QueryRow(ctx, query, customerAccount, amount, progress).
-			Scan(&transfer.ID, &transfer.DebitAccountID, &transfer.CreditAccountID, &transfer.Amount, &transfer.CreatedAt, &transfer.TransferProgress)
-	} else {
-		err = TransferDB.QueryRow(ctx, query, customerAccount, amount, progress).
-			Scan(&transfer.ID, &transfer.DebitAccountID, &transfer.CreditAccountID, &transfer.Amount, &transfer.CreatedAt, &transfer.TransferProgress)
-	}
+// OverPresentmentTolerance is how much a presentment may exceed the authorized amount: the larger of the percentage of
+// the authorized amount and the absolute amount, in minor units of the authorization currency
+type OverPresentmentTolerance struct {
+	Percent uint64 `sql:"over_presentment_percent"`
+	Amount  uint64 `sql:"over_presentment_amount"`
+}
 
-	switch {
-	case errors.Is(err, sqldb.ErrNoRows):
-		return nil, &errs.Error{
-			Code:    errs.NotFound,
-			Message: "no transfer found for given authorization",
-		}
-	case err != nil:
-		return nil, err
+// Limit returns the largest amount a presentment of the authorized amount may settle
+func (t OverPresentmentTolerance) Limit(authorized uint64) uint64 {
+	over := authorized * t.Percent / 100
+	if t.Amount > over {
+		over = t.Amount
 	}
+	return authorized + over
+}
 
-	return &transfer, err
+// NetworkReferences identify a card transaction across the card network, any of them may be empty. The auth code is
+// generated when the authorization is approved, the others come from the network.
+type NetworkReferences struct {
+	NetworkTransactionID string `sql:"network_transaction_id"`
+	AuthCode             string `sql:"auth_code"`
+	MerchantID           string `sql:"merchant_id"`
+	AcquirerReference    string `sql:"acquirer_reference"`
+}
+
+const transferColumns = `id, debit_account_id, credit_account_id, amount, settled_amount, reversed_amount, created_at, transfer_progress, kind, original_transfer_id,
+	merchant_category_code, expires_at, presentment_id, merchant_currency, merchant_amount, fx_rate, settlement_fx_rate, card_id, decline_reason,
+	network_transaction_id, auth_code, merchant_id, acquirer_reference, match_rule, overdrawn_amount,
+	over_presentment_percent, over_presentment_amount, cleared_amount, cleared_merchant_amount`
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTransfer(row scanner, transfer *TransferResponse) error {
+	return row.Scan(&transfer.ID, &transfer.DebitAccountID, &transfer.CreditAccountID, &transfer.Amount, &transfer.SettledAmount,
+		&transfer.ReversedAmount, &transfer.CreatedAt, &transfer.TransferProgress, &transfer.Kind, &transfer.OriginalTransferID,
+		&transfer.MerchantCategoryCode, &transfer.ExpiresAt, &transfer.PresentmentID, &transfer.MerchantCurrency, &transfer.MerchantAmount,
+		&transfer.FXRate, &transfer.SettlementFXRate, &transfer.CardID, &transfer.DeclineReason,
+		&transfer.References.NetworkTransactionID, &transfer.References.AuthCode, &transfer.References.MerchantID,
+		&transfer.References.AcquirerReference, &transfer.MatchRule, &transfer.OverdrawnAmount,
+		&transfer.OverPresentment.Percent, &transfer.OverPresentment.Amount, &transfer.ClearedAmount, &transfer.ClearedMerchantAmount)
 }
 
 type TransferReq struct {
@@ -77,6 +160,20 @@ type TransferReq struct {
 	CreditAccountID uint64
 	Amount          uint64
 	Progress        TransferProgress
+	// Kind defaults to an authorization
+	Kind                 TransferKind
+	OriginalTransferID   uuid.NullUUID
+	MerchantCategoryCode string
+	ExpiresAt            *time.Time
+	// MerchantCurrency, MerchantAmount and FXRate are set for transfers in another currency than the customer account
+	MerchantCurrency string
+	MerchantAmount   uint64
+	FXRate           *string
+	CardID           uuid.NullUUID
+	DeclineReason    string
+	References       NetworkReferences
+	OverdrawnAmount  uint64
+	OverPresentment  OverPresentmentTolerance
 }
 
 // InsertNewTransfer inserts a transfer into the database idempotently on id
@@ -84,9 +181,12 @@ func InsertNewTransfer(req *TransferReq) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 	_, err := TransferDB.Exec(ctx, `
-		INSERT INTO transfers (id, debit_account_id, credit_account_id, amount)
-		    VALUES ($1, $2, $3, $4)
-		    ON CONFLICT (id) DO NOTHING`, req.ID, req.DebitAccountID, req.CreditAccountID, req.Amount)
+		INSERT INTO transfers (id, debit_account_id, credit_account_id, amount, merchant_category_code, expires_at, merchant_currency, merchant_amount, fx_rate, card_id,
+		    network_transaction_id, auth_code, merchant_id, acquirer_reference, over_presentment_percent, over_presentment_amount)
+		    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+		    ON CONFLICT (id) DO NOTHING`, req.ID, req.DebitAccountID, req.CreditAccountID, req.Amount, req.MerchantCategoryCode, req.ExpiresAt,
+		req.MerchantCurrency, req.MerchantAmount, req.FXRate, req.CardID, req.References.NetworkTransactionID, req.References.AuthCode,
+		req.References.MerchantID, req.References.AcquirerReference, req.OverPresentment.Percent, req.OverPresentment.Amount)
 	return err
 }
 
@@ -94,10 +194,21 @@ func InsertNewTransfer(req *TransferReq) error {
 func InsertNewTransferWithProgress(req *TransferReq) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
+
+	kind := req.Kind
+	if kind == "" {
+		kind = TransferKindAuthorization
+	}
+
 	_, err := TransferDB.Exec(ctx, `
-		INSERT INTO transfers (id, debit_account_id, credit_account_id, amount, transfer_progress)
-		    VALUES ($1, $2, $3, $4, $5)
-		    ON CONFLICT (id) DO NOTHING`, req.ID, req.DebitAccountID, req.CreditAccountID, req.Amount, req.Progress)
+		INSERT INTO transfers (id, debit_account_id, credit_account_id, amount, transfer_progress, kind, original_transfer_id, merchant_category_code, expires_at,
+		    card_id, merchant_currency, merchant_amount, fx_rate, decline_reason, network_transaction_id, auth_code, merchant_id, acquirer_reference,
+		    overdrawn_amount)
+		    VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19)
+		    ON CONFLICT (id) DO NOTHING`, req.ID, req.DebitAccountID, req.CreditAccountID, req.Amount, req.Progress, kind, req.OriginalTransferID,
+		req.MerchantCategoryCode, req.ExpiresAt, req.CardID, req.MerchantCurrency, req.MerchantAmount, req.FXRate, req.DeclineReason,
+		req.References.NetworkTransactionID, req.References.AuthCode, req.References.MerchantID, req.References.AcquirerReference,
+		req.OverdrawnAmount)
 	return err
 }
 
@@ -115,3 +226,461 @@ func UpdateTransferProgress(id uuid.UUID, progress TransferProgress, tx *sqldb.T
 
 	return err
 }
+
+// UpdateSettledAmount records the amount posted on settlement of the transfer
+func UpdateSettledAmount(id uuid.UUID, amount uint64) error {
+	dbCtx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	_, err := TransferDB.Exec(dbCtx, `
+		update transfers set settled_amount = $1 WHERE id = $2`, amount, id)
+	return err
+}
+
+// AddClearedAmount adds what a presentment clears of the authorization, in the account or the merchant currency
+func AddClearedAmount(id uuid.UUID, amount uint64, merchantAmount uint64, tx *sqldb.Tx) error {
+	dbCtx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	_, err := tx.Exec(dbCtx, `
+		update transfers set cleared_amount = cleared_amount + $1, cleared_merchant_amount = cleared_merchant_amount + $2
+		WHERE id = $3`, amount, merchantAmount, id)
+	return err
+}
+
+// UpdateOverdrawnAmount records what the collections account covered of the presentment of the transfer
+func UpdateOverdrawnAmount(id uuid.UUID, amount uint64) error {
+	dbCtx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	_, err := TransferDB.Exec(dbCtx, `
+		update transfers set overdrawn_amount = $1 WHERE id = $2`, amount, id)
+	return err
+}
+
+// UpdateSettlementFXRate records the rate the presentment of a transfer in a merchant currency was converted at
+func UpdateSettlementFXRate(id uuid.UUID, rate string) error {
+	dbCtx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	_, err := TransferDB.Exec(dbCtx, `
+		update transfers set settlement_fx_rate = $1 WHERE id = $2`, rate, id)
+	return err
+}
+
+// UpdateReversedAmount records the amount left on the authorization after a reversal, in the account and the merchant
+// currency, and the total amount reversed
+func UpdateReversedAmount(id uuid.UUID, amount uint64, merchantAmount uint64, reversedAmount uint64) error {
+	dbCtx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	_, err := TransferDB.Exec(dbCtx, `
+		update transfers set amount = $1, merchant_amount = $2, reversed_amount = $3 WHERE id = $4`, amount, merchantAmount, reversedAmount, id)
+	return err
+}
+
+// GetTransferByID returns the transfer with given id
+func GetTransferByID(ctx context.Context, id uuid.UUID) (*TransferResponse, error) {
+	var transfer TransferResponse
+	err := scanTransfer(TransferDB.QueryRow(ctx, `
+		SELECT `+transferColumns+` FROM transfers
+		WHERE id = $1`, id), &transfer)
+
+	switch {
+	case errors.Is(err, sqldb.ErrNoRows):
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "transfer not found",
+		}
+	case err != nil:
+		return nil, err
+	}
+
+	return &transfer, nil
+}
+
+type IncrementReq struct {
+	ID              uuid.UUID
+	AuthorizationID uuid.UUID
+	Amount          uint64
+	// MerchantAmount is the increment in the merchant currency of an authorization in a foreign currency
+	MerchantAmount uint64
+}
+
+// InsertAuthorizationIncrement records an incremental hold idempotently on id
+// and adds its amount to the authorization transfer, so the authorization stays a single row
+func InsertAuthorizationIncrement(req *IncrementReq) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	tx, err := TransferDB.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(ctx, `
+		INSERT INTO authorization_increments (id, authorization_id, amount, merchant_amount)
+		    VALUES ($1, $2, $3, $4)
+		    ON CONFLICT (id) DO NOTHING`, req.ID, req.AuthorizationID, req.Amount, req.MerchantAmount)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if res.RowsAffected() > 0 {
+		_, err = tx.Exec(ctx, `
+			update transfers set amount = amount + $1, merchant_amount = merchant_amount + $2 WHERE id = $3`, req.Amount, req.MerchantAmount, req.AuthorizationID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// LockTransfer returns the transfer and locks its row until the transaction ends
+func LockTransfer(ctx context.Context, id uuid.UUID, tx *sqldb.Tx) (*TransferResponse, error) {
+	var transfer TransferResponse
+	err := scanTransfer(tx.QueryRow(ctx, `
+		SELECT `+transferColumns+` FROM transfers
+		WHERE id = $1 FOR UPDATE`, id), &transfer)
+
+	switch {
+	case errors.Is(err, sqldb.ErrNoRows):
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "transfer not found",
+		}
+	case err != nil:
+		return nil, err
+	}
+
+	return &transfer, nil
+}
+
+// GetRefundedAmount returns the total amount refunded against the original transfer, the refunds in progress
+// included, but the refund with the given id
+func GetRefundedAmount(ctx context.Context, originalTransferID uuid.UUID, refundID uuid.UUID, tx *sqldb.Tx) (uint64, error) {
+	var amount uint64
+	err := tx.QueryRow(ctx, `
+		SELECT COALESCE(SUM(amount), 0) FROM transfers
+		WHERE original_transfer_id = $1 AND kind = 'refund' AND id <> $2 AND transfer_progress IN ($3, $4)`,
+		originalTransferID, refundID, TransferProgressInitiated, TransferProgressSettled).Scan(&amount)
+	return amount, err
+}
+
+// ReserveRefund records the refund in progress so later refunds of the original transfer count it. A retry of a refund
+// released on failure reserves it again.
+func ReserveRefund(ctx context.Context, req *TransferReq, tx *sqldb.Tx) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO transfers (id, debit_account_id, credit_account_id, amount, transfer_progress, kind, original_transfer_id)
+		    VALUES ($1, $2, $3, $4, $5, $6, $7)
+		    ON CONFLICT (id) DO UPDATE SET transfer_progress = EXCLUDED.transfer_progress
+		    WHERE transfers.transfer_progress = $8`, req.ID, req.DebitAccountID, req.CreditAccountID, req.Amount,
+		TransferProgressInitiated, TransferKindRefund, req.OriginalTransferID, TransferProgressFailedOnLedgerSettlement)
+	return err
+}
+
+// UpdatePresentmentMatch records the presentment matched with the authorization, if any, and the rule that matched it
+func UpdatePresentmentMatch(id uuid.UUID, presentmentID uuid.NullUUID, rule MatchRule, tx *sqldb.Tx) error {
+	dbCtx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	_, err := tx.Exec(dbCtx, `
+		update transfers set presentment_id = coalesce($1, presentment_id), match_rule = $2 WHERE id = $3`, presentmentID, rule, id)
+	return err
+}
+
+type Direction string
+
+const (
+	DirectionDebit  Direction = "debit"
+	DirectionCredit Direction = "credit"
+)
+
+type ListTransfersReq struct {
+	Account uint64
+	// optional filters
+	Progress      TransferProgress
+	DeclineReason string
+	Direction     Direction
+	From          time.Time
+	To            time.Time
+	// Cursor is the next cursor of the previous page
+	Cursor string
+	Limit  int
+}
+
+// ListTransfers returns the transfers of the account, newest first, and the cursor of the next page.
+// The cursor is empty on the last page.
+func ListTransfers(ctx context.Context, req *ListTransfersReq) ([]TransferResponse, string, error) {
+	args := []interface{}{req.Account}
+	var conditions []string
+
+	switch req.Direction {
+	case DirectionDebit:
+		conditions = append(conditions, "debit_account_id = $1")
+	case DirectionCredit:
+		conditions = append(conditions, "credit_account_id = $1")
+	default:
+		conditions = append(conditions, "(debit_account_id = $1 OR credit_account_id = $1)")
+	}
+
+	if req.Progress != "" {
+		args = append(args, req.Progress)
+		conditions = append(conditions, fmt.Sprintf("transfer_progress = $%d", len(args)))
+	}
+	if req.DeclineReason != "" {
+		args = append(args, req.DeclineReason)
+		conditions = append(conditions, fmt.Sprintf("decline_reason = $%d", len(args)))
+	}
+	if !req.From.IsZero() {
+		args = append(args, req.From)
+		conditions = append(conditions, fmt.Sprintf("created_at >= $%d", len(args)))
+	}
+	if !req.To.IsZero() {
+		args = append(args, req.To)
+		conditions = append(conditions, fmt.Sprintf("created_at < $%d", len(args)))
+	}
+	if req.Cursor != "" {
+		createdAt, id, err := decodeCursor(req.Cursor)
+		if err != nil {
+			return nil, "", &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "invalid cursor",
+			}
+		}
+		args = append(args, createdAt, id)
+		conditions = append(conditions, fmt.Sprintf("(created_at, id) < ($%d, $%d)", len(args)-1, len(args)))
+	}
+
+	// fetch one more row to know if there is a next page
+	args = append(args, req.Limit+1)
+	query := `
+		SELECT ` + transferColumns + ` FROM transfers
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY created_at DESC, id DESC
+		LIMIT $` + fmt.Sprint(len(args))
+
+	rows, err := TransferDB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rows.Close()
+
+	var transfers []TransferResponse
+	for rows.Next() {
+		var transfer TransferResponse
+		err = scanTransfer(rows, &transfer)
+		if err != nil {
+			return nil, "", err
+		}
+		transfers = append(transfers, transfer)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	var next string
+	if len(transfers) > req.Limit {
+		transfers = transfers[:req.Limit]
+		last := transfers[len(transfers)-1]
+		next = encodeCursor(last.CreatedAt, last.ID)
+	}
+
+	return transfers, next, nil
+}
+
+func encodeCursor(createdAt time.Time, id uuid.UUID) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(createdAt.Format(time.RFC3339Nano) + "," + id.String()))
+}
+
+func decodeCursor(cursor string) (time.Time, uuid.UUID, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, uuid.Nil, err
+	}
+
+	parts := strings.SplitN(string(raw), ",", 2)
+	if len(parts) != 2 {
+		return time.Time{}, uuid.Nil, errors.New("malformed cursor")
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, uuid.Nil, err
+	}
+
+	id, err := uuid.FromString(parts[1])
+	if err != nil {
+		return time.Time{}, uuid.Nil, err
+	}
+
+	return createdAt, id, nil
+}
+
+type LedgerTransferReq struct {
+	ID         uuid.UUID
+	TransferID uuid.UUID
+	// PendingID is the pending transfer a post or void transfer resolves
+	PendingID uuid.NullUUID
+}
+
+// InsertLedgerTransfer records a ledger transfer booked for the transfer idempotently on id
+func InsertLedgerTransfer(req *LedgerTransferReq) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	_, err := TransferDB.Exec(ctx, `
+		INSERT INTO ledger_transfers (id, transfer_id, pending_id)
+		    VALUES ($1, $2, $3)
+		    ON CONFLICT (id) DO NOTHING`, req.ID, req.TransferID, req.PendingID)
+	return err
+}
+
+// GetLedgerTransferIDs returns the ids of the ledger transfers booked for the transfer, in booking order
+func GetLedgerTransferIDs(ctx context.Context, transferID uuid.UUID) ([]uuid.UUID, error) {
+	rows, err := TransferDB.Query(ctx, `
+		SELECT id FROM ledger_transfers
+		WHERE transfer_id = $1
+		ORDER BY created_at ASC`, transferID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []uuid.UUID
+	for rows.Next() {
+		var id uuid.UUID
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// GetAccountStatus returns the status of the account, accounts without metadata are active. The row is share locked
+// for the read, so a status change in progress, like a closure, is waited for.
+func GetAccountStatus(ctx context.Context, account uint64) (ledger.AccountStatus, error) {
+	tx, err := AccountDB.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var status ledger.AccountStatus
+	err = tx.QueryRow(ctx, `
+		SELECT status FROM accounts
+		WHERE id = $1
+		FOR SHARE`, account).Scan(&status)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return ledger.AccountStatusActive, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return status, tx.Commit()
+}
+
+// SpendControls limit the authorizations of an account, or of one of its cards. Amounts are in minor units of the
+// account currency, nil limits don't apply.
+type SpendControls struct {
+	AccountID uint64 `sql:"account_id"`
+	// CardID is nil for the controls of the account
+	CardID               uuid.UUID `sql:"card_id"`
+	MaxTransactionAmount *uint64   `sql:"max_transaction_amount"`
+	DailyLimit           *uint64   `sql:"daily_limit"`
+	MonthlyLimit         *uint64   `sql:"monthly_limit"`
+	// HourlyCount is how many authorizations are allowed in an hour
+	HourlyCount *int `sql:"hourly_count"`
+	// BlockedMCCs are the merchant categories declined right away
+	BlockedMCCs []string  `sql:"blocked_mccs"`
+	UpdatedAt   time.Time `sql:"updated_at"`
+}
+
+// UpsertSpendControls replaces the spend controls of the account or the card
+func UpsertSpendControls(ctx context.Context, controls *SpendControls) error {
+	blocked := controls.BlockedMCCs
+	if blocked == nil {
+		blocked = []string{}
+	}
+
+	_, err := TransferDB.Exec(ctx, `
+		INSERT INTO spend_controls (account_id, card_id, max_transaction_amount, daily_limit, monthly_limit, hourly_count, blocked_mccs)
+		    VALUES ($1, $2, $3, $4, $5, $6, $7)
+		    ON CONFLICT (account_id, card_id) DO UPDATE
+		    SET max_transaction_amount = $3, daily_limit = $4, monthly_limit = $5, hourly_count = $6, blocked_mccs = $7, updated_at = now()`,
+		controls.AccountID, controls.CardID, controls.MaxTransactionAmount, controls.DailyLimit, controls.MonthlyLimit, controls.HourlyCount, blocked)
+	return err
+}
+
+// GetSpendControls returns the spend controls of the account, or of the card when not nil. NotFound when there are none.
+func GetSpendControls(ctx context.Context, account uint64, cardID uuid.UUID) (*SpendControls, error) {
+	var controls SpendControls
+	err := TransferDB.QueryRow(ctx, `
+		SELECT account_id, card_id, max_transaction_amount, daily_limit, monthly_limit, hourly_count, blocked_mccs, updated_at
+		FROM spend_controls
+		WHERE account_id = $1 AND card_id = $2`, account, cardID).Scan(&controls.AccountID, &controls.CardID, &controls.MaxTransactionAmount,
+		&controls.DailyLimit, &controls.MonthlyLimit, &controls.HourlyCount, &controls.BlockedMCCs, &controls.UpdatedAt)
+	if errors.Is(err, sqldb.ErrNoRows) {
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "no spend controls",
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &controls, nil
+}
+
+// LockSpend serialises the spend control checks of the account until the transaction ends
+func LockSpend(ctx context.Context, account uint64, tx *sqldb.Tx) error {
+	_, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, int64(account))
+	return err
+}
+
+// GetSpend returns the amount and the number of the authorizations of the account since the time, only those made with
+// the card when it's set. Settled authorizations count for their settled amount, declined, reversed and failed ones
+// don't count. The reservations of authorizations not recorded yet count too, but the one with the given id.
+func GetSpend(ctx context.Context, account uint64, cardID uuid.NullUUID, since time.Time, id uuid.UUID, tx *sqldb.Tx) (uint64, int, error) {
+	var amount uint64
+	var count int
+	err := tx.QueryRow(ctx, `
+		SELECT COALESCE(SUM(amount), 0), COUNT(*) FROM (
+		    SELECT CASE WHEN transfer_progress = $4 THEN settled_amount ELSE amount END AS amount
+		    FROM transfers
+		    WHERE debit_account_id = $1 AND kind = 'authorization' AND created_at >= $2 AND ($3::uuid IS NULL OR card_id = $3)
+		        AND transfer_progress IN ($4, $5, $6)
+		    UNION ALL
+		    SELECT r.amount FROM spend_reservations r
+		    WHERE r.account_id = $1 AND r.created_at >= $2 AND ($3::uuid IS NULL OR r.card_id = $3) AND r.id <> $7
+		        AND NOT EXISTS (SELECT 1 FROM transfers t WHERE t.id = r.id)
+		) spend`, account, since, cardID,
+		TransferProgressSettled, TransferProgressInitiated, TransferProgressInProcess, id).Scan(&amount, &count)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return amount, count, nil
+}
+
+// ReserveSpend holds the amount of the authorization against the spend controls until it's recorded in transfers
+func ReserveSpend(ctx context.Context, id uuid.UUID, account uint64, cardID uuid.NullUUID, amount uint64, tx *sqldb.Tx) error {
+	_, err := tx.Exec(ctx, `
+		INSERT INTO spend_reservations (id, account_id, card_id, amount)
+		    VALUES ($1, $2, $3, $4)
+		    ON CONFLICT (id) DO NOTHING`, id, account, cardID, amount)
+	return err
+}
+
+// ReleaseSpend drops the reservation of an authorization whose workflow didn't start or failed
+func ReleaseSpend(ctx context.Context, id uuid.UUID) error {
+	_, err := TransferDB.Exec(ctx, `DELETE FROM spend_reservations WHERE id = $1`, id)
+	return err
+}
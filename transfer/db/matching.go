@@ -0,0 +1,117 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/storage/sqldb"
+	"encore.dev/types/uuid"
+)
+
+// MatchRule is the rule that matched a presentment with an authorization
+type MatchRule string
+
+const (
+	// MatchRuleReference matched the network transaction id, the auth code or the acquirer reference
+	MatchRuleReference MatchRule = "reference"
+	// MatchRuleMerchantAmount matched the merchant and the exact amount
+	MatchRuleMerchantAmount MatchRule = "merchant_amount"
+	// MatchRuleFuzzy matched an amount close enough within the time window
+	MatchRuleFuzzy MatchRule = "fuzzy"
+)
+
+// MatchReq describes a presentment to match with an open authorization of the customer account
+type MatchReq struct {
+	Account uint64
+	// Amount is in the merchant currency when it's set, in the account currency otherwise
+	Amount           uint64
+	MerchantCurrency string
+	// CardID restricts the match to the authorizations made with the card
+	CardID     uuid.NullUUID
+	References NetworkReferences
+	Progress   TransferProgress
+	// FuzzyMaxAmount and FuzzySince bound the authorizations the fuzzy rule matches
+	FuzzyMaxAmount uint64
+	FuzzySince     time.Time
+	// ExpiresAfter only matches the authorizations expiring after it when set, to bound the expired ones
+	ExpiresAfter *time.Time
+	// ForUpdate locks the matched authorization
+	ForUpdate bool
+}
+
+// amountColumn is the amount still held of the authorization in the currency of the presentment, see HeldAmount
+const amountColumn = `(CASE WHEN merchant_currency = '' THEN amount - cleared_amount ELSE merchant_amount - cleared_merchant_amount END)`
+
+// limitColumn is the largest amount a presentment of the authorization may settle, see OverPresentmentTolerance
+const limitColumn = `(` + amountColumn + ` + GREATEST(` + amountColumn + ` * over_presentment_percent / 100, over_presentment_amount))`
+
+// MatchAuthorization returns the authorization of the presentment and the rule that matched it. The rules are tried
+// in order: a network reference whatever the amount, an auth code being short only within the merchant and the
+// over-presentment tolerance, then the merchant with the exact amount, then the closest amount
+// within the fuzzy bounds, covering the presentment or short of it within the over-presentment tolerance. An
+// authorization of another merchant never matches fuzzily.
+func MatchAuthorization(ctx context.Context, req *MatchReq, tx *sqldb.Tx) (*TransferResponse, MatchRule, error) {
+	refs := req.References
+	if refs.NetworkTransactionID != "" || refs.AuthCode != "" || refs.AcquirerReference != "" {
+		transfer, err := matchAuthorization(ctx, req, tx, `
+		    AND ((network_transaction_id <> '' AND network_transaction_id = $6)
+		        OR (auth_code <> '' AND auth_code = $7 AND (merchant_id = '' OR $9 = '' OR merchant_id = $9) AND `+limitColumn+` >= $10)
+		        OR (acquirer_reference <> '' AND acquirer_reference = $8))
+		ORDER BY created_at ASC`, refs.NetworkTransactionID, refs.AuthCode, refs.AcquirerReference, refs.MerchantID, req.Amount)
+		if errs.Code(err) != errs.NotFound {
+			return transfer, MatchRuleReference, err
+		}
+	}
+
+	if refs.MerchantID != "" {
+		transfer, err := matchAuthorization(ctx, req, tx, `
+		    AND merchant_id = $6 AND `+amountColumn+` = $7
+		ORDER BY created_at ASC`, refs.MerchantID, req.Amount)
+		if errs.Code(err) != errs.NotFound {
+			return transfer, MatchRuleMerchantAmount, err
+		}
+	}
+
+	transfer, err := matchAuthorization(ctx, req, tx, `
+	    AND `+limitColumn+` >= $6 AND `+amountColumn+` <= $7 AND created_at >= $8
+	    AND (merchant_id = '' OR $9 = '' OR merchant_id = $9)
+	ORDER BY `+amountColumn+` < $6, ABS(`+amountColumn+` - $6), created_at ASC`, req.Amount, req.FuzzyMaxAmount, req.FuzzySince, refs.MerchantID)
+	return transfer, MatchRuleFuzzy, err
+}
+
+// matchAuthorization returns the first open authorization of the presentment account with the conditions, their
+// arguments start at $6. Only the arguments the conditions use are bound, Postgres can't type the others.
+func matchAuthorization(ctx context.Context, req *MatchReq, tx *sqldb.Tx, conditions string, args ...interface{}) (*TransferResponse, error) {
+	query := `
+		SELECT ` + transferColumns + ` FROM transfers
+		WHERE debit_account_id = $1 AND merchant_currency = $2 AND transfer_progress = $3 AND kind = 'authorization'
+		    AND ($4::uuid IS NULL OR card_id = $4) AND ($5::timestamptz IS NULL OR expires_at >= $5)` + conditions + `
+		LIMIT 1`
+	if req.ForUpdate {
+		query += " FOR UPDATE"
+	}
+
+	args = append([]interface{}{req.Account, req.MerchantCurrency, req.Progress, req.CardID, req.ExpiresAfter}, args...)
+
+	var transfer TransferResponse
+	var err error
+	if tx != nil {
+		err = scanTransfer(tx.QueryRow(ctx, query, args...), &transfer)
+	} else {
+		err = scanTransfer(TransferDB.QueryRow(ctx, query, args...), &transfer)
+	}
+
+	switch {
+	case errors.Is(err, sqldb.ErrNoRows):
+		return nil, &errs.Error{
+			Code:    errs.NotFound,
+			Message: "no transfer found for given authorization",
+		}
+	case err != nil:
+		return nil, err
+	}
+
+	return &transfer, nil
+}
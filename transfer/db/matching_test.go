@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"encore.dev/beta/errs"
+	"encore.dev/types/uuid"
+)
+
+// insertAuthorization records an open authorization of the account, held for the amount
+func insertAuthorization(t *testing.T, account uint64, amount uint64, refs NetworkReferences) uuid.UUID {
+	t.Helper()
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = InsertNewTransfer(&TransferReq{
+		ID:              id,
+		DebitAccountID:  account,
+		CreditAccountID: 2,
+		Amount:          amount,
+		References:      refs,
+		OverPresentment: OverPresentmentTolerance{Percent: 20},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// TestMatchAuthorization runs every rule against the database, each query must bind only the arguments it uses
+func TestMatchAuthorization(t *testing.T) {
+	ctx := context.Background()
+	account := uint64(rand.Int31n(1<<30)) + 1000
+
+	byTransaction := insertAuthorization(t, account, 1000, NetworkReferences{NetworkTransactionID: "txn-1", AuthCode: "A1B2C3", MerchantID: "merchant-0"})
+	byAcquirer := insertAuthorization(t, account, 2000, NetworkReferences{AcquirerReference: "arn-1"})
+	byMerchant := insertAuthorization(t, account, 3000, NetworkReferences{MerchantID: "merchant-1"})
+	fuzzy := insertAuthorization(t, account, 5000, NetworkReferences{})
+
+	tests := []struct {
+		name     string
+		amount   uint64
+		refs     NetworkReferences
+		want     uuid.UUID
+		wantRule MatchRule
+	}{
+		{"network transaction id", 1, NetworkReferences{NetworkTransactionID: "txn-1"}, byTransaction, MatchRuleReference},
+		{"auth code", 1000, NetworkReferences{AuthCode: "A1B2C3"}, byTransaction, MatchRuleReference},
+		{"auth code beyond the tolerance", 4900, NetworkReferences{AuthCode: "A1B2C3"}, fuzzy, MatchRuleFuzzy},
+		{"auth code of another merchant", 1000, NetworkReferences{AuthCode: "A1B2C3", MerchantID: "merchant-2"}, byAcquirer, MatchRuleFuzzy},
+		{"acquirer reference", 1, NetworkReferences{AcquirerReference: "arn-1"}, byAcquirer, MatchRuleReference},
+		{"unknown reference falls through", 3000, NetworkReferences{NetworkTransactionID: "txn-2", MerchantID: "merchant-1"}, byMerchant, MatchRuleMerchantAmount},
+		{"merchant and amount", 3000, NetworkReferences{MerchantID: "merchant-1"}, byMerchant, MatchRuleMerchantAmount},
+		{"fuzzy", 4900, NetworkReferences{}, fuzzy, MatchRuleFuzzy},
+		{"fuzzy within the tolerance", 5900, NetworkReferences{}, fuzzy, MatchRuleFuzzy},
+		{"none", 9000, NetworkReferences{}, uuid.Nil, MatchRuleFuzzy},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx, err := TransferDB.Begin(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+
+			got, rule, err := MatchAuthorization(ctx, &MatchReq{
+				Account:        account,
+				Amount:         tt.amount,
+				References:     tt.refs,
+				Progress:       TransferProgressInitiated,
+				FuzzyMaxAmount: tt.amount * 2,
+				FuzzySince:     time.Now().Add(-time.Hour),
+				ForUpdate:      true,
+			}, tx)
+
+			if tt.want == uuid.Nil {
+				var e *errs.Error
+				if !errors.As(err, &e) || e.Code != errs.NotFound {
+					t.Fatalf("got %v, %v, want not found", got, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != tt.want || rule != tt.wantRule {
+				t.Errorf("matched %s by %s, want %s by %s", got.ID, rule, tt.want, tt.wantRule)
+			}
+		})
+	}
+}
@@ -1,15 +1,49 @@
 package transfer
 
+import (
+	"encore.dev/types/uuid"
+
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/money"
+)
+
 type TransactionType string
 
 const (
-	TransactionTypeCreditCardAuth    TransactionType = "credit_card_authorization"
-	TransactionTypeCreditCardPresent TransactionType = "credit_card_presentment"
+	TransactionTypeCreditCardAuth            TransactionType = "credit_card_authorization"
+	TransactionTypeCreditCardIncrementalAuth TransactionType = "credit_card_incremental_authorization"
+	TransactionTypeCreditCardPresent         TransactionType = "credit_card_presentment"
+	TransactionTypeCreditCardReversal        TransactionType = "credit_card_reversal"
+	TransactionTypeCreditCardRefund          TransactionType = "credit_card_refund"
 )
 
 type Request struct {
-	//TransferID      *string
+	// TransferID makes the request idempotent: it's used as the workflow and ledger transfer id, generated when empty
+	TransferID      uuid.UUID
 	CustomerAccount uint64
 	TxnType         TransactionType
-	Amount          uint64
+	// Amount is in the currency of the account or, for an authorization in a foreign currency, the merchant currency.
+	// Changes to an authorization are in the currency of the authorization.
+	Amount money.Amount
+	// AuthorizationID is the authorization to increment or reverse
+	AuthorizationID uuid.UUID
+	// OriginalTransferID is the transaction to refund, refunds can also be booked without one
+	OriginalTransferID *uuid.UUID
+	// MerchantCategoryCode decides how long an authorization hold lasts
+	MerchantCategoryCode string
+	// CardID is the card of an authorization or a presentment made with a card
+	CardID *uuid.UUID
+	// References identify an authorization or a presentment on the card network, the auth code is generated for
+	// authorizations
+	References NetworkReferences
+	// MoreClearings tells a presentment isn't the final clearing of its authorization, the rest stays held for the
+	// next ones
+	MoreClearings bool
+}
+
+// NetworkReferences identify a card transaction on the card network, any of them may be empty
+type NetworkReferences struct {
+	NetworkTransactionID string `json:"network_transaction_id,omitempty"`
+	AuthCode             string `json:"auth_code,omitempty"`
+	MerchantID           string `json:"merchant_id,omitempty"`
+	AcquirerReference    string `json:"acquirer_reference,omitempty"`
 }
@@ -0,0 +1,3 @@
+ALTER TABLE transfers ADD COLUMN card_id uuid;
+
+create index if not exists index_transfers_card_id on transfers (card_id);
@@ -0,0 +1,13 @@
+CREATE TABLE spend_controls (
+                            account_id bigint NOT NULL,
+                            card_id uuid NOT NULL DEFAULT '00000000-0000-0000-0000-000000000000',
+                            max_transaction_amount bigint,
+                            daily_limit bigint,
+                            monthly_limit bigint,
+                            hourly_count integer,
+                            blocked_mccs text[] NOT NULL DEFAULT '{}',
+                            updated_at timestamp with time zone NOT NULL DEFAULT now(),
+                            PRIMARY KEY (account_id, card_id)
+);
+
+ALTER TABLE transfers ADD COLUMN decline_reason varchar NOT NULL DEFAULT '';
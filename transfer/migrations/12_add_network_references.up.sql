@@ -0,0 +1,11 @@
+ALTER TABLE transfers ADD COLUMN network_transaction_id varchar NOT NULL DEFAULT '';
+ALTER TABLE transfers ADD COLUMN auth_code varchar NOT NULL DEFAULT '';
+ALTER TABLE transfers ADD COLUMN merchant_id varchar NOT NULL DEFAULT '';
+ALTER TABLE transfers ADD COLUMN acquirer_reference varchar NOT NULL DEFAULT '';
+-- match_rule is the rule that matched the presentment with the authorization
+ALTER TABLE transfers ADD COLUMN match_rule varchar NOT NULL DEFAULT '';
+
+create index if not exists index_transfers_network_transaction_id on transfers (debit_account_id, network_transaction_id) where network_transaction_id <> '';
+create index if not exists index_transfers_auth_code on transfers (debit_account_id, auth_code) where auth_code <> '';
+create index if not exists index_transfers_acquirer_reference on transfers (debit_account_id, acquirer_reference) where acquirer_reference <> '';
+create index if not exists index_transfers_merchant_id on transfers (debit_account_id, merchant_id) where merchant_id <> '';
@@ -0,0 +1,2 @@
+-- overdrawn_amount is what the collections account covered of a force-posted presentment
+ALTER TABLE transfers ADD COLUMN overdrawn_amount bigint NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- how much a presentment may exceed the authorized amount, from the merchant category of the authorization: the larger
+-- of the percentage of the authorized amount and the absolute amount
+ALTER TABLE transfers ADD COLUMN over_presentment_percent bigint NOT NULL DEFAULT 0;
+ALTER TABLE transfers ADD COLUMN over_presentment_amount bigint NOT NULL DEFAULT 0;
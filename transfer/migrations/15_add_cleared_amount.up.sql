@@ -0,0 +1,4 @@
+-- cleared_amount and cleared_merchant_amount are what the presentments of an authorization cleared so far, in the
+-- currency of the presentments, the rest of the authorization is still held for further clearings
+ALTER TABLE transfers ADD COLUMN cleared_amount bigint NOT NULL DEFAULT 0;
+ALTER TABLE transfers ADD COLUMN cleared_merchant_amount bigint NOT NULL DEFAULT 0;
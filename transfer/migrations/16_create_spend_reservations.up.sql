@@ -0,0 +1,12 @@
+-- spend_reservations hold the amount of an authorization allowed by the spend controls until its workflow records it in
+-- transfers, so concurrent authorizations of the account are checked against each other
+CREATE TABLE spend_reservations (
+                            id uuid NOT NULL,
+                            account_id bigint NOT NULL,
+                            card_id uuid,
+                            amount bigint NOT NULL,
+                            created_at timestamp with time zone NOT NULL DEFAULT now(),
+                            PRIMARY KEY (id)
+);
+
+create index if not exists index_spend_reservations_account_id on spend_reservations (account_id, created_at);
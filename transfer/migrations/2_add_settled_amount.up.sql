@@ -0,0 +1 @@
+ALTER TABLE transfers ADD COLUMN settled_amount bigint NOT NULL DEFAULT 0;
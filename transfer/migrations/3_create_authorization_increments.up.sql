@@ -0,0 +1,9 @@
+CREATE TABLE authorization_increments (
+                            id uuid NOT NULL,
+                            authorization_id uuid NOT NULL REFERENCES transfers (id),
+                            amount bigint NOT NULL,
+                            created_at timestamp with time zone NOT NULL DEFAULT now(),
+                            PRIMARY KEY (id)
+);
+
+create index if not exists index_authorization_increments_authorization_id on authorization_increments (authorization_id);
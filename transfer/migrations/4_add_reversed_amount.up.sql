@@ -0,0 +1 @@
+ALTER TABLE transfers ADD COLUMN reversed_amount bigint NOT NULL DEFAULT 0;
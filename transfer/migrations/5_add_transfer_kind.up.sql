@@ -0,0 +1,4 @@
+ALTER TABLE transfers ADD COLUMN kind varchar NOT NULL DEFAULT 'authorization';
+ALTER TABLE transfers ADD COLUMN original_transfer_id uuid REFERENCES transfers (id);
+
+create index if not exists index_original_transfer_id on transfers (original_transfer_id);
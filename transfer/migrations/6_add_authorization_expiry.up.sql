@@ -0,0 +1,2 @@
+ALTER TABLE transfers ADD COLUMN merchant_category_code varchar NOT NULL DEFAULT '';
+ALTER TABLE transfers ADD COLUMN expires_at timestamp with time zone;
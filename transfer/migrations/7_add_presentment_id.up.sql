@@ -0,0 +1,4 @@
+ALTER TABLE transfers ADD COLUMN presentment_id uuid;
+
+create index if not exists index_debit_account_id_created_at on transfers (debit_account_id, created_at, id);
+create index if not exists index_credit_account_id_created_at on transfers (credit_account_id, created_at, id);
@@ -0,0 +1,9 @@
+CREATE TABLE ledger_transfers (
+                            id uuid NOT NULL,
+                            transfer_id uuid NOT NULL,
+                            pending_id uuid,
+                            created_at timestamp with time zone NOT NULL DEFAULT now(),
+                            PRIMARY KEY (id)
+);
+
+create index if not exists index_ledger_transfers_transfer_id on ledger_transfers (transfer_id);
@@ -0,0 +1,5 @@
+ALTER TABLE transfers ADD COLUMN merchant_currency varchar NOT NULL DEFAULT '';
+ALTER TABLE transfers ADD COLUMN merchant_amount bigint NOT NULL DEFAULT 0;
+ALTER TABLE transfers ADD COLUMN fx_rate numeric;
+ALTER TABLE transfers ADD COLUMN settlement_fx_rate numeric;
+ALTER TABLE authorization_increments ADD COLUMN merchant_amount bigint NOT NULL DEFAULT 0;
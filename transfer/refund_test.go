@@ -0,0 +1,90 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"testing"
+
+	"encore.dev/beta/errs"
+	"encore.dev/types/uuid"
+
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/money"
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/transfer/db"
+)
+
+// insertPresentment records a presentment of the account with the progress, as the Presentment workflow does
+func insertPresentment(t *testing.T, account uint64, amount uint64, progress db.TransferProgress) uuid.UUID {
+	t.Helper()
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.InsertNewTransferWithProgress(&db.TransferReq{
+		ID:              id,
+		DebitAccountID:  account,
+		CreditAccountID: 2,
+		Amount:          amount,
+		Progress:        progress,
+		Kind:            db.TransferKindPresentment,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// TestReserveRefund refunds a force-posted presentment up to its amount
+func TestReserveRefund(t *testing.T) {
+	ctx := context.Background()
+	account := uint64(rand.Int31n(1<<30)) + 1000
+
+	forcePosted := insertPresentment(t, account, 700, db.TransferProgressUnmatchedForcePost)
+	failed := insertPresentment(t, account, 700, db.TransferProgressFailedForcePost)
+
+	tests := []struct {
+		name     string
+		original uuid.UUID
+		amount   uint64
+		wantCode errs.ErrCode
+	}{
+		{"part of a force post", forcePosted, 500, errs.OK},
+		{"the rest of a force post", forcePosted, 200, errs.OK},
+		{"beyond a force post", forcePosted, 1, errs.FailedPrecondition},
+		{"failed force post", failed, 100, errs.FailedPrecondition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			id, err := uuid.NewV4()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = reserveRefund(ctx, &Request{
+				CustomerAccount:    account,
+				Amount:             money.New(tt.amount, "USD"),
+				OriginalTransferID: &tt.original,
+			}, &db.TransferReq{
+				ID:                 id,
+				DebitAccountID:     2,
+				CreditAccountID:    account,
+				Amount:             tt.amount,
+				OriginalTransferID: uuid.NullUUID{UUID: tt.original, Valid: true},
+			})
+
+			if tt.wantCode == errs.OK {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var e *errs.Error
+			if !errors.As(err, &e) || e.Code != tt.wantCode {
+				t.Fatalf("got %v, want %s", err, tt.wantCode)
+			}
+		})
+	}
+}
@@ -4,16 +4,22 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
+	"time"
 
 	encore "encore.dev"
 	"encore.dev/beta/errs"
+	"go.temporal.io/api/enums/v1"
+	"go.temporal.io/api/serviceerror"
 	"go.temporal.io/sdk/client"
 	"go.temporal.io/sdk/temporal"
 	"go.temporal.io/sdk/worker"
 
 	"encore.dev/types/uuid"
 
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/fx"
 	"github.com/ohmpatel1997/pave-coding-challenge-simon/ledger"
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/money"
 	"github.com/ohmpatel1997/pave-coding-challenge-simon/transfer/db"
 	"github.com/ohmpatel1997/pave-coding-challenge-simon/transfer/workflow"
 	tb "github.com/tigerbeetledb/tigerbeetle-go"
@@ -24,9 +30,50 @@ type Service struct {
 	client      client.Client
 	worker      worker.Worker
 	workflowSvc *workflow.Service
+	expiry      *authorizationExpiry
+	decision    *authorizationDecision
+	matching    *presentmentMatching
+	forcePost   *forcePost
+	overPresent *overPresentment
+	rates       fx.RateProvider
 }
 
 func initService() (*Service, error) {
+	expiry, err := loadAuthorizationExpiry(authorizationExpiryConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	decision, err := loadAuthorizationDecision(authorizationDecisionConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	matching, err := loadPresentmentMatching(presentmentMatchingConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	forcePost, err := loadForcePost(forcePostConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	overPresent, err := loadOverPresentment(overPresentmentConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	rates, err := fx.NewFileRateProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	chart, err := ledger.NewChartOfAccounts()
+	if err != nil {
+		return nil, err
+	}
+
 	c, err := client.Dial(client.Options{})
 	if err != nil {
 		return nil, fmt.Errorf("create temporal client: %v", err)
@@ -36,7 +83,7 @@ func initService() (*Service, error) {
 	if err != nil {
 		return nil, errs.Wrap(errors.New("error connecting to db"), err.Error())
 	}
-	ledgerSvc := ledger.NewLedgerService(tbClient)
+	ledgerSvc := ledger.NewLedgerService(tbClient, chart)
 
 	workflowSvc := workflow.NewService(ledgerSvc, c)
 
@@ -44,16 +91,30 @@ func initService() (*Service, error) {
 
 	w.RegisterWorkflow(workflowSvc.Authorization)
 	w.RegisterWorkflow(workflowSvc.Presentment)
+	w.RegisterWorkflow(workflowSvc.Refund)
 
 	w.RegisterActivity(uuid.NewV4)
 	w.RegisterActivity(ledgerSvc.FreezeAmount)
+	w.RegisterActivity(ledgerSvc.PostTransfer)
 	w.RegisterActivity(ledgerSvc.SettleTransaction)
 	w.RegisterActivity(ledgerSvc.CancelTransaction)
+	w.RegisterActivity(ledgerSvc.ReduceTransaction)
+	w.RegisterActivity(ledgerSvc.CaptureTransaction)
+	w.RegisterActivity(ledgerSvc.PostOverdrawnTransfer)
 	w.RegisterActivity(db.InsertNewTransfer)
+	w.RegisterActivity(db.InsertNewTransferWithProgress)
 	w.RegisterActivity(db.UpdateTransferProgress)
+	w.RegisterActivity(db.UpdateSettledAmount)
+	w.RegisterActivity(db.UpdateOverdrawnAmount)
+	w.RegisterActivity(db.UpdateSettlementFXRate)
+	w.RegisterActivity(db.InsertAuthorizationIncrement)
+	w.RegisterActivity(db.UpdateReversedAmount)
+	w.RegisterActivity(db.InsertLedgerTransfer)
+	w.RegisterActivity(db.ReleaseSpend)
 	w.RegisterActivity(workflowSvc.SignalActivity)
+	w.RegisterActivity(workflowSvc.CheckAccountActivity)
 	w.RegisterActivity(db.TransferDB.Begin)
-	w.RegisterActivity(db.GetTransaction)
+	w.RegisterActivity(db.MatchAuthorization)
 
 	err = w.Start()
 	if err != nil {
@@ -61,84 +122,578 @@ func initService() (*Service, error) {
 		return nil, fmt.Errorf("start temporal worker: %v", err)
 	}
 
-	return &Service{client: c, worker: w, workflowSvc: workflowSvc}, nil
+	return &Service{client: c, worker: w, workflowSvc: workflowSvc, expiry: expiry, decision: decision, matching: matching, forcePost: forcePost, overPresent: overPresent, rates: rates}, nil
 }
 
 func (s *Service) Shutdown(force context.Context) {
 	s.client.Close()
 	s.worker.Stop()
-	s.workflowSvc.LedgerSvc.TB.Close()
+	s.workflowSvc.LedgerSvc.Backend.Close()
 }
 
 //encore:api private method=POST
 func (s *Service) Transfer(ctx context.Context, req *Request) error {
 	switch req.TxnType {
 	case TransactionTypeCreditCardAuth:
-		workflowID, err := uuid.NewV4()
+		resp, err := s.authorize(ctx, req)
 		if err != nil {
-			return fmt.Errorf("generate workflow id: %v", err)
+			return err
 		}
 
-		options := client.StartWorkflowOptions{
-			ID:        workflowID.String(),
-			TaskQueue: encore.Meta().Environment.Name + "-credit-card-transfer",
-			RetryPolicy: &temporal.RetryPolicy{
-				MaximumAttempts: 1, // try only once
-			},
-			//WorkflowExecutionTimeout: time.Minute * 5,
-			//WorkflowIDReusePolicy:    enums.WORKFLOW_ID_REUSE_POLICY_ALLOW_DUPLICATE_FAILED_ONLY,
+		if resp.Status == string(workflow.DecisionDeclined) {
+			return declinedError(ledger.DeclineReason(resp.DeclineReason))
+		}
+	case TransactionTypeCreditCardIncrementalAuth:
+		auth, err := getOpenAuthorization(ctx, req)
+		if err != nil {
+			return err
 		}
 
-		_, err = s.client.ExecuteWorkflow(ctx, options, s.workflowSvc.Authorization, &workflow.PaymentDetails{
-			WorkflowID:    workflowID,
-			SourceAccount: req.CustomerAccount,
-			TargetAccount: 2, // bank's account, hardcoded for now
-			Amount:        req.Amount,
+		amount, merchantAmount, err := s.authorizationAmount(auth, req)
+		if err != nil {
+			return err
+		}
+
+		// the caller waits for the hold, found by its id
+		holdID, err := newWorkflowID(req)
+		if err != nil {
+			return err
+		}
+
+		err = s.client.SignalWorkflow(ctx, auth.ID.String(), "", fmt.Sprintf("increment-%s", auth.ID.String()), &workflow.IncrementSignal{
+			ID:             auth.ID.String(),
+			HoldID:         holdID,
+			Amount:         amount,
+			MerchantAmount: merchantAmount,
 		})
 		if err != nil {
 			return &errs.Error{
 				Code:    errs.Internal,
-				Message: errs.Wrap(err, "error executing workflow").Error(),
+				Message: errs.Wrap(err, "error signaling workflow").Error(),
 			}
 		}
-	case TransactionTypeCreditCardPresent:
-		workflowID, err := uuid.NewV4()
+
+		err = s.requestResult(ctx, auth.ID, holdID, "increment")
 		if err != nil {
-			return fmt.Errorf("generate workflow id: %v", err)
+			return err
+		}
+	case TransactionTypeCreditCardReversal:
+		auth, err := getOpenAuthorization(ctx, req)
+		if err != nil {
+			return err
 		}
 
-		options := client.StartWorkflowOptions{
-			ID:        workflowID.String(),
-			TaskQueue: encore.Meta().Environment.Name + "-credit-card-transfer",
-			RetryPolicy: &temporal.RetryPolicy{
-				MaximumAttempts: 1, // try only once
-			},
+		amount, merchantAmount, err := s.authorizationAmount(auth, req)
+		if err != nil {
+			return err
 		}
 
-		_, err = s.client.ExecuteWorkflow(ctx, options, s.workflowSvc.Presentment, &workflow.PaymentDetails{
-			SourceAccount: req.CustomerAccount,
-			TargetAccount: 2, // bank's account, hardcoded for now
-			Amount:        req.Amount,
+		// the caller waits for the reversal, found by its id
+		reversalID, err := newWorkflowID(req)
+		if err != nil {
+			return err
+		}
+
+		err = s.client.SignalWorkflow(ctx, auth.ID.String(), "", fmt.Sprintf("reversal-%s", auth.ID.String()), &workflow.ReversalSignal{
+			ID:             auth.ID.String(),
+			ReversalID:     reversalID,
+			Amount:         amount,
+			MerchantAmount: merchantAmount,
 		})
 		if err != nil {
 			return &errs.Error{
 				Code:    errs.Internal,
-				Message: errs.Wrap(err, "error executing workflow").Error(),
+				Message: errs.Wrap(err, "error signaling workflow").Error(),
+			}
+		}
+
+		err = s.requestResult(ctx, auth.ID, reversalID, "reversal")
+		if err != nil {
+			return err
+		}
+	case TransactionTypeCreditCardRefund:
+		currency, err := s.accountCurrency(req.CustomerAccount)
+		if err != nil {
+			return err
+		}
+
+		if isForeign(req.Amount, currency) {
+			return &errs.Error{
+				Code:    errs.InvalidArgument,
+				Message: "refunds are in the account currency",
+			}
+		}
+
+		settlementAccount, err := s.systemAccount(ledger.RoleSettlement, currency)
+		if err != nil {
+			return err
+		}
+
+		workflowID, err := newWorkflowID(req)
+		if err != nil {
+			return err
+		}
+
+		var originalTransferID uuid.NullUUID
+		if req.OriginalTransferID != nil {
+			originalTransferID = uuid.NullUUID{UUID: *req.OriginalTransferID, Valid: true}
+			err := reserveRefund(ctx, req, &db.TransferReq{
+				ID:                 workflowID,
+				DebitAccountID:     settlementAccount,
+				CreditAccountID:    req.CustomerAccount,
+				Amount:             req.Amount.Value,
+				OriginalTransferID: originalTransferID,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		err = s.executeWorkflow(ctx, workflowID, s.workflowSvc.Refund, &workflow.PaymentDetails{
+			WorkflowID:         workflowID,
+			SourceAccount:      settlementAccount,
+			TargetAccount:      req.CustomerAccount,
+			Amount:             req.Amount,
+			OriginalTransferID: originalTransferID,
+		})
+		if err != nil {
+			if originalTransferID.Valid {
+				// release the reserved amount, a retry reserves it again and the workflow settles the refund if it
+				// started after all
+				_ = db.UpdateTransferProgress(workflowID, db.TransferProgressFailedOnLedgerSettlement, nil)
+			}
+			return err
+		}
+	case TransactionTypeCreditCardPresent:
+		currency, err := s.accountCurrency(req.CustomerAccount)
+		if err != nil {
+			return err
+		}
+
+		workflowID, err := newWorkflowID(req)
+		if err != nil {
+			return err
+		}
+
+		settlementAccount, err := s.systemAccount(ledger.RoleSettlement, currency)
+		if err != nil {
+			return err
+		}
+
+		paymentDetails := &workflow.PaymentDetails{
+			WorkflowID:    workflowID,
+			SourceAccount: req.CustomerAccount,
+			TargetAccount: settlementAccount,
+			Amount:        req.Amount,
+			CardID:        nullUUID(req.CardID),
+			References:    db.NetworkReferences(req.References),
+		}
+		paymentDetails.FuzzyMaxAmount, paymentDetails.FuzzySince = s.matching.fuzzyBounds(req.Amount.Value, time.Now())
+		paymentDetails.ExpiredSince = s.matching.expiredSince(time.Now())
+		paymentDetails.FlagOverPresentment = s.overPresent.flagBeyondTolerance
+		paymentDetails.FinalClearing = !req.MoreClearings
+
+		if s.forcePost.overdrawIntoCollections {
+			paymentDetails.CollectionsAccount, err = s.systemAccount(ledger.RoleCollections, currency)
+			if err != nil {
+				return err
 			}
 		}
+
+		if isForeign(req.Amount, currency) {
+			// presentments are matched on the merchant amount, the rate is the one at presentment
+			err = s.convert(paymentDetails, currency)
+			if err != nil {
+				return err
+			}
+			paymentDetails.Amount = req.Amount
+		}
+
+		err = s.executeWorkflow(ctx, workflowID, s.workflowSvc.Presentment, paymentDetails)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// accountCurrency returns the currency of the customer account
+func (s *Service) accountCurrency(customerAccount uint64) (ledger.Currency, error) {
+	acc, err := s.workflowSvc.LedgerSvc.GetAccount(customerAccount)
+	if err != nil {
+		return ledger.Currency{}, err
+	}
+
+	return ledger.CurrencyByLedger(acc.Ledger)
+}
+
+// systemAccount returns the bank's account with the role in the currency
+func (s *Service) systemAccount(role ledger.Role, currency ledger.Currency) (uint64, error) {
+	return s.workflowSvc.LedgerSvc.Chart.SystemAccount(role, currency.Code)
+}
+
+func nullUUID(id *uuid.UUID) uuid.NullUUID {
+	if id == nil {
+		return uuid.NullUUID{}
+	}
+	return uuid.NullUUID{UUID: *id, Valid: true}
+}
+
+// isForeign tells if the amount is in another currency than the account
+func isForeign(amount money.Amount, accountCurrency ledger.Currency) bool {
+	return !strings.EqualFold(amount.Currency, accountCurrency.Code)
+}
+
+// convert turns the payment into one in the merchant currency: the payment amount becomes the merchant amount,
+// converted to the account currency at the current rate, and the money goes to the settlement account of the
+// merchant currency through the FX accounts
+func (s *Service) convert(paymentDetails *workflow.PaymentDetails, accountCurrency ledger.Currency) error {
+	merchantCurrency, err := ledger.CurrencyByCode(paymentDetails.Amount.Currency)
+	if err != nil {
+		return err
+	}
+
+	rate, err := s.rates.Rate(merchantCurrency.Code, accountCurrency.Code)
+	if err != nil {
+		return err
+	}
+
+	amount, err := rate.Convert(paymentDetails.Amount)
+	if err != nil {
+		return err
+	}
+
+	sourceFXAccount, err := s.systemAccount(ledger.RoleFX, accountCurrency)
+	if err != nil {
+		return err
+	}
+
+	targetFXAccount, err := s.systemAccount(ledger.RoleFX, merchantCurrency)
+	if err != nil {
+		return err
+	}
+
+	settlementAccount, err := s.systemAccount(ledger.RoleSettlement, merchantCurrency)
+	if err != nil {
+		return err
+	}
+
+	paymentDetails.FX = &workflow.FXDetails{
+		MerchantAmount:  paymentDetails.Amount,
+		Rate:            rate,
+		SourceFXAccount: sourceFXAccount,
+		TargetFXAccount: targetFXAccount,
+	}
+	paymentDetails.TargetAccount = settlementAccount
+	paymentDetails.Amount = amount
+	return nil
+}
+
+// authorizationAmount returns the amount of a change to the authorization in the account currency. Changes to an
+// authorization in a foreign currency are in the merchant currency, converted at the rate of the authorization,
+// the merchant amount is then returned as well.
+func (s *Service) authorizationAmount(auth *db.TransferResponse, req *Request) (uint64, uint64, error) {
+	currency, err := s.accountCurrency(req.CustomerAccount)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var merchantCurrency string
+	if isForeign(req.Amount, currency) {
+		merchantCurrency = req.Amount.Currency
+	}
+
+	if merchantCurrency != auth.MerchantCurrency {
+		return 0, 0, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "currency doesn't match the authorization",
+		}
+	}
+
+	if auth.MerchantCurrency == "" || auth.FXRate == nil {
+		return req.Amount.Value, 0, nil
+	}
+
+	rate := fx.Rate{From: auth.MerchantCurrency, To: currency.Code, Value: *auth.FXRate}
+	amount, err := rate.Convert(req.Amount)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return amount.Value, req.Amount.Value, nil
+}
+
+// newWorkflowID returns the transfer id given by the caller, so a retried request maps to the same workflow
+// and ledger transfer, or a new one
+func newWorkflowID(req *Request) (uuid.UUID, error) {
+	if req.TransferID != uuid.Nil {
+		return req.TransferID, nil
+	}
+
+	workflowID, err := uuid.NewV4()
+	if err != nil {
+		return uuid.Nil, fmt.Errorf("generate workflow id: %v", err)
+	}
+	return workflowID, nil
+}
+
+// executeWorkflow starts the workflow once per workflow id. Starting a workflow id again returns
+// the running or completed workflow instead of a new one, only failed workflows can be started again.
+func (s *Service) executeWorkflow(ctx context.Context, workflowID uuid.UUID, wf interface{}, paymentDetails *workflow.PaymentDetails) error {
+	options := client.StartWorkflowOptions{
+		ID:        workflowID.String(),
+		TaskQueue: encore.Meta().Environment.Name + "-credit-card-transfer",
+		RetryPolicy: &temporal.RetryPolicy{
+			MaximumAttempts: 1, // try only once
+		},
+		WorkflowIDReusePolicy: enums.WORKFLOW_ID_REUSE_POLICY_ALLOW_DUPLICATE_FAILED_ONLY,
+	}
+
+	_, err := s.client.ExecuteWorkflow(ctx, options, wf, paymentDetails)
+	if err != nil && !temporal.IsWorkflowExecutionAlreadyStartedError(err) {
+		return &errs.Error{
+			Code:    errs.Internal,
+			Message: errs.Wrap(err, "error executing workflow").Error(),
+		}
+	}
+
+	return nil
+}
+
+// getOpenAuthorization returns the authorization of the request, only an open authorization of the customer can be changed
+func getOpenAuthorization(ctx context.Context, req *Request) (*db.TransferResponse, error) {
+	auth, err := db.GetTransferByID(ctx, req.AuthorizationID)
+	if err != nil {
+		return nil, err
+	}
+
+	if auth.DebitAccountID != req.CustomerAccount || auth.TransferProgress != string(db.TransferProgressInitiated) {
+		return nil, &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "authorization is not open",
+		}
+	}
+
+	return auth, nil
+}
+
+// refundable returns what of the transaction can be refunded: the settled amount of a settled authorization or the
+// amount of a force-posted presentment. Other transactions can't be refunded.
+func refundable(original *db.TransferResponse) (uint64, bool) {
+	switch {
+	case original.Kind == string(db.TransferKindAuthorization) && original.TransferProgress == string(db.TransferProgressSettled):
+		return original.SettledAmount, true
+	case original.Kind == string(db.TransferKindPresentment) && original.TransferProgress == string(db.TransferProgressUnmatchedForcePost):
+		return original.Amount, true
+	}
+	return 0, false
+}
+
+// reserveRefund checks the refund against the original transaction, which must be a settled transaction
+// of the customer, and the refunds so far must not exceed what was settled. The refund is recorded in progress in the
+// same transaction, with the original transaction locked, so concurrent refunds can't both take the same amount.
+func reserveRefund(ctx context.Context, req *Request, refund *db.TransferReq) error {
+	tx, err := db.TransferDB.Begin(ctx)
+	if err != nil {
+		return errs.Wrap(err, "error starting the transaction")
+	}
+	defer tx.Rollback()
+
+	original, err := db.LockTransfer(ctx, *req.OriginalTransferID, tx)
+	if err != nil {
+		return err
+	}
+
+	settled, ok := refundable(original)
+	if original.DebitAccountID != req.CustomerAccount || !ok {
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "original transaction can't be refunded",
+		}
+	}
+
+	refunded, err := db.GetRefundedAmount(ctx, original.ID, refund.ID, tx)
+	if err != nil {
+		return err
+	}
+
+	if refunded+req.Amount.Value > settled {
+		return &errs.Error{
+			Code:    errs.FailedPrecondition,
+			Message: "refund exceeds the settled amount of the original transaction",
+		}
+	}
+
+	err = db.ReserveRefund(ctx, refund, tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 type PresentmentRequest struct {
-	Account uint64 `json:"account"`
-	Amount  uint64 `json:"amount"`
+	Account uint64       `json:"account"`
+	Amount  money.Amount `json:"amount"`
+	// CardID restricts the match to the authorizations made with the card
+	CardID     *uuid.UUID        `json:"card_id,omitempty"`
+	References NetworkReferences `json:"references"`
 }
 
-// GetAuthTransferForPresentment returns the auth transfer for presentment
+// GetAuthTransferForPresentment returns the auth transfer the presentment matches, an open one or one expired within
+// the grace window
 //
 //encore:api private method=GET
 func (s *Service) GetAuthTransferForPresentment(ctx context.Context, req *PresentmentRequest) (*db.TransferResponse, error) {
-	return db.GetTransaction(ctx, req.Account, req.Amount, db.TransferProgressInitiated, false, nil)
+	currency, err := s.accountCurrency(req.Account)
+	if err != nil {
+		return nil, err
+	}
+
+	var merchantCurrency string
+	if isForeign(req.Amount, currency) {
+		merchantCurrency = req.Amount.Currency
+	}
+
+	maxAmount, since := s.matching.fuzzyBounds(req.Amount.Value, time.Now())
+	match := &db.MatchReq{
+		Account:          req.Account,
+		Amount:           req.Amount.Value,
+		MerchantCurrency: merchantCurrency,
+		CardID:           nullUUID(req.CardID),
+		References:       db.NetworkReferences(req.References),
+		Progress:         db.TransferProgressInitiated,
+		FuzzyMaxAmount:   maxAmount,
+		FuzzySince:       since,
+	}
+	auth, _, err := db.MatchAuthorization(ctx, match, nil)
+	if errs.Code(err) == errs.NotFound {
+		expiredSince := s.matching.expiredSince(time.Now())
+		match.Progress, match.ExpiresAfter = db.TransferProgressExpired, &expiredSince
+		auth, _, err = db.MatchAuthorization(ctx, match, nil)
+	}
+	return auth, err
+}
+
+type ListTransfersRequest struct {
+	Account       uint64    `json:"account"`
+	Progress      string    `json:"progress"`
+	DeclineReason string    `json:"decline_reason"`
+	Direction     string    `json:"direction"`
+	From          time.Time `json:"from"`
+	To            time.Time `json:"to"`
+	Cursor        string    `json:"cursor"`
+	Limit         int       `json:"limit"`
+}
+
+type ListTransfersResponse struct {
+	Transfers  []db.TransferResponse `json:"transfers"`
+	NextCursor string                `json:"next_cursor"`
+}
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 100
+)
+
+// ListTransfers returns the transfers of an account page by page, newest first
+//
+//encore:api private method=POST
+func (s *Service) ListTransfers(ctx context.Context, req *ListTransfersRequest) (*ListTransfersResponse, error) {
+	direction := db.Direction(req.Direction)
+	if direction != "" && direction != db.DirectionDebit && direction != db.DirectionCredit {
+		return nil, &errs.Error{
+			Code:    errs.InvalidArgument,
+			Message: "direction must be debit or credit",
+		}
+	}
+
+	limit := req.Limit
+	switch {
+	case limit <= 0:
+		limit = defaultListLimit
+	case limit > maxListLimit:
+		limit = maxListLimit
+	}
+
+	transfers, next, err := db.ListTransfers(ctx, &db.ListTransfersReq{
+		Account:       req.Account,
+		Progress:      db.TransferProgress(req.Progress),
+		DeclineReason: req.DeclineReason,
+		Direction:     direction,
+		From:          req.From,
+		To:            req.To,
+		Cursor:        req.Cursor,
+		Limit:         limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ListTransfersResponse{Transfers: transfers, NextCursor: next}, nil
+}
+
+type GetTransferRequest struct {
+	ID uuid.UUID `json:"id"`
+}
+
+type TransferDetails struct {
+	Transfer db.TransferResponse `json:"transfer"`
+	// LedgerTransferIDs are the ledger transfers booked for the transfer, in booking order
+	LedgerTransferIDs []uuid.UUID `json:"ledger_transfer_ids"`
+	WorkflowStatus    string      `json:"workflow_status"`
+	// PresentmentWorkflowStatus is set once a presentment is matched with the authorization
+	PresentmentWorkflowStatus string `json:"presentment_workflow_status,omitempty"`
+}
+
+// GetTransfer returns the transfer with the ledger transfers booked for it and the status of its workflows
+//
+//encore:api private method=POST
+func (s *Service) GetTransfer(ctx context.Context, req *GetTransferRequest) (*TransferDetails, error) {
+	transfer, err := db.GetTransferByID(ctx, req.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	ledgerTransferIDs, err := db.GetLedgerTransferIDs(ctx, transfer.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	details := &TransferDetails{
+		Transfer:          *transfer,
+		LedgerTransferIDs: ledgerTransferIDs,
+	}
+
+	details.WorkflowStatus, err = s.workflowStatus(ctx, transfer.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if transfer.PresentmentID.Valid {
+		details.PresentmentWorkflowStatus, err = s.workflowStatus(ctx, transfer.PresentmentID.UUID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return details, nil
+}
+
+// workflowStatus returns the status of the latest run of the workflow, workflows past their retention aren't found
+func (s *Service) workflowStatus(ctx context.Context, workflowID uuid.UUID) (string, error) {
+	resp, err := s.client.DescribeWorkflowExecution(ctx, workflowID.String(), "")
+	var notFound *serviceerror.NotFound
+	switch {
+	case errors.As(err, &notFound):
+		return "not_found", nil
+	case err != nil:
+		return "", &errs.Error{
+			Code:    errs.Internal,
+			Message: errs.Wrap(err, "error describing workflow").Error(),
+		}
+	}
+
+	return resp.WorkflowExecutionInfo.GetStatus().String(), nil
 }
@@ -6,50 +6,139 @@ import (
 	"fmt"
 
 	"encore.dev/beta/errs"
+	"encore.dev/types/uuid"
+	"go.temporal.io/sdk/temporal"
 
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/ledger"
 	"github.com/ohmpatel1997/pave-coding-challenge-simon/transfer/db"
 )
 
-func (s *Service) SignalActivity(ctx context.Context, req *PaymentDetails) error {
+// SignalActivity matches the presentment with an open authorization and signals its workflow to settle it. Without
+// one, an authorization expired within the grace window is matched, left for the presentment to post afresh. It returns
+// the matched authorization, nil when none matched. Unless it's the final clearing, the authorization stays open for
+// further presentments on what is still held. A presentment exceeding the authorization beyond its
+// over-presentment tolerance is declined, unless it's to be flagged.
+func (s *Service) SignalActivity(ctx context.Context, req *PaymentDetails) (*PresentmentMatch, error) {
 	tx, err := db.TransferDB.Begin(ctx)
 	if err != nil {
-		return &errs.Error{
+		return nil, &errs.Error{
 			Code:    errs.Internal,
 			Message: "internal error",
 		}
 	}
 
+	var merchantCurrency string
+	if req.FX != nil {
+		merchantCurrency = req.FX.MerchantAmount.Currency
+	}
+
 	// get a initiated transfer, get a lock, so not other workflow can pick it up
-	transfer, err := db.GetTransaction(ctx, req.SourceAccount, req.Amount, db.TransferProgressInitiated, true, tx)
+	match := &db.MatchReq{
+		Account:          req.SourceAccount,
+		Amount:           req.Amount.Value,
+		MerchantCurrency: merchantCurrency,
+		CardID:           req.CardID,
+		References:       req.References,
+		Progress:         db.TransferProgressInitiated,
+		FuzzyMaxAmount:   req.FuzzyMaxAmount,
+		FuzzySince:       req.FuzzySince,
+		ForUpdate:        true,
+	}
+	transfer, rule, err := db.MatchAuthorization(ctx, match, tx)
+	if errs.Code(err) == errs.NotFound && !req.ExpiredSince.IsZero() {
+		match.Progress, match.ExpiresAfter = db.TransferProgressExpired, &req.ExpiredSince
+		transfer, rule, err = db.MatchAuthorization(ctx, match, tx)
+	}
 	var encoreErr *errs.Error
 	switch {
-	// in case if there is another workflow that has already settled the transaction
+	// no open authorization, or another workflow has already settled it
 	case err != nil && errors.As(err, &encoreErr) && encoreErr.Code == errs.NotFound:
 		tx.Rollback()
-		return nil
+		return nil, nil
 	case err != nil:
 		tx.Rollback()
-		return err
+		return nil, err
+	}
+
+	presentmentID := req.WorkflowID
+	result := &PresentmentMatch{
+		AuthorizationID: transfer.ID,
+		Expired:         transfer.TransferProgress == string(db.TransferProgressExpired),
+	}
+
+	// the tolerance is on the amount still held, in the currency of the presentment
+	held := transfer.HeldAmount()
+	flagged := req.Amount.Value > transfer.OverPresentment.Limit(held)
+	if flagged && !req.FlagOverPresentment {
+		tx.Rollback()
+		result.DeclineReason = ledger.DeclineReasonOverPresentment
+		return result, nil
+	}
+
+	// a clearing of all that is held is the last one whatever its flag, the expired authorizations are cleared at once
+	final := req.FinalClearing || req.Amount.Value >= held || result.Expired
+
+	// the workflow of an expired authorization is over, the presentment posts it itself
+	if !result.Expired {
+		signal := &PresentmentSignal{ID: transfer.ID.String(), PresentmentID: presentmentID, Amount: req.Amount.Value, Flagged: flagged, Final: final}
+		if req.FX != nil {
+			// the authorization converts the merchant amount itself
+			signal = &PresentmentSignal{ID: transfer.ID.String(), PresentmentID: presentmentID, MerchantAmount: req.Amount.Value, SettlementRate: &req.FX.Rate, Flagged: flagged, Final: final}
+		}
+
+		// signalled before the commit, so a retry may signal the presentment again: the workflow skips it by its id
+		err = s.temporalClient.SignalWorkflow(ctx, transfer.ID.String(), "", fmt.Sprintf("presentment-%s", transfer.ID.String()), signal)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
 	}
 
-	req.WorkflowID = transfer.ID
-	// signal the auth workflow to settle transaction
-	err = s.temporalClient.SignalWorkflow(ctx, req.WorkflowID.String(), "", fmt.Sprintf("presentment-%s", req.WorkflowID.String()), &PresentmentSignal{ID: req.WorkflowID.String()})
+	if final {
+		// update the transfer progress to in progress so that the another workflow doesn't pick it up
+		err = db.UpdateTransferProgress(transfer.ID, db.TransferProgressInProcess, tx)
+	} else {
+		// the authorization stays open for the next clearings, on what is left of it
+		clearedAmount, clearedMerchantAmount := req.Amount.Value, uint64(0)
+		if req.FX != nil {
+			clearedAmount, clearedMerchantAmount = 0, req.Amount.Value
+		}
+		err = db.AddClearedAmount(transfer.ID, clearedAmount, clearedMerchantAmount, tx)
+	}
 	if err != nil {
-		return err
+		tx.Rollback()
+		return nil, err
 	}
 
-	// update the transfer progress to in progress so that the another workflow doesn't pick it up
-	err = db.UpdateTransferProgress(transfer.ID, db.TransferProgressInProcess, tx)
+	err = db.UpdatePresentmentMatch(transfer.ID, uuid.NullUUID{UUID: presentmentID, Valid: presentmentID != uuid.Nil}, rule, tx)
 	if err != nil {
 		tx.Rollback()
-		return err
+		return nil, err
 	}
 
 	err = tx.Commit()
 	if err != nil {
 		tx.Rollback()
+		return nil, err
+	}
+	return result, nil
+}
+
+// CheckAccountActivity fails for good if money can't leave the account, or come in when debit is false
+func (s *Service) CheckAccountActivity(ctx context.Context, account uint64, debit bool) error {
+	status, err := db.GetAccountStatus(ctx, account)
+	if err != nil {
 		return err
 	}
+
+	check := status.CheckCredit
+	if debit {
+		check = status.CheckDebit
+	}
+
+	err = check(account)
+	if err != nil {
+		return temporal.NewNonRetryableApplicationError(err.Error(), "account_status", err, ledger.DeclineReasonForStatus(status))
+	}
 	return nil
 }
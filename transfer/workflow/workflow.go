@@ -10,7 +10,9 @@ import (
 
 	"encore.dev/types/uuid"
 
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/fx"
 	"github.com/ohmpatel1997/pave-coding-challenge-simon/ledger"
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/money"
 	"github.com/ohmpatel1997/pave-coding-challenge-simon/transfer/db"
 )
 
@@ -23,18 +25,176 @@ type PaymentDetails struct {
 	WorkflowID    uuid.UUID
 	SourceAccount uint64
 	TargetAccount uint64
-	Amount        uint64
+	Amount        money.Amount
+	// OriginalTransferID is the transaction a refund is booked against, if any
+	OriginalTransferID   uuid.NullUUID
+	MerchantCategoryCode string
+	// Expiry is how long the authorization hold lasts before it's released
+	Expiry time.Duration
+	// DecisionDeadline is when the caller stops waiting for the decision on the authorization, a hold placed after it
+	// is released
+	DecisionDeadline time.Time
+	// FX is set when the transaction is in another currency than the customer account
+	FX *FXDetails
+	// CardID is the card the transaction is made with, presentments with a card only match its authorizations
+	CardID uuid.NullUUID
+	// References identify the transaction on the card network, presentments are matched on them first
+	References db.NetworkReferences
+	// FuzzyMaxAmount and FuzzySince bound the authorizations a presentment matches without references
+	FuzzyMaxAmount uint64
+	FuzzySince     time.Time
+	// ExpiredSince is the earliest expiry of the expired authorizations a presentment still matches
+	ExpiredSince time.Time
+	// OverPresentment is how much a presentment may exceed the amount of the authorization
+	OverPresentment db.OverPresentmentTolerance
+	// FinalClearing presentments release what is left of the authorization once cleared, otherwise it stays held for
+	// further presentments
+	FinalClearing bool
+	// FlagOverPresentment posts presentments beyond the over-presentment tolerance and flags them, rather than
+	// declining them
+	FlagOverPresentment bool
+	// CollectionsAccount covers what the customer account lacks to force-post a presentment matching no
+	// authorization, zero when the account can't be overdrawn
+	CollectionsAccount uint64
+}
+
+// FXDetails describes a transaction in another currency than the customer account. The amount of the payment
+// details is then in the account currency, converted from the merchant amount at the rate.
+type FXDetails struct {
+	MerchantAmount money.Amount
+	// Rate converts the merchant currency to the account currency
+	Rate fx.Rate
+	// SourceFXAccount and TargetFXAccount are the bank's FX accounts in the account and the merchant currency
+	SourceFXAccount uint64
+	TargetFXAccount uint64
+}
+
+// conversion returns the ledger conversion paying the merchant amount, nil for a transaction in the account currency
+func (d *PaymentDetails) conversion(merchantAmount uint64) *ledger.Conversion {
+	if d.FX == nil {
+		return nil
+	}
+
+	return &ledger.Conversion{
+		SourceFXAccount: d.FX.SourceFXAccount,
+		TargetFXAccount: d.FX.TargetFXAccount,
+		Amount:          money.New(merchantAmount, d.FX.MerchantAmount.Currency),
+	}
+}
+
+// defaultAuthorizationExpiry applies to authorizations started without an expiry
+const defaultAuthorizationExpiry = 100 * time.Second
+
+// Changes to the Authorization and Presentment workflows, a workflow started before a change replays without it
+const (
+	// changeAccountStatus checks the account status before touching the ledger
+	changeAccountStatus = "account-status"
+	// changeLedgerDeclines records the authorizations the ledger refuses as declined
+	changeLedgerDeclines = "ledger-declines"
+	// changeLedgerTransfers records the ledger transfers of a transfer
+	changeLedgerTransfers = "ledger-transfers"
+	// changeSettledAmount records the amount posted on settlement
+	changeSettledAmount = "settled-amount"
+	// changeOverPresentment posts what a presentment exceeds the authorization by
+	changeOverPresentment = "over-presentment"
+	// changeMultiClearing leaves the authorization open after a clearing that isn't the final one
+	changeMultiClearing = "multi-clearing"
+	// changePresentmentMatch force-posts, declines and posts late presentments after matching
+	changePresentmentMatch = "presentment-match"
+	// changeForcePostStatus refuses force-posts on frozen accounts, matched presentments still clear
+	changeForcePostStatus = "force-post-status"
+	// changeStatusRecheck checks the account status again once a hold is placed and releases it on a closed account
+	changeStatusRecheck = "status-recheck"
+	// changeSpendRelease releases the spend control reservation of an authorization that fails
+	changeSpendRelease = "spend-release"
+)
+
+// changed tells whether the workflow runs with the change
+func changed(ctx workflow.Context, changeID string) bool {
+	return workflow.GetVersion(ctx, changeID, workflow.DefaultVersion, 1) == 1
 }
 
 func NewService(ledgerSvc *ledger.Service, temporalClient client.Client) *Service {
 	return &Service{LedgerSvc: ledgerSvc, temporalClient: temporalClient}
 }
 
+// DecisionQuery is the query returning the AuthorizationDecision of an Authorization workflow
+const DecisionQuery = "decision"
+
+// RequestQuery is the query returning the AuthorizationDecision on a request changing the authorization, by the id of
+// the request. It's pending until the workflow handled the request.
+const RequestQuery = "request"
+
+type DecisionStatus string
+
+const (
+	DecisionPending  DecisionStatus = "pending"
+	DecisionApproved DecisionStatus = "approved"
+	DecisionDeclined DecisionStatus = "declined"
+	// DecisionFailed authorizations could be neither approved nor declined
+	DecisionFailed DecisionStatus = "failed"
+)
+
+// AuthorizationDecision tells whether the hold of the authorization was placed, or why it was declined
+type AuthorizationDecision struct {
+	Status        DecisionStatus
+	DeclineReason ledger.DeclineReason
+}
+
+type IncrementSignal struct {
+	ID string
+	// HoldID of the further pending transfer, generated when empty
+	HoldID uuid.UUID
+	// Amount to add to the authorization hold
+	Amount uint64
+	// MerchantAmount is the increment in the merchant currency of an authorization in a foreign currency
+	MerchantAmount uint64
+}
+
+type ReversalSignal struct {
+	ID string
+	// ReversalID is the request reversing the authorization, a signal sent again for it is ignored
+	ReversalID uuid.UUID
+	// Amount to release from the authorization hold, zero reverses the whole authorization
+	Amount uint64
+	// MerchantAmount is the amount released in the merchant currency of an authorization in a foreign currency
+	MerchantAmount uint64
+}
+
+// hold is a pending ledger transfer backing the authorization
+type hold struct {
+	ID     uuid.UUID
+	Amount uint64
+}
+
+// PresentmentMatch is the authorization a presentment matched
+type PresentmentMatch struct {
+	AuthorizationID uuid.UUID
+	// Expired authorizations have no hold left, the presentment posts a fresh transfer for them
+	Expired bool
+	// DeclineReason is set when the presentment exceeds the authorization beyond the over-presentment tolerance and is
+	// declined, the authorization is left as it was
+	DeclineReason ledger.DeclineReason
+}
+
 type PresentmentSignal struct {
 	ID string
+	// PresentmentID is the presentment clearing the authorization, a signal sent again for it is ignored
+	PresentmentID uuid.UUID
+	// Amount presented, above the authorized amount for an over-presentment
+	Amount uint64
+	// MerchantAmount is presented instead of the amount for an authorization in a foreign currency,
+	// SettlementRate converts it to the account currency at presentment
+	MerchantAmount uint64
+	SettlementRate *fx.Rate
+	// Flagged presentments exceed the authorization beyond the over-presentment tolerance
+	Flagged bool
+	// Final clearings settle the authorization, the rest of the hold is released. Other clearings post their amount
+	// and leave the rest held.
+	Final bool
 }
 
-func (s *Service) Authorization(ctx workflow.Context, paymentDetails *PaymentDetails) error {
+func (s *Service) Authorization(ctx workflow.Context, paymentDetails *PaymentDetails) (err error) {
 	// RetryPolicy specifies how to automatically handle retries if an Activity fails.
 	retrypolicy := &temporal.RetryPolicy{
 		InitialInterval: time.Second,
@@ -47,92 +207,336 @@ func (s *Service) Authorization(ctx workflow.Context, paymentDetails *PaymentDet
 		RetryPolicy:         retrypolicy,
 	}
 
+	var merchantAmount uint64
+	if paymentDetails.FX != nil {
+		merchantAmount = paymentDetails.FX.MerchantAmount.Value
+	}
+
 	// workflow id would be the transaction id
 	req := &ledger.TransferReq{
 		ID:              paymentDetails.WorkflowID,
 		DebitAccountID:  paymentDetails.SourceAccount,
 		CreditAccountID: paymentDetails.TargetAccount,
 		Amount:          paymentDetails.Amount,
+		Conversion:      paymentDetails.conversion(merchantAmount),
+	}
+
+	// the caller waits for the decision, the ledger alone decides if the balance is enough
+	decision := AuthorizationDecision{Status: DecisionPending}
+	err = workflow.SetQueryHandler(ctx, DecisionQuery, func() (AuthorizationDecision, error) {
+		return decision, nil
+	})
+	if err != nil {
+		return err
 	}
+	defer func() {
+		if err != nil && decision.Status == DecisionPending {
+			decision.Status = DecisionFailed
+		}
+		if err != nil && changed(ctx, changeSpendRelease) {
+			// the authorization may not be recorded, its spend control reservation mustn't count against the limits
+			releaseErr := workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.ReleaseSpend, paymentDetails.WorkflowID).Get(ctx, nil)
+			if releaseErr != nil {
+				workflow.GetLogger(ctx).Error("error releasing spend reservation", "id", paymentDetails.WorkflowID.String(), "error", releaseErr)
+			}
+		}
+	}()
 
-	err := workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), s.LedgerSvc.FreezeAmount, req).Get(ctx, nil)
+	// the callers of increments and reversals wait for them too
+	requests := map[uuid.UUID]AuthorizationDecision{}
+	err = workflow.SetQueryHandler(ctx, RequestQuery, func(id uuid.UUID) (AuthorizationDecision, error) {
+		if d, ok := requests[id]; ok {
+			return d, nil
+		}
+		return AuthorizationDecision{Status: DecisionPending}, nil
+	})
 	if err != nil {
 		return err
 	}
 
+	// the caller gave up on the decision, the authorization isn't approved after it
+	late := func() bool {
+		return !paymentDetails.DecisionDeadline.IsZero() && workflow.Now(ctx).After(paymentDetails.DecisionDeadline)
+	}
+
+	if late() {
+		err = temporal.NewNonRetryableApplicationError("decision deadline exceeded", "decision_timeout", nil, ledger.DeclineReasonDecisionTimeout)
+	} else if changed(ctx, changeAccountStatus) {
+		err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), s.CheckAccountActivity, paymentDetails.SourceAccount, true).Get(ctx, nil)
+	}
+	if err == nil {
+		err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), s.LedgerSvc.FreezeAmount, req).Get(ctx, nil)
+	}
+	if reason := ledger.DeclineReasonOf(err); reason != "" && changed(ctx, changeLedgerDeclines) {
+		// the ledger refused the hold, the authorization is declined rather than failed
+		decision = AuthorizationDecision{Status: DecisionDeclined, DeclineReason: reason}
+		return workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.InsertNewTransferWithProgress, paymentDetails.DeclinedTransfer(reason)).Get(ctx, nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	expiry := paymentDetails.Expiry
+	if expiry <= 0 {
+		expiry = defaultAuthorizationExpiry
+	}
+	expiresAt := workflow.Now(ctx).Add(expiry)
+
 	// insert it into external db
 	tnsfer := db.TransferReq{
-		ID:              paymentDetails.WorkflowID,
-		DebitAccountID:  paymentDetails.SourceAccount,
-		CreditAccountID: paymentDetails.TargetAccount,
-		Amount:          paymentDetails.Amount,
+		ID:                   paymentDetails.WorkflowID,
+		DebitAccountID:       paymentDetails.SourceAccount,
+		CreditAccountID:      paymentDetails.TargetAccount,
+		Amount:               paymentDetails.Amount.Value,
+		MerchantCategoryCode: paymentDetails.MerchantCategoryCode,
+		ExpiresAt:            &expiresAt,
+		MerchantAmount:       merchantAmount,
+		CardID:               paymentDetails.CardID,
+		References:           paymentDetails.References,
+		OverPresentment:      paymentDetails.OverPresentment,
+	}
+	if paymentDetails.FX != nil {
+		tnsfer.MerchantCurrency = paymentDetails.FX.MerchantAmount.Currency
+		tnsfer.FXRate = &paymentDetails.FX.Rate.Value
 	}
 
-	err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.InsertNewTransfer, tnsfer).Get(ctx, nil)
-	if err != nil {
-		// unfreeze the amount
-		var cancelID uuid.UUID
-		err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), uuid.NewV4).Get(ctx, &cancelID)
-		if err != nil {
-			tnsfer.Progress = db.TransferProgressFailedOnLedgerCancellation
-			// update the flag in external db
-			err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.InsertNewTransferWithProgress, tnsfer).Get(ctx, nil)
-			if err != nil {
-				return err
+	var reason ledger.DeclineReason
+	if late() {
+		// the hold was placed after the caller gave up
+		reason = ledger.DeclineReasonDecisionTimeout
+	} else if changed(ctx, changeStatusRecheck) {
+		// the account may have been frozen or closed since the first check, a closure in progress is waited for
+		err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), s.CheckAccountActivity, paymentDetails.SourceAccount, true).Get(ctx, nil)
+		reason = ledger.DeclineReasonOf(err)
+		if err != nil && reason == "" {
+			decision.Status = DecisionFailed
+			if _, releaseErr := s.releaseHold(workflow.WithActivityOptions(ctx, options), req, tnsfer); releaseErr != nil {
+				return releaseErr
 			}
 			return err
 		}
-
-		err := workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), s.LedgerSvc.CancelTransaction, req.ID, cancelID).Get(ctx, nil)
-		if err != nil {
-			tnsfer.Progress = db.TransferProgressFailedOnLedgerCancellation
-			// update the flag in external db
-			err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.InsertNewTransferWithProgress, tnsfer).Get(ctx, nil)
-			if err != nil {
-				return err
-			}
+	}
+	if reason != "" {
+		// the hold is released and the authorization declined
+		released, err := s.releaseHold(workflow.WithActivityOptions(ctx, options), req, tnsfer)
+		if !released {
+			decision.Status = DecisionFailed
 			return err
-
 		}
+		decision = AuthorizationDecision{Status: DecisionDeclined, DeclineReason: reason}
+		return workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.InsertNewTransferWithProgress,
+			paymentDetails.DeclinedTransfer(reason)).Get(ctx, nil)
+	}
+
+	err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.InsertNewTransfer, tnsfer).Get(ctx, nil)
+	if err != nil {
+		decision.Status = DecisionFailed
+
+		// unfreeze the amount
+		_, err = s.releaseHold(workflow.WithActivityOptions(ctx, options), req, tnsfer)
 		return err
 	}
 
+	decision.Status = DecisionApproved
+
+	recordLedgerTransfer(workflow.WithActivityOptions(ctx, options), req.ID, req.ID, uuid.Nil)
+
+	// the original hold, incremental authorizations add further holds
+	holds := []hold{{ID: req.ID, Amount: req.Amount.Value}}
+	authorizedAmount := req.Amount.Value
+
+	var reversedAmount uint64
+
+	// what the clearings before the final one posted of the holds, and what the customer paid for them
+	var clearedAmount, clearedMerchantAmount, paidAmount uint64
+	var clearings, reversals []uuid.UUID
+
 	var signal PresentmentSignal
-	var timedOut = false
+	var increment IncrementSignal
+	var reversal ReversalSignal
+	var timedOut, presented, incremented, reversalRequested, reversed = false, false, false, false, false
 
 	presentmentChan := workflow.GetSignalChannel(ctx, fmt.Sprintf("presentment-%s", tnsfer.ID.String()))
+	incrementChan := workflow.GetSignalChannel(ctx, fmt.Sprintf("increment-%s", tnsfer.ID.String()))
+	reversalChan := workflow.GetSignalChannel(ctx, fmt.Sprintf("reversal-%s", tnsfer.ID.String()))
 
 	futureCtx, futureCancel := workflow.WithCancel(ctx)
 	defer futureCancel()
-	timeoutFuture := workflow.NewTimer(futureCtx, 100*time.Second)
+	timeoutFuture := workflow.NewTimer(futureCtx, expiresAt.Sub(workflow.Now(ctx)))
 	selector := workflow.NewSelector(ctx)
 	selector.AddReceive(presentmentChan, func(channel workflow.ReceiveChannel, more bool) {
+		signal = PresentmentSignal{}
 		channel.Receive(ctx, &signal)
+		presented = true
+	})
+	selector.AddReceive(incrementChan, func(channel workflow.ReceiveChannel, more bool) {
+		channel.Receive(ctx, &increment)
+		incremented = true
+	})
+	selector.AddReceive(reversalChan, func(channel workflow.ReceiveChannel, more bool) {
+		channel.Receive(ctx, &reversal)
+		reversalRequested = true
 	})
 	selector.AddFuture(timeoutFuture, func(future workflow.Future) {
 		_ = future.Get(futureCtx, nil)
 		timedOut = true
 	})
 
-	// wait for presentment signal or timeout
-	selector.Select(ctx)
+	// wait for the final presentment signal, reversal or timeout, adjusting the hold on every increment, partial
+	// reversal and partial clearing
+	for {
+		selector.Select(ctx)
 
-	switch {
-	case timedOut, len(signal.ID) > 0 && signal.ID != req.ID.String(): // got the invalid signal transaction id. This case should never happen ideally
-		// cancel the transaction
+		if presented {
+			presented = false
+			if signal.ID != req.ID.String() || signal.Final || !changed(ctx, changeMultiClearing) {
+				break
+			}
+			if handled(clearings, signal.PresentmentID) {
+				continue
+			}
 
-		var cancelID uuid.UUID
-		err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), uuid.NewV4).Get(ctx, &cancelID)
-		if err != nil {
-			// update the flag in external db
-			err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateTransferProgress, req.ID, db.TransferProgressFailedOnLedgerTimeout, nil).Get(ctx, nil)
+			captureAmount, captureMerchantAmount := signal.Amount, signal.MerchantAmount
+			if paymentDetails.FX != nil {
+				// the merchant amount is captured at the authorization rate, a different rate at presentment is adjusted after
+				captureAmount = authorizedAmount
+				if captureMerchantAmount > 0 && captureMerchantAmount < merchantAmount {
+					converted, err := paymentDetails.FX.Rate.Convert(money.New(captureMerchantAmount, paymentDetails.FX.MerchantAmount.Currency))
+					if err != nil {
+						workflow.GetLogger(ctx).Error("error converting presented amount", "id", req.ID.String(), "error", err)
+					} else {
+						captureAmount = converted.Value
+					}
+				}
+			}
+			// a clearing of all that is held is the last one
+			if captureAmount == 0 || captureAmount >= authorizedAmount {
+				break
+			}
+
+			holds, err = s.captureHolds(workflow.WithActivityOptions(ctx, options), req.ID, holds, captureAmount)
 			if err != nil {
+				// update the flag in external db, the workflow fails with the ledger error
+				updateErr := workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateTransferProgress, req.ID, db.TransferProgressFailedOnLedgerSettlement, nil).Get(ctx, nil)
+				if updateErr != nil {
+					return updateErr
+				}
 				return err
 			}
+
+			paid := captureAmount
+			if paymentDetails.FX != nil && signal.SettlementRate != nil {
+				paid = s.adjustFXSettlement(workflow.WithActivityOptions(ctx, options), paymentDetails, captureAmount, captureMerchantAmount, *signal.SettlementRate)
+			}
+
+			clearings = append(clearings, signal.PresentmentID)
+			authorizedAmount -= captureAmount
+			merchantAmount -= captureMerchantAmount
+			clearedAmount += captureAmount
+			clearedMerchantAmount += captureMerchantAmount
+			paidAmount += paid
+
+			err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateSettledAmount, req.ID, paidAmount).Get(ctx, nil)
+			if err != nil {
+				workflow.GetLogger(ctx).Error("error recording partial clearing", "id", req.ID.String(), "error", err)
+			}
+			continue
+		}
+
+		if incremented {
+			incremented = false
+			if increment.ID != req.ID.String() || increment.Amount == 0 || hasHold(holds, increment.HoldID) {
+				continue
+			}
+
+			h, err := s.incrementHold(workflow.WithActivityOptions(ctx, options), paymentDetails, increment.HoldID, increment.Amount, increment.MerchantAmount)
+			if err != nil {
+				workflow.GetLogger(ctx).Error("error incrementing authorization", "id", req.ID.String(), "error", err)
+				requests[increment.HoldID] = refusal(err)
+				continue
+			}
+			requests[increment.HoldID] = AuthorizationDecision{Status: DecisionApproved}
+
+			holds = append(holds, h)
+			authorizedAmount += h.Amount
+			merchantAmount += increment.MerchantAmount
+			continue
+		}
+
+		if reversalRequested {
+			reversalRequested = false
+			if reversal.ID != req.ID.String() || handled(reversals, reversal.ReversalID) {
+				continue
+			}
+			reversals = append(reversals, reversal.ReversalID)
+
+			// full reversal, release everything right away
+			if reversal.Amount == 0 || reversal.Amount >= authorizedAmount {
+				reversed = true
+				break
+			}
+
+			holds, err = s.reduceHolds(workflow.WithActivityOptions(ctx, options), req.ID, holds, reversal.Amount)
+			if err != nil {
+				workflow.GetLogger(ctx).Error("error reversing authorization", "id", req.ID.String(), "error", err)
+				requests[reversal.ReversalID] = refusal(err)
+			} else {
+				requests[reversal.ReversalID] = AuthorizationDecision{Status: DecisionApproved}
+				if reversal.MerchantAmount < merchantAmount {
+					merchantAmount -= reversal.MerchantAmount
+				}
+			}
+
+			// the holds reflect what was actually released, even on error
+			remaining := totalHeld(holds)
+			reversedAmount += authorizedAmount - remaining
+			authorizedAmount = remaining
+
+			err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateReversedAmount, req.ID, authorizedAmount+clearedAmount, merchantAmount+clearedMerchantAmount, reversedAmount).Get(ctx, nil)
+			if err != nil {
+				workflow.GetLogger(ctx).Error("error recording reversal", "id", req.ID.String(), "error", err)
+			}
+			continue
+		}
+
+		break
+	}
+
+	switch {
+	case reversed:
+		err = s.cancelHolds(workflow.WithActivityOptions(ctx, options), req.ID, holds)
+		if err != nil {
+			requests[reversal.ReversalID] = refusal(err)
+			// update the flag in external db, the workflow fails with the ledger error
+			updateErr := workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateTransferProgress, req.ID, db.TransferProgressFailedOnLedgerCancellation, nil).Get(ctx, nil)
+			if updateErr != nil {
+				return updateErr
+			}
+			return err
+		}
+
+		requests[reversal.ReversalID] = AuthorizationDecision{Status: DecisionApproved}
+
+		// what was cleared is left on the authorization, which is then settled
+		err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateReversedAmount, req.ID, clearedAmount, clearedMerchantAmount, reversedAmount+authorizedAmount).Get(ctx, nil)
+		if err != nil {
 			return err
 		}
 
-		err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), s.LedgerSvc.CancelTransaction, req.ID, cancelID).Get(ctx, nil)
+		progress := db.TransferProgressReversed
+		if clearedAmount > 0 {
+			progress = db.TransferProgressSettled
+		}
+
+		// update the flag in external db
+		err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateTransferProgress, req.ID, progress, nil).Get(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+	case timedOut, len(signal.ID) > 0 && signal.ID != req.ID.String(): // got the invalid signal transaction id. This case should never happen ideally
+		// cancel the transaction
+		err = s.cancelHolds(workflow.WithActivityOptions(ctx, options), req.ID, holds)
 		if err != nil {
 			// update the flag in external db
 			err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateTransferProgress, req.ID, db.TransferProgressFailedOnLedgerTimeout, nil).Get(ctx, nil)
@@ -143,8 +547,13 @@ func (s *Service) Authorization(ctx workflow.Context, paymentDetails *PaymentDet
 			return err
 		}
 
-		// update the flag in external db
-		err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateTransferProgress, req.ID, db.TransferProgressSettled).Get(ctx, nil)
+		// the hold is released, a late presentment can still match the authorization and post it afresh. An
+		// authorization partially cleared is settled for what was cleared.
+		progress := db.TransferProgressExpired
+		if clearedAmount > 0 {
+			progress = db.TransferProgressSettled
+		}
+		err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateTransferProgress, req.ID, progress, nil).Get(ctx, nil)
 		if err != nil {
 			// update the flag in external db
 			err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateTransferProgress, req.ID, db.TransferProgressFailedOnExternalDB, nil).Get(ctx, nil)
@@ -156,23 +565,70 @@ func (s *Service) Authorization(ctx workflow.Context, paymentDetails *PaymentDet
 		}
 
 	case len(signal.ID) > 0 && signal.ID == req.ID.String():
-		// settle the transaction
-		var settlementID uuid.UUID
-		err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), uuid.NewV4).Get(ctx, &settlementID)
+		// settle the transaction, the final clearing
+		// partial capture: post only the presented amount, the rest of the hold is released
+		settledAmount := signal.Amount
+		presentedMerchantAmount := signal.MerchantAmount
+
+		// over-presentment: the holds are posted in full and the difference in a transfer of its own
+		var overAmount, overMerchantAmount uint64
+		if paymentDetails.FX == nil && settledAmount > authorizedAmount {
+			overAmount = settledAmount - authorizedAmount
+		}
+		if paymentDetails.FX != nil && presentedMerchantAmount > merchantAmount {
+			overMerchantAmount = presentedMerchantAmount - merchantAmount
+		}
+
+		if paymentDetails.FX != nil {
+			if presentedMerchantAmount == 0 || presentedMerchantAmount > merchantAmount {
+				presentedMerchantAmount = merchantAmount
+			}
+
+			// the presented merchant amount is settled at the authorization rate, a different rate at presentment is adjusted after
+			settledAmount = authorizedAmount
+			if presentedMerchantAmount < merchantAmount {
+				converted, err := paymentDetails.FX.Rate.Convert(money.New(presentedMerchantAmount, paymentDetails.FX.MerchantAmount.Currency))
+				if err != nil {
+					workflow.GetLogger(ctx).Error("error converting presented amount", "id", req.ID.String(), "error", err)
+				} else {
+					settledAmount = converted.Value
+				}
+			}
+		}
+		if settledAmount == 0 || settledAmount > authorizedAmount {
+			settledAmount = authorizedAmount
+		}
+
+		err = s.settleHolds(workflow.WithActivityOptions(ctx, options), req.ID, holds, settledAmount)
 		if err != nil {
 			// update the flag in external db
 			err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateTransferProgress, req.ID, db.TransferProgressFailedOnLedgerSettlement, nil).Get(ctx, nil)
 			if err != nil {
 				return err
 			}
-
 			return err
 		}
 
-		err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), s.LedgerSvc.SettleTransaction, req.ID, settlementID).Get(ctx, nil)
+		if paymentDetails.FX != nil && signal.SettlementRate != nil {
+			settledAmount = s.adjustFXSettlement(workflow.WithActivityOptions(ctx, options), paymentDetails, settledAmount, presentedMerchantAmount, *signal.SettlementRate)
+
+			err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateSettlementFXRate, req.ID, signal.SettlementRate.Value).Get(ctx, nil)
+			if err != nil {
+				workflow.GetLogger(ctx).Error("error recording settlement rate", "id", req.ID.String(), "error", err)
+			}
+		}
+
+		if (overAmount > 0 || overMerchantAmount > 0) && changed(ctx, changeOverPresentment) {
+			s.postOverPresentment(workflow.WithActivityOptions(ctx, options), paymentDetails, overAmount, overMerchantAmount, signal)
+		}
+
+		err = nil
+		if changed(ctx, changeSettledAmount) {
+			err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateSettledAmount, req.ID, paidAmount+settledAmount).Get(ctx, nil)
+		}
 		if err != nil {
 			// update the flag in external db
-			err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateTransferProgress, req.ID, db.TransferProgressFailedOnLedgerSettlement, nil).Get(ctx, nil)
+			err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateTransferProgress, req.ID, db.TransferProgressFailedOnExternalDB, nil).Get(ctx, nil)
 			if err != nil {
 				return err
 			}
@@ -180,7 +636,7 @@ func (s *Service) Authorization(ctx workflow.Context, paymentDetails *PaymentDet
 		}
 
 		// update the flag in external db
-		err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateTransferProgress, req.ID, db.TransferProgressSettled).Get(ctx, nil)
+		err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateTransferProgress, req.ID, db.TransferProgressSettled, nil).Get(ctx, nil)
 		if err != nil {
 			// update the flag in external db
 			err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateTransferProgress, req.ID, db.TransferProgressFailedOnExternalDB, nil).Get(ctx, nil)
@@ -194,6 +650,403 @@ func (s *Service) Authorization(ctx workflow.Context, paymentDetails *PaymentDet
 	return nil
 }
 
+// refusal returns the decision on a request the workflow couldn't apply, declined when the ledger or the account
+// status refused it
+func refusal(err error) AuthorizationDecision {
+	if reason := ledger.DeclineReasonOf(err); reason != "" {
+		return AuthorizationDecision{Status: DecisionDeclined, DeclineReason: reason}
+	}
+	return AuthorizationDecision{Status: DecisionFailed}
+}
+
+// releaseHold voids the hold of the authorization, the authorization is recorded as failed on cancellation when the
+// ledger doesn't void it. It tells whether the hold was voided, the error is the one recording the failure.
+func (s *Service) releaseHold(ctx workflow.Context, req *ledger.TransferReq, tnsfer db.TransferReq) (bool, error) {
+	var cancelID uuid.UUID
+	err := workflow.ExecuteActivity(ctx, uuid.NewV4).Get(ctx, &cancelID)
+	if err == nil {
+		err = workflow.ExecuteActivity(ctx, s.LedgerSvc.CancelTransaction, req.ID, cancelID).Get(ctx, nil)
+	}
+	if err == nil {
+		return true, nil
+	}
+
+	tnsfer.Progress = db.TransferProgressFailedOnLedgerCancellation
+	// update the flag in external db
+	return false, workflow.ExecuteActivity(ctx, db.InsertNewTransferWithProgress, tnsfer).Get(ctx, nil)
+}
+
+// incrementHold places a further pending transfer for the authorization and records it against the authorization
+func (s *Service) incrementHold(ctx workflow.Context, paymentDetails *PaymentDetails, holdID uuid.UUID, amount uint64, merchantAmount uint64) (hold, error) {
+	err := workflow.ExecuteActivity(ctx, s.CheckAccountActivity, paymentDetails.SourceAccount, true).Get(ctx, nil)
+	if err != nil {
+		return hold{}, err
+	}
+
+	if holdID == uuid.Nil {
+		err := workflow.ExecuteActivity(ctx, uuid.NewV4).Get(ctx, &holdID)
+		if err != nil {
+			return hold{}, err
+		}
+	}
+
+	err = workflow.ExecuteActivity(ctx, s.LedgerSvc.FreezeAmount, &ledger.TransferReq{
+		ID:              holdID,
+		DebitAccountID:  paymentDetails.SourceAccount,
+		CreditAccountID: paymentDetails.TargetAccount,
+		Amount:          money.New(amount, paymentDetails.Amount.Currency),
+		Conversion:      paymentDetails.conversion(merchantAmount),
+	}).Get(ctx, nil)
+	if err != nil {
+		return hold{}, err
+	}
+
+	h := hold{ID: holdID, Amount: amount}
+	if changed(ctx, changeStatusRecheck) {
+		// the account may have been frozen or closed while the hold was placed
+		err = workflow.ExecuteActivity(ctx, s.CheckAccountActivity, paymentDetails.SourceAccount, true).Get(ctx, nil)
+		if err != nil {
+			if cancelErr := s.cancelHolds(ctx, paymentDetails.WorkflowID, []hold{h}); cancelErr != nil {
+				return hold{}, cancelErr
+			}
+			return hold{}, err
+		}
+	}
+
+	err = workflow.ExecuteActivity(ctx, db.InsertAuthorizationIncrement, &db.IncrementReq{
+		ID:              holdID,
+		AuthorizationID: paymentDetails.WorkflowID,
+		Amount:          amount,
+		MerchantAmount:  merchantAmount,
+	}).Get(ctx, nil)
+	if err != nil {
+		// release the hold, the authorization can't reflect it
+		if cancelErr := s.cancelHolds(ctx, paymentDetails.WorkflowID, []hold{h}); cancelErr != nil {
+			return hold{}, cancelErr
+		}
+		return hold{}, err
+	}
+	recordLedgerTransfer(ctx, paymentDetails.WorkflowID, holdID, uuid.Nil)
+
+	return h, nil
+}
+
+// adjustFXSettlement charges or refunds the customer the difference between the presented merchant amount converted at
+// the settlement rate and the amount settled at the authorization rate, against the bank's FX account of the account
+// currency. It returns what the customer paid in the end. If the adjustment fails the bank bears the difference.
+func (s *Service) adjustFXSettlement(ctx workflow.Context, paymentDetails *PaymentDetails, settledAmount uint64, merchantAmount uint64, rate fx.Rate) uint64 {
+	presented, err := rate.Convert(money.New(merchantAmount, paymentDetails.FX.MerchantAmount.Currency))
+	if err != nil {
+		workflow.GetLogger(ctx).Error("error converting presented amount", "id", paymentDetails.WorkflowID.String(), "error", err)
+		return settledAmount
+	}
+	presentedAmount := presented.Value
+
+	if presentedAmount == settledAmount {
+		return settledAmount
+	}
+
+	var adjustmentID uuid.UUID
+	err = workflow.ExecuteActivity(ctx, uuid.NewV4).Get(ctx, &adjustmentID)
+	if err != nil {
+		workflow.GetLogger(ctx).Error("error adjusting fx settlement", "id", paymentDetails.WorkflowID.String(), "error", err)
+		return settledAmount
+	}
+
+	adjustment := &ledger.TransferReq{
+		ID:              adjustmentID,
+		DebitAccountID:  paymentDetails.SourceAccount,
+		CreditAccountID: paymentDetails.FX.SourceFXAccount,
+		Amount:          money.New(presentedAmount-settledAmount, paymentDetails.Amount.Currency),
+	}
+	if presentedAmount < settledAmount {
+		adjustment.DebitAccountID, adjustment.CreditAccountID = paymentDetails.FX.SourceFXAccount, paymentDetails.SourceAccount
+		adjustment.Amount = money.New(settledAmount-presentedAmount, paymentDetails.Amount.Currency)
+	}
+
+	err = workflow.ExecuteActivity(ctx, s.LedgerSvc.PostTransfer, adjustment).Get(ctx, nil)
+	if err != nil {
+		workflow.GetLogger(ctx).Error("error adjusting fx settlement", "id", paymentDetails.WorkflowID.String(), "error", err)
+		return settledAmount
+	}
+	recordLedgerTransfer(ctx, paymentDetails.WorkflowID, adjustmentID, uuid.Nil)
+
+	return presentedAmount
+}
+
+// postOverPresentment posts what the presentment exceeds the authorization by from the customer to the settlement
+// account, the holds being posted already. It's recorded as an over-presentment linked to the authorization, settled or
+// flagged, or declined with its reason when the ledger refuses it: the authorization is settled either way.
+func (s *Service) postOverPresentment(ctx workflow.Context, paymentDetails *PaymentDetails, amount uint64, merchantAmount uint64, signal PresentmentSignal) {
+	authID := paymentDetails.WorkflowID
+	tnsfer := &db.TransferReq{
+		// derived from the authorization, it's presented once
+		ID:                   uuid.NewV5(authID, "over-presentment"),
+		DebitAccountID:       paymentDetails.SourceAccount,
+		CreditAccountID:      paymentDetails.TargetAccount,
+		Amount:               amount,
+		Progress:             db.TransferProgressSettled,
+		Kind:                 db.TransferKindOverPresentment,
+		OriginalTransferID:   uuid.NullUUID{UUID: authID, Valid: true},
+		MerchantCategoryCode: paymentDetails.MerchantCategoryCode,
+		CardID:               paymentDetails.CardID,
+	}
+	if signal.Flagged {
+		tnsfer.Progress = db.TransferProgressFlaggedOverPresentment
+	}
+
+	if paymentDetails.FX != nil {
+		// the excess is converted at the rate of the presentment, there was no rate locked for it
+		rate := paymentDetails.FX.Rate
+		if signal.SettlementRate != nil {
+			rate = *signal.SettlementRate
+		}
+
+		converted, err := rate.Convert(money.New(merchantAmount, paymentDetails.FX.MerchantAmount.Currency))
+		if err != nil {
+			workflow.GetLogger(ctx).Error("error converting over-presentment", "id", authID.String(), "error", err)
+			return
+		}
+		tnsfer.Amount = converted.Value
+		tnsfer.MerchantCurrency = paymentDetails.FX.MerchantAmount.Currency
+		tnsfer.MerchantAmount = merchantAmount
+		tnsfer.FXRate = &rate.Value
+	}
+
+	err := workflow.ExecuteActivity(ctx, s.LedgerSvc.PostTransfer, &ledger.TransferReq{
+		ID:              tnsfer.ID,
+		DebitAccountID:  tnsfer.DebitAccountID,
+		CreditAccountID: tnsfer.CreditAccountID,
+		Amount:          money.New(tnsfer.Amount, paymentDetails.Amount.Currency),
+		Conversion:      paymentDetails.conversion(merchantAmount),
+	}).Get(ctx, nil)
+	if err != nil {
+		workflow.GetLogger(ctx).Error("error posting over-presentment", "id", authID.String(), "error", err)
+		reason := ledger.DeclineReasonOf(err)
+		if reason == "" {
+			return
+		}
+		tnsfer.Progress = db.TransferProgressDeclined
+		tnsfer.DeclineReason = string(reason)
+	}
+
+	err = workflow.ExecuteActivity(ctx, db.InsertNewTransferWithProgress, tnsfer).Get(ctx, nil)
+	if err != nil {
+		workflow.GetLogger(ctx).Error("error recording over-presentment", "id", authID.String(), "error", err)
+		return
+	}
+	if tnsfer.Progress != db.TransferProgressDeclined {
+		recordLedgerTransfer(ctx, tnsfer.ID, tnsfer.ID, uuid.Nil)
+	}
+}
+
+// DeclinedTransfer returns the transfer recording the authorization as declined for the reason, no hold was placed
+func (p *PaymentDetails) DeclinedTransfer(reason ledger.DeclineReason) *db.TransferReq {
+	tnsfer := &db.TransferReq{
+		ID:                   p.WorkflowID,
+		DebitAccountID:       p.SourceAccount,
+		CreditAccountID:      p.TargetAccount,
+		Amount:               p.Amount.Value,
+		Progress:             db.TransferProgressDeclined,
+		Kind:                 db.TransferKindAuthorization,
+		MerchantCategoryCode: p.MerchantCategoryCode,
+		CardID:               p.CardID,
+		DeclineReason:        string(reason),
+		References:           p.References,
+	}
+	// declined authorizations get no auth code
+	tnsfer.References.AuthCode = ""
+	if p.FX != nil {
+		tnsfer.MerchantCurrency = p.FX.MerchantAmount.Currency
+		tnsfer.MerchantAmount = p.FX.MerchantAmount.Value
+		tnsfer.FXRate = &p.FX.Rate.Value
+	}
+	return tnsfer
+}
+
+// recordLedgerTransfer keeps track of the ledger transfers booked for a transfer, so they can be looked up in the ledger.
+// It's bookkeeping only, a failure doesn't fail the money movement.
+func recordLedgerTransfer(ctx workflow.Context, transferID uuid.UUID, ledgerTransferID uuid.UUID, pendingID uuid.UUID) {
+	if !changed(ctx, changeLedgerTransfers) {
+		return
+	}
+
+	err := workflow.ExecuteActivity(ctx, db.InsertLedgerTransfer, &db.LedgerTransferReq{
+		ID:         ledgerTransferID,
+		TransferID: transferID,
+		PendingID:  uuid.NullUUID{UUID: pendingID, Valid: pendingID != uuid.Nil},
+	}).Get(ctx, nil)
+	if err != nil {
+		workflow.GetLogger(ctx).Error("error recording ledger transfer", "id", ledgerTransferID.String(), "error", err)
+	}
+}
+
+// settleHolds posts the amount across the holds in the order they were placed, holds left with nothing to post are voided
+func (s *Service) settleHolds(ctx workflow.Context, authID uuid.UUID, holds []hold, amount uint64) error {
+	for _, h := range holds {
+		if amount == 0 {
+			err := s.cancelHolds(ctx, authID, []hold{h})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		postAmount := h.Amount
+		if amount < postAmount {
+			postAmount = amount
+		}
+
+		var settlementID uuid.UUID
+		err := workflow.ExecuteActivity(ctx, uuid.NewV4).Get(ctx, &settlementID)
+		if err != nil {
+			return err
+		}
+
+		err = workflow.ExecuteActivity(ctx, s.LedgerSvc.SettleTransaction, h.ID, settlementID, postAmount).Get(ctx, nil)
+		if err != nil {
+			return err
+		}
+		recordLedgerTransfer(ctx, authID, settlementID, h.ID)
+		amount -= postAmount
+	}
+
+	return nil
+}
+
+// captureHolds posts the amount across the holds in the order they were placed and keeps the rest held: a hold posted
+// in part is replaced by a hold for what is left. The holds still in place are returned.
+func (s *Service) captureHolds(ctx workflow.Context, authID uuid.UUID, holds []hold, amount uint64) ([]hold, error) {
+	for amount > 0 && len(holds) > 0 {
+		first := holds[0]
+
+		var postID uuid.UUID
+		err := workflow.ExecuteActivity(ctx, uuid.NewV4).Get(ctx, &postID)
+		if err != nil {
+			return holds, err
+		}
+
+		if amount >= first.Amount {
+			err = workflow.ExecuteActivity(ctx, s.LedgerSvc.SettleTransaction, first.ID, postID, first.Amount).Get(ctx, nil)
+			if err != nil {
+				return holds, err
+			}
+			recordLedgerTransfer(ctx, authID, postID, first.ID)
+
+			holds = holds[1:]
+			amount -= first.Amount
+			continue
+		}
+
+		var newHoldID uuid.UUID
+		err = workflow.ExecuteActivity(ctx, uuid.NewV4).Get(ctx, &newHoldID)
+		if err != nil {
+			return holds, err
+		}
+
+		err = workflow.ExecuteActivity(ctx, s.LedgerSvc.CaptureTransaction, first.ID, postID, newHoldID, amount).Get(ctx, nil)
+		if err != nil {
+			return holds, err
+		}
+		recordLedgerTransfer(ctx, authID, postID, first.ID)
+		recordLedgerTransfer(ctx, authID, newHoldID, uuid.Nil)
+
+		holds[0] = hold{ID: newHoldID, Amount: first.Amount - amount}
+		amount = 0
+	}
+
+	return holds, nil
+}
+
+// reduceHolds releases the amount from the holds, latest first. A hold released in full is voided,
+// a partially released one is replaced by a hold for what is left. The holds still in place are returned.
+func (s *Service) reduceHolds(ctx workflow.Context, authID uuid.UUID, holds []hold, amount uint64) ([]hold, error) {
+	for amount > 0 && len(holds) > 0 {
+		last := holds[len(holds)-1]
+		if amount >= last.Amount {
+			err := s.cancelHolds(ctx, authID, []hold{last})
+			if err != nil {
+				return holds, err
+			}
+
+			holds = holds[:len(holds)-1]
+			amount -= last.Amount
+			continue
+		}
+
+		var voidID, newHoldID uuid.UUID
+		err := workflow.ExecuteActivity(ctx, uuid.NewV4).Get(ctx, &voidID)
+		if err != nil {
+			return holds, err
+		}
+
+		err = workflow.ExecuteActivity(ctx, uuid.NewV4).Get(ctx, &newHoldID)
+		if err != nil {
+			return holds, err
+		}
+
+		err = workflow.ExecuteActivity(ctx, s.LedgerSvc.ReduceTransaction, last.ID, voidID, newHoldID, last.Amount-amount).Get(ctx, nil)
+		if err != nil {
+			return holds, err
+		}
+		recordLedgerTransfer(ctx, authID, voidID, last.ID)
+		recordLedgerTransfer(ctx, authID, newHoldID, uuid.Nil)
+
+		holds[len(holds)-1] = hold{ID: newHoldID, Amount: last.Amount - amount}
+		amount = 0
+	}
+
+	return holds, nil
+}
+
+// hasHold tells if the hold is already part of the authorization, so a replayed increment isn't held twice
+func hasHold(holds []hold, id uuid.UUID) bool {
+	for _, h := range holds {
+		if id != uuid.Nil && h.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// handled tells if the request with the id, a clearing or a reversal, was already applied to the authorization, so a
+// replayed signal isn't applied twice. Requests without an id are always applied.
+func handled(ids []uuid.UUID, id uuid.UUID) bool {
+	for _, c := range ids {
+		if id != uuid.Nil && c == id {
+			return true
+		}
+	}
+	return false
+}
+
+func totalHeld(holds []hold) uint64 {
+	var total uint64
+	for _, h := range holds {
+		total += h.Amount
+	}
+	return total
+}
+
+// cancelHolds voids all the holds
+func (s *Service) cancelHolds(ctx workflow.Context, authID uuid.UUID, holds []hold) error {
+	for _, h := range holds {
+		var cancelID uuid.UUID
+		err := workflow.ExecuteActivity(ctx, uuid.NewV4).Get(ctx, &cancelID)
+		if err != nil {
+			return err
+		}
+
+		err = workflow.ExecuteActivity(ctx, s.LedgerSvc.CancelTransaction, h.ID, cancelID).Get(ctx, nil)
+		if err != nil {
+			return err
+		}
+		recordLedgerTransfer(ctx, authID, cancelID, h.ID)
+	}
+
+	return nil
+}
+
 func (s *Service) Presentment(ctx workflow.Context, req *PaymentDetails) error {
 
 	// RetryPolicy specifies how to automatically handle retries if an Activity fails.
@@ -208,10 +1061,251 @@ func (s *Service) Presentment(ctx workflow.Context, req *PaymentDetails) error {
 		RetryPolicy:         retrypolicy,
 	}
 
-	err := workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), s.SignalActivity, req).Get(ctx, nil)
+	if changed(ctx, changeAccountStatus) {
+		// only a closed account refuses the presentment, like a credit: a frozen one still clears its authorizations
+		err := workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), s.CheckAccountActivity, req.SourceAccount, false).Get(ctx, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	var match *PresentmentMatch
+	err := workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), s.SignalActivity, req).Get(ctx, &match)
+	if err != nil || !changed(ctx, changePresentmentMatch) {
+		return err
+	}
+
+	switch {
+	case match == nil:
+		return s.forcePost(workflow.WithActivityOptions(ctx, options), req)
+	case match.DeclineReason != "":
+		return s.declinePresentment(workflow.WithActivityOptions(ctx, options), req, match)
+	case match.Expired:
+		return s.settleExpired(workflow.WithActivityOptions(ctx, options), req, match.AuthorizationID)
+	}
+
+	return nil
+}
+
+// forcePost records a presentment matching no authorization as its own transfer, posted right away
+func (s *Service) forcePost(ctx workflow.Context, req *PaymentDetails) error {
+	tnsfer := &db.TransferReq{
+		ID:                   req.WorkflowID,
+		DebitAccountID:       req.SourceAccount,
+		CreditAccountID:      req.TargetAccount,
+		Amount:               req.Amount.Value,
+		Progress:             db.TransferProgressUnmatchedForcePost,
+		Kind:                 db.TransferKindPresentment,
+		MerchantCategoryCode: req.MerchantCategoryCode,
+		CardID:               req.CardID,
+		References:           req.References,
+	}
+	if req.FX != nil {
+		tnsfer.MerchantCurrency = req.FX.MerchantAmount.Currency
+		tnsfer.MerchantAmount = req.FX.MerchantAmount.Value
+		tnsfer.FXRate = &req.FX.Rate.Value
+	}
+
+	// matching no authorization, the presentment is a new debit
+	var amount, overdrawn uint64
+	var err error
+	if changed(ctx, changeForcePostStatus) {
+		err = workflow.ExecuteActivity(ctx, s.CheckAccountActivity, req.SourceAccount, true).Get(ctx, nil)
+	}
+	if err == nil {
+		amount, overdrawn, err = s.postPresentment(ctx, req, req.WorkflowID)
+	}
+	if reason := ledger.DeclineReasonOf(err); reason != "" {
+		tnsfer.Progress = db.TransferProgressFailedForcePost
+		tnsfer.DeclineReason = string(reason)
+		if insertErr := workflow.ExecuteActivity(ctx, db.InsertNewTransferWithProgress, tnsfer).Get(ctx, nil); insertErr != nil {
+			workflow.GetLogger(ctx).Error("error recording failed force post", "id", req.WorkflowID.String(), "error", insertErr)
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	tnsfer.Amount, tnsfer.OverdrawnAmount = amount, overdrawn
+	return workflow.ExecuteActivity(ctx, db.InsertNewTransferWithProgress, tnsfer).Get(ctx, nil)
+}
+
+// declinePresentment records the presentment as declined, linked to the authorization it matched, and fails with the
+// reason of the decline
+func (s *Service) declinePresentment(ctx workflow.Context, req *PaymentDetails, match *PresentmentMatch) error {
+	tnsfer := &db.TransferReq{
+		ID:                 req.WorkflowID,
+		DebitAccountID:     req.SourceAccount,
+		CreditAccountID:    req.TargetAccount,
+		Amount:             req.Amount.Value,
+		Progress:           db.TransferProgressDeclined,
+		Kind:               db.TransferKindPresentment,
+		OriginalTransferID: uuid.NullUUID{UUID: match.AuthorizationID, Valid: true},
+		CardID:             req.CardID,
+		DeclineReason:      string(match.DeclineReason),
+		References:         req.References,
+	}
+	if req.FX != nil {
+		tnsfer.MerchantCurrency = req.FX.MerchantAmount.Currency
+		tnsfer.MerchantAmount = req.FX.MerchantAmount.Value
+		tnsfer.FXRate = &req.FX.Rate.Value
+	}
+
+	err := workflow.ExecuteActivity(ctx, db.InsertNewTransferWithProgress, tnsfer).Get(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	return temporal.NewNonRetryableApplicationError(fmt.Sprintf("presentment declined: %s", match.DeclineReason), "declined", nil, match.DeclineReason)
+}
+
+// settleExpired settles an authorization that expired before its presentment: its hold is gone, so the presentment is
+// posted afresh. When the ledger refuses it, the authorization is left expired to be matched again.
+func (s *Service) settleExpired(ctx workflow.Context, req *PaymentDetails, authID uuid.UUID) error {
+	amount, overdrawn, err := s.postPresentment(ctx, req, authID)
+	if err != nil {
+		if updateErr := workflow.ExecuteActivity(ctx, db.UpdateTransferProgress, authID, db.TransferProgressExpired, nil).Get(ctx, nil); updateErr != nil {
+			workflow.GetLogger(ctx).Error("error releasing expired authorization", "id", authID.String(), "error", updateErr)
+		}
+		return err
+	}
+
+	if req.FX != nil {
+		err = workflow.ExecuteActivity(ctx, db.UpdateSettlementFXRate, authID, req.FX.Rate.Value).Get(ctx, nil)
+		if err != nil {
+			workflow.GetLogger(ctx).Error("error recording settlement rate", "id", authID.String(), "error", err)
+		}
+	}
+
+	if overdrawn > 0 {
+		err = workflow.ExecuteActivity(ctx, db.UpdateOverdrawnAmount, authID, overdrawn).Get(ctx, nil)
+		if err != nil {
+			workflow.GetLogger(ctx).Error("error recording overdrawn amount", "id", authID.String(), "error", err)
+		}
+	}
+
+	err = workflow.ExecuteActivity(ctx, db.UpdateSettledAmount, authID, amount).Get(ctx, nil)
+	if err == nil {
+		err = workflow.ExecuteActivity(ctx, db.UpdateTransferProgress, authID, db.TransferProgressSettled, nil).Get(ctx, nil)
+	}
+	if err != nil {
+		if updateErr := workflow.ExecuteActivity(ctx, db.UpdateTransferProgress, authID, db.TransferProgressFailedOnExternalDB, nil).Get(ctx, nil); updateErr != nil {
+			return updateErr
+		}
+		return err
+	}
+
+	return nil
+}
+
+// postPresentment posts the presentment from the customer to the settlement account without a hold, in a ledger
+// transfer with the id of the presentment workflow recorded against the transfer. When the presentment has a
+// collections account, what the customer lacks is credited from it in the same linked chain, the customer then owes it
+// to the bank. It returns the amount posted in the account currency and the amount overdrawn.
+func (s *Service) postPresentment(ctx workflow.Context, req *PaymentDetails, transferID uuid.UUID) (uint64, uint64, error) {
+	// the presentment is in the merchant currency, converted at the rate of the day
+	amount := req.Amount
+	if req.FX != nil {
+		var err error
+		amount, err = req.FX.Rate.Convert(req.FX.MerchantAmount)
+		if err != nil {
+			return 0, 0, temporal.NewNonRetryableApplicationError(err.Error(), "conversion", err)
+		}
+	}
+
+	transferReq := &ledger.TransferReq{
+		ID:              req.WorkflowID,
+		DebitAccountID:  req.SourceAccount,
+		CreditAccountID: req.TargetAccount,
+		Amount:          amount,
+		Conversion:      req.conversion(req.Amount.Value),
+	}
+
+	if req.CollectionsAccount == 0 {
+		err := workflow.ExecuteActivity(ctx, s.LedgerSvc.PostTransfer, transferReq).Get(ctx, nil)
+		if err != nil {
+			return 0, 0, err
+		}
+		recordLedgerTransfer(ctx, transferID, req.WorkflowID, uuid.Nil)
+		return amount.Value, 0, nil
+	}
+
+	// derived from the presentment so a retried workflow doesn't cover the shortfall twice
+	overdraftID := uuid.NewV5(req.WorkflowID, "collections")
+	var overdrawn uint64
+	err := workflow.ExecuteActivity(ctx, s.LedgerSvc.PostOverdrawnTransfer, transferReq, req.CollectionsAccount, overdraftID).Get(ctx, &overdrawn)
+	if err != nil {
+		return 0, 0, err
+	}
+	if overdrawn > 0 {
+		recordLedgerTransfer(ctx, transferID, overdraftID, uuid.Nil)
+	}
+	recordLedgerTransfer(ctx, transferID, req.WorkflowID, uuid.Nil)
+
+	return amount.Value, overdrawn, nil
+}
+
+// Refund credits the customer back from the settlement account, optionally against an original transaction
+func (s *Service) Refund(ctx workflow.Context, paymentDetails *PaymentDetails) error {
+	// RetryPolicy specifies how to automatically handle retries if an Activity fails.
+	retrypolicy := &temporal.RetryPolicy{
+		InitialInterval: time.Second,
+		MaximumInterval: 5 * time.Second,
+		MaximumAttempts: 5,
+	}
+
+	options := workflow.ActivityOptions{
+		StartToCloseTimeout: time.Minute, // maximum time of a single Activity execution
+		RetryPolicy:         retrypolicy,
+	}
+
+	// workflow id would be the transaction id
+	req := &ledger.TransferReq{
+		ID:              paymentDetails.WorkflowID,
+		DebitAccountID:  paymentDetails.SourceAccount,
+		CreditAccountID: paymentDetails.TargetAccount,
+		Amount:          paymentDetails.Amount,
+	}
+
+	err := workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), s.CheckAccountActivity, paymentDetails.TargetAccount, false).Get(ctx, nil)
+	if err == nil {
+		err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), s.LedgerSvc.PostTransfer, req).Get(ctx, nil)
+	}
+	if err != nil {
+		if paymentDetails.OriginalTransferID.Valid {
+			// release the amount reserved against the original transaction
+			_ = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateTransferProgress, paymentDetails.WorkflowID,
+				db.TransferProgressFailedOnLedgerSettlement, nil).Get(ctx, nil)
+		}
+		return err
+	}
+
+	if paymentDetails.OriginalTransferID.Valid {
+		// the refund was reserved before the workflow started, it's settled as soon as it's posted
+		err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.UpdateTransferProgress, paymentDetails.WorkflowID,
+			db.TransferProgressSettled, nil).Get(ctx, nil)
+		if err != nil {
+			return err
+		}
+		recordLedgerTransfer(workflow.WithActivityOptions(ctx, options), req.ID, req.ID, uuid.Nil)
+		return nil
+	}
+
+	// insert it into external db, the refund is settled as soon as it's posted
+	err = workflow.ExecuteActivity(workflow.WithActivityOptions(ctx, options), db.InsertNewTransferWithProgress, &db.TransferReq{
+		ID:                 paymentDetails.WorkflowID,
+		DebitAccountID:     paymentDetails.SourceAccount,
+		CreditAccountID:    paymentDetails.TargetAccount,
+		Amount:             paymentDetails.Amount.Value,
+		Progress:           db.TransferProgressSettled,
+		Kind:               db.TransferKindRefund,
+		OriginalTransferID: paymentDetails.OriginalTransferID,
+	}).Get(ctx, nil)
 	if err != nil {
 		return err
 	}
+	recordLedgerTransfer(workflow.WithActivityOptions(ctx, options), req.ID, req.ID, uuid.Nil)
 
 	return nil
 }
@@ -0,0 +1,386 @@
+package workflow
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"encore.dev/storage/sqldb"
+	"encore.dev/types/uuid"
+	"github.com/stretchr/testify/mock"
+	tb_types "github.com/tigerbeetledb/tigerbeetle-go/pkg/types"
+	"go.temporal.io/sdk/temporal"
+	"go.temporal.io/sdk/testsuite"
+
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/ledger"
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/money"
+	"github.com/ohmpatel1997/pave-coding-challenge-simon/transfer/db"
+)
+
+const (
+	testCustomer   = 10
+	testSettlement = 2
+	testSuspense   = 401
+	testCollection = 601
+)
+
+// newTestService returns a workflow service on a memory ledger, the customer holding 1000 USD and the settlement
+// account able to take 2000
+func newTestService(t *testing.T) *Service {
+	t.Helper()
+
+	chart, err := ledger.NewChartOfAccounts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := ledger.NewLedgerService(ledger.NewMemoryBackend(), chart)
+
+	accounts := []struct {
+		id      uint64
+		accType string
+	}{
+		{testCustomer, "customer"},
+		{testSettlement, "settlement"},
+		{testSuspense, "suspense"},
+		{testCollection, "collections_receivable"},
+	}
+	for _, acc := range accounts {
+		accType, err := chart.AccountType(acc.accType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := l.CreateAccount(acc.id, accType, "USD", tb_types.Uint128{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	funding := []*ledger.TransferReq{
+		{ID: uuid.Must(uuid.NewV4()), DebitAccountID: testSuspense, CreditAccountID: testCustomer, Amount: money.New(1000, "USD")},
+		{ID: uuid.Must(uuid.NewV4()), DebitAccountID: testSettlement, CreditAccountID: testSuspense, Amount: money.New(2000, "USD")},
+	}
+	for _, req := range funding {
+		if err := l.PostTransfer(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return &Service{LedgerSvc: l}
+}
+
+// testDB keeps what the workflows record in the transfers table
+type testDB struct {
+	progress  map[uuid.UUID]db.TransferProgress
+	settled   map[uuid.UUID]uint64
+	reversed  map[uuid.UUID]uint64
+	overdrawn map[uuid.UUID]uint64
+}
+
+// newTestEnv returns a workflow environment running the ledger activities of the service, the account status always
+// allowing the transfer and the database activities recorded in the returned testDB
+func newTestEnv(t *testing.T, s *Service) (*testsuite.TestWorkflowEnvironment, *testDB) {
+	t.Helper()
+
+	var suite testsuite.WorkflowTestSuite
+	env := suite.NewTestWorkflowEnvironment()
+	env.RegisterWorkflow(s.Authorization)
+	env.RegisterWorkflow(s.Presentment)
+
+	env.RegisterActivity(uuid.NewV4)
+	env.RegisterActivity(s.LedgerSvc.FreezeAmount)
+	env.RegisterActivity(s.LedgerSvc.PostTransfer)
+	env.RegisterActivity(s.LedgerSvc.SettleTransaction)
+	env.RegisterActivity(s.LedgerSvc.CancelTransaction)
+	env.RegisterActivity(s.LedgerSvc.ReduceTransaction)
+	env.RegisterActivity(s.LedgerSvc.CaptureTransaction)
+	env.RegisterActivity(s.LedgerSvc.PostOverdrawnTransfer)
+
+	d := &testDB{
+		progress:  map[uuid.UUID]db.TransferProgress{},
+		settled:   map[uuid.UUID]uint64{},
+		reversed:  map[uuid.UUID]uint64{},
+		overdrawn: map[uuid.UUID]uint64{},
+	}
+
+	env.OnActivity(s.CheckAccountActivity, mock.Anything, mock.Anything, mock.Anything).Return(nil)
+	env.OnActivity(db.InsertNewTransfer, mock.Anything).Return(func(req *db.TransferReq) error {
+		d.progress[req.ID] = db.TransferProgressInitiated
+		return nil
+	})
+	env.OnActivity(db.InsertNewTransferWithProgress, mock.Anything).Return(func(req *db.TransferReq) error {
+		d.progress[req.ID] = req.Progress
+		return nil
+	})
+	env.OnActivity(db.UpdateTransferProgress, mock.Anything, mock.Anything, mock.Anything).Return(func(id uuid.UUID, progress db.TransferProgress, _ *sqldb.Tx) error {
+		d.progress[id] = progress
+		return nil
+	})
+	env.OnActivity(db.UpdateSettledAmount, mock.Anything, mock.Anything).Return(func(id uuid.UUID, amount uint64) error {
+		d.settled[id] = amount
+		return nil
+	})
+	env.OnActivity(db.UpdateReversedAmount, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(func(id uuid.UUID, _ uint64, _ uint64, reversed uint64) error {
+		d.reversed[id] = reversed
+		return nil
+	})
+	env.OnActivity(db.InsertAuthorizationIncrement, mock.Anything).Return(nil)
+	env.OnActivity(db.InsertLedgerTransfer, mock.Anything).Return(nil)
+	env.OnActivity(db.UpdateSettlementFXRate, mock.Anything, mock.Anything).Return(nil)
+	env.OnActivity(db.UpdateOverdrawnAmount, mock.Anything, mock.Anything).Return(func(id uuid.UUID, amount uint64) error {
+		d.overdrawn[id] = amount
+		return nil
+	})
+	env.OnActivity(db.ReleaseSpend, mock.Anything, mock.Anything).Return(nil)
+
+	return env, d
+}
+
+// authorization returns the payment details of an authorization of the customer for the amount
+func authorization(amount uint64) *PaymentDetails {
+	return &PaymentDetails{
+		WorkflowID:    uuid.Must(uuid.NewV4()),
+		SourceAccount: testCustomer,
+		TargetAccount: testSettlement,
+		Amount:        money.New(amount, "USD"),
+		Expiry:        time.Hour,
+	}
+}
+
+// signalAt sends the signal of the authorization after the delay
+func signalAt(env *testsuite.TestWorkflowEnvironment, delay time.Duration, name string, authID uuid.UUID, signal interface{}) {
+	env.RegisterDelayedCallback(func() {
+		env.SignalWorkflow(fmt.Sprintf("%s-%s", name, authID.String()), signal)
+	}, delay)
+}
+
+// assertDebits checks the pending and the posted debits of the account
+func assertDebits(t *testing.T, s *Service, id uint64, pending, posted uint64) {
+	t.Helper()
+
+	acc, err := s.LedgerSvc.GetAccount(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acc.DebitsPending != pending || acc.DebitsPosted != posted {
+		t.Errorf("account %d: pending %d posted %d, want %d and %d", id, acc.DebitsPending, acc.DebitsPosted, pending, posted)
+	}
+}
+
+// assertSettled checks the workflow completed and left the authorization settled for the amount
+func assertSettled(t *testing.T, env *testsuite.TestWorkflowEnvironment, d *testDB, authID uuid.UUID, amount uint64) {
+	t.Helper()
+
+	if !env.IsWorkflowCompleted() {
+		t.Fatal("workflow not completed")
+	}
+	if err := env.GetWorkflowError(); err != nil {
+		t.Fatal(err)
+	}
+	if d.progress[authID] != db.TransferProgressSettled || d.settled[authID] != amount {
+		t.Errorf("authorization %s settled for %d, want settled for %d", d.progress[authID], d.settled[authID], amount)
+	}
+}
+
+func TestAuthorizationIncrement(t *testing.T) {
+	s := newTestService(t)
+	env, d := newTestEnv(t, s)
+	auth := authorization(300)
+	holdID := uuid.Must(uuid.NewV4())
+
+	signalAt(env, time.Minute, "increment", auth.WorkflowID, IncrementSignal{ID: auth.WorkflowID.String(), HoldID: holdID, Amount: 200})
+	env.RegisterDelayedCallback(func() {
+		assertDebits(t, s, testCustomer, 500, 0)
+
+		res, err := env.QueryWorkflow(RequestQuery, holdID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decision AuthorizationDecision
+		if err := res.Get(&decision); err != nil {
+			t.Fatal(err)
+		}
+		if decision.Status != DecisionApproved {
+			t.Errorf("increment %s, want approved", decision.Status)
+		}
+	}, 2*time.Minute)
+	signalAt(env, 3*time.Minute, "presentment", auth.WorkflowID, PresentmentSignal{ID: auth.WorkflowID.String(), PresentmentID: uuid.Must(uuid.NewV4()), Amount: 450, Final: true})
+
+	env.ExecuteWorkflow(s.Authorization, auth)
+
+	assertSettled(t, env, d, auth.WorkflowID, 450)
+	// the presentment is posted across both holds, what is left of the increment is released
+	assertDebits(t, s, testCustomer, 0, 450)
+}
+
+func TestAuthorizationPartialReversal(t *testing.T) {
+	s := newTestService(t)
+	env, d := newTestEnv(t, s)
+	auth := authorization(500)
+
+	// a clearing of 200 leaves 300 held, the reversal releases 100 of it and the final clearing posts 150 of the rest
+	signalAt(env, time.Minute, "presentment", auth.WorkflowID, PresentmentSignal{ID: auth.WorkflowID.String(), PresentmentID: uuid.Must(uuid.NewV4()), Amount: 200})
+	signalAt(env, 2*time.Minute, "reversal", auth.WorkflowID, ReversalSignal{ID: auth.WorkflowID.String(), ReversalID: uuid.Must(uuid.NewV4()), Amount: 100})
+	env.RegisterDelayedCallback(func() {
+		assertDebits(t, s, testCustomer, 200, 200)
+	}, 150*time.Second)
+	signalAt(env, 3*time.Minute, "presentment", auth.WorkflowID, PresentmentSignal{ID: auth.WorkflowID.String(), PresentmentID: uuid.Must(uuid.NewV4()), Amount: 150, Final: true})
+
+	env.ExecuteWorkflow(s.Authorization, auth)
+
+	assertSettled(t, env, d, auth.WorkflowID, 350)
+	assertDebits(t, s, testCustomer, 0, 350)
+	if d.reversed[auth.WorkflowID] != 100 {
+		t.Errorf("reversed %d, want 100", d.reversed[auth.WorkflowID])
+	}
+}
+
+func TestAuthorizationReversalLedgerFailure(t *testing.T) {
+	s := newTestService(t)
+	env, d := newTestEnv(t, s)
+	auth := authorization(500)
+	reversalID := uuid.Must(uuid.NewV4())
+
+	env.OnActivity(s.LedgerSvc.CancelTransaction, mock.Anything, mock.Anything).Return(temporal.NewNonRetryableApplicationError("ledger unavailable", "ledger", nil))
+	signalAt(env, time.Minute, "reversal", auth.WorkflowID, ReversalSignal{ID: auth.WorkflowID.String(), ReversalID: reversalID})
+
+	env.ExecuteWorkflow(s.Authorization, auth)
+
+	// the workflow fails with the ledger error once the failure is recorded
+	if env.GetWorkflowError() == nil {
+		t.Error("workflow succeeded, want the ledger error")
+	}
+	if d.progress[auth.WorkflowID] != db.TransferProgressFailedOnLedgerCancellation {
+		t.Errorf("authorization %s, want %s", d.progress[auth.WorkflowID], db.TransferProgressFailedOnLedgerCancellation)
+	}
+
+	res, err := env.QueryWorkflow(RequestQuery, reversalID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decision AuthorizationDecision
+	if err := res.Get(&decision); err != nil {
+		t.Fatal(err)
+	}
+	if decision.Status != DecisionFailed {
+		t.Errorf("reversal %s, want failed", decision.Status)
+	}
+}
+
+func TestPresentmentExpiredAuthorization(t *testing.T) {
+	tests := []struct {
+		name          string
+		amount        uint64
+		collections   uint64
+		wantOverdrawn uint64
+	}{
+		{"within the balance", 400, 0, 0},
+		{"overdrawn into collections", 1200, testCollection, 200},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t)
+			env, d := newTestEnv(t, s)
+			authID := uuid.Must(uuid.NewV4())
+
+			// the authorization expired, its hold was released: the presentment posts it afresh
+			env.OnActivity(s.SignalActivity, mock.Anything, mock.Anything).Return(&PresentmentMatch{AuthorizationID: authID, Expired: true}, nil)
+
+			presentment := authorization(tt.amount)
+			presentment.CollectionsAccount = tt.collections
+			env.ExecuteWorkflow(s.Presentment, presentment)
+
+			assertSettled(t, env, d, authID, tt.amount)
+			assertDebits(t, s, testCustomer, 0, tt.amount)
+			if d.overdrawn[authID] != tt.wantOverdrawn {
+				t.Errorf("overdrawn %d, want %d", d.overdrawn[authID], tt.wantOverdrawn)
+			}
+			if _, ok := d.progress[presentment.WorkflowID]; ok {
+				t.Error("the presentment was recorded apart from the authorization")
+			}
+		})
+	}
+}
+
+func TestAuthorizationOverPresentment(t *testing.T) {
+	tests := []struct {
+		name    string
+		flagged bool
+		want    db.TransferProgress
+	}{
+		{"within the tolerance", false, db.TransferProgressSettled},
+		{"flagged beyond the tolerance", true, db.TransferProgressFlaggedOverPresentment},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestService(t)
+			env, d := newTestEnv(t, s)
+			auth := authorization(500)
+
+			signalAt(env, time.Minute, "presentment", auth.WorkflowID, PresentmentSignal{ID: auth.WorkflowID.String(), PresentmentID: uuid.Must(uuid.NewV4()), Amount: 550, Flagged: tt.flagged, Final: true})
+
+			env.ExecuteWorkflow(s.Authorization, auth)
+
+			// the hold is posted in full, the tip in a transfer of its own
+			assertSettled(t, env, d, auth.WorkflowID, 500)
+			assertDebits(t, s, testCustomer, 0, 550)
+			if got := d.progress[uuid.NewV5(auth.WorkflowID, "over-presentment")]; got != tt.want {
+				t.Errorf("over-presentment %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizationPartialCapture(t *testing.T) {
+	s := newTestService(t)
+	env, d := newTestEnv(t, s)
+	auth := authorization(500)
+
+	signalAt(env, time.Minute, "presentment", auth.WorkflowID, PresentmentSignal{ID: auth.WorkflowID.String(), PresentmentID: uuid.Must(uuid.NewV4()), Amount: 300, Final: true})
+
+	env.ExecuteWorkflow(s.Authorization, auth)
+
+	// the rest of the hold is released
+	assertSettled(t, env, d, auth.WorkflowID, 300)
+	assertDebits(t, s, testCustomer, 0, 300)
+}
+
+func TestAuthorizationMultiClearing(t *testing.T) {
+	s := newTestService(t)
+	env, d := newTestEnv(t, s)
+	auth := authorization(600)
+	second := uuid.Must(uuid.NewV4())
+
+	signalAt(env, time.Minute, "presentment", auth.WorkflowID, PresentmentSignal{ID: auth.WorkflowID.String(), PresentmentID: uuid.Must(uuid.NewV4()), Amount: 100})
+	signalAt(env, 2*time.Minute, "presentment", auth.WorkflowID, PresentmentSignal{ID: auth.WorkflowID.String(), PresentmentID: second, Amount: 200})
+	// a clearing signalled again isn't captured twice
+	signalAt(env, 3*time.Minute, "presentment", auth.WorkflowID, PresentmentSignal{ID: auth.WorkflowID.String(), PresentmentID: second, Amount: 200})
+	env.RegisterDelayedCallback(func() {
+		assertDebits(t, s, testCustomer, 300, 300)
+	}, 4*time.Minute)
+	signalAt(env, 5*time.Minute, "presentment", auth.WorkflowID, PresentmentSignal{ID: auth.WorkflowID.String(), PresentmentID: uuid.Must(uuid.NewV4()), Amount: 250, Final: true})
+
+	env.ExecuteWorkflow(s.Authorization, auth)
+
+	assertSettled(t, env, d, auth.WorkflowID, 550)
+	assertDebits(t, s, testCustomer, 0, 550)
+}
+
+func TestAuthorizationClearingLedgerFailure(t *testing.T) {
+	s := newTestService(t)
+	env, d := newTestEnv(t, s)
+	auth := authorization(500)
+
+	env.OnActivity(s.LedgerSvc.CaptureTransaction, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return(temporal.NewNonRetryableApplicationError("ledger unavailable", "ledger", nil))
+	signalAt(env, time.Minute, "presentment", auth.WorkflowID, PresentmentSignal{ID: auth.WorkflowID.String(), PresentmentID: uuid.Must(uuid.NewV4()), Amount: 100})
+
+	env.ExecuteWorkflow(s.Authorization, auth)
+
+	// the workflow fails with the ledger error once the failure is recorded
+	if env.GetWorkflowError() == nil {
+		t.Error("workflow succeeded, want the ledger error")
+	}
+	if d.progress[auth.WorkflowID] != db.TransferProgressFailedOnLedgerSettlement {
+		t.Errorf("authorization %s, want %s", d.progress[auth.WorkflowID], db.TransferProgressFailedOnLedgerSettlement)
+	}
+}